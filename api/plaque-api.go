@@ -1,10 +1,15 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"jkurtz678/moda-viewer/videoplayer"
 	"jkurtz678/moda-viewer/viewer"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -13,6 +18,7 @@ import (
 type PlaqueAPIHandler struct {
 	Viewer         *viewer.Viewer
 	PlaqueTemplate string
+	APIToken       string // bearer token required by requests that control the viewer, they are refused if empty
 	*httprouter.Router
 }
 
@@ -24,6 +30,22 @@ func NewPlaqueAPIHandler(viewer *viewer.Viewer) *PlaqueAPIHandler {
 	}
 	h.Router.GET("/", h.servePlaque)
 	h.Router.GET("/api/status", h.getStatus)
+	h.Router.GET("/api/events", h.streamStatus)
+	h.Router.GET("/api/processes", h.getProcesses)
+	h.Router.GET("/api/tokens", h.getTokens)
+	h.Router.GET("/api/cache", h.getCache)
+	h.Router.GET("/api/stage", h.getStage)
+	h.Router.POST("/api/stage", h.authorize(h.stagePlaylist))
+	h.Router.DELETE("/api/stage", h.authorize(h.cancelStage))
+	h.Router.POST("/api/player/next", h.authorize(h.control(h.Viewer.Next)))
+	h.Router.POST("/api/player/previous", h.authorize(h.control(h.Viewer.Previous)))
+	h.Router.POST("/api/player/pause", h.authorize(h.control(h.Viewer.Pause)))
+	h.Router.POST("/api/player/resume", h.authorize(h.control(h.Viewer.Resume)))
+	h.Router.POST("/api/player/seek", h.authorize(h.seek))
+	h.Router.POST("/api/player/goto/:tokenMetaID", h.authorize(h.gotoToken))
+	h.Router.GET("/api/display", h.getDisplay)
+	h.Router.POST("/api/display/on", h.authorize(h.setDisplayPower(true)))
+	h.Router.POST("/api/display/off", h.authorize(h.setDisplayPower(false)))
 	h.Router.ServeFiles("/ui/*filepath", http.Dir("ui"))
 	return h
 }
@@ -43,3 +65,201 @@ func (h *PlaqueAPIHandler) getStatus(w http.ResponseWriter, r *http.Request, par
 		json.NewEncoder(w).Encode(fmt.Sprintf("internal error %s", err))
 	}
 }
+
+// getProcesses returns restart counts and last exit reasons of the player and plaque processes
+func (h *PlaqueAPIHandler) getProcesses(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.Viewer.ProcessStatuses()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(fmt.Sprintf("internal error %s", err))
+	}
+}
+
+// streamStatus pushes viewer state to the plaque as server-sent events whenever it changes
+func (h *PlaqueAPIHandler) streamStatus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// comment lines keep idle connections from being closed by the webview or proxies
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	updates := h.Viewer.SubscribeState(r.Context())
+	for {
+		select {
+		case stateData, ok := <-updates:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(stateData)
+			if err != nil {
+				fmt.Fprintf(w, "event: error\ndata: %q\n\n", err.Error())
+				flusher.Flush()
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// authorize rejects requests without the api token as a bearer token
+func (h *PlaqueAPIHandler) authorize(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if h.APIToken == "" {
+			writeError(w, http.StatusForbidden, "player control is disabled, set api_token to enable it")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid api token")
+			return
+		}
+		handle(w, r, params)
+	}
+}
+
+// control returns a handler which runs a playback command
+func (h *PlaqueAPIHandler) control(command func() error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		err := command()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("player error %s", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type seekRequest struct {
+	Position float64 `json:"position"` // seconds into the current file
+}
+
+func (h *PlaqueAPIHandler) seek(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req seekRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Position < 0 {
+		writeError(w, http.StatusBadRequest, "body must be json with a non-negative position in seconds")
+		return
+	}
+	h.control(func() error { return h.Viewer.Seek(req.Position) })(w, r, params)
+}
+
+// gotoToken jumps to the media of a token in the playlist
+func (h *PlaqueAPIHandler) gotoToken(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	err := h.Viewer.PlayToken(params.ByName("tokenMetaID"))
+	if errors.Is(err, viewer.ErrTokenNotInPlaylist) || errors.Is(err, videoplayer.ErrInvalidIndex) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("player error %s", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTokens returns the load state of each token of the plaque, with the reason and next retry of those that failed
+func (h *PlaqueAPIHandler) getTokens(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.Viewer.TokenStatuses()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(fmt.Sprintf("internal error %s", err))
+	}
+}
+
+// getStage returns the prefetch progress of the staged token list, null if nothing is staged
+func (h *PlaqueAPIHandler) getStage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.Viewer.Stage()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(fmt.Sprintf("internal error %s", err))
+	}
+}
+
+type stageRequest struct {
+	TokenMetaIDList []string `json:"token_meta_id_list"` // tokens that replace the plaque tokens once their media is downloaded
+}
+
+// stagePlaylist starts downloading a token list in the background, it replaces the plaque tokens once all of it is local
+func (h *PlaqueAPIHandler) stagePlaylist(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req stageRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil {
+		err = h.Viewer.StagePlaylist(req.TokenMetaIDList)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "body must be json with a non-empty token_meta_id_list")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// cancelStage forgets the token list staged with the api
+func (h *PlaqueAPIHandler) cancelStage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.Viewer.CancelStage()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getCache returns the disk used by media files, with the last access and pin of each
+func (h *PlaqueAPIHandler) getCache(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	usage, err := h.Viewer.CacheUsage()
+	if errors.Is(err, viewer.ErrNoCache) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("internal error %s", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(usage)
+}
+
+// getDisplay returns whether the display is on and whether the viewer controls its power
+func (h *PlaqueAPIHandler) getDisplay(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(h.Viewer.DisplayPower()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(fmt.Sprintf("internal error %s", err))
+	}
+}
+
+func (h *PlaqueAPIHandler) setDisplayPower(on bool) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		err := h.Viewer.SetDisplayPower(r.Context(), on)
+		if errors.Is(err, viewer.ErrNoDisplayController) {
+			writeError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("display error %s", err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(msg)
+}
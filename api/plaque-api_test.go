@@ -6,10 +6,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"jkurtz678/moda-viewer/config"
+	"jkurtz678/moda-viewer/display"
 	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/process"
+	"jkurtz678/moda-viewer/storage"
+	"jkurtz678/moda-viewer/videoplayer"
 	"jkurtz678/moda-viewer/viewer"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -40,7 +46,7 @@ func TestPlaqueAPI(t *testing.T) {
 	g.Assert(ioutil.WriteFile(metaPath, file, 0644)).IsNil()
 
 	fstoreClientStub := &fstore.FstoreClientStub{}
-	v := viewer.NewViewer(fstoreClientStub, nil)
+	v := viewer.NewViewer(config.Default(), fstoreClientStub, nil)
 	v.PlaqueFile = configPath
 	v.MetadataDir = tmpdir
 
@@ -55,6 +61,152 @@ func TestPlaqueAPI(t *testing.T) {
 			g.Assert(strings.Contains(w.Body.String(), testMeta.TokenMeta.Name)).IsTrue()
 			g.Assert(strings.Contains(w.Body.String(), testMeta.TokenMeta.Artist)).IsTrue()
 		})
+
+		g.It("Should return player and plaque process status", func() {
+			w, r := testWR("GET", "/api/processes", "")
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(200)
+
+			var statuses []process.Status
+			g.Assert(json.Unmarshal(w.Body.Bytes(), &statuses)).IsNil()
+			g.Assert(len(statuses)).Equal(2)
+			g.Assert(statuses[0].Name).Equal("vlc")
+			g.Assert(statuses[1].Name).Equal("webview")
+			g.Assert(statuses[0].Running).IsFalse()
+			g.Assert(statuses[0].Restarts).Equal(0)
+		})
+
+		g.It("Should refuse player control without a valid api token", func() {
+			w, r := testWR("POST", "/api/player/next", "")
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(http.StatusForbidden)
+
+			h.APIToken = "secret"
+			defer func() { h.APIToken = "" }()
+			w, r = testWR("POST", "/api/player/next", "")
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(http.StatusUnauthorized)
+
+			w, r = testWR("POST", "/api/player/next", "")
+			r.Header.Set("Authorization", "Bearer wrong")
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(http.StatusUnauthorized)
+		})
+
+		g.It("Should control the player", func() {
+			h.APIToken = "secret"
+			defer func() { h.APIToken = "" }()
+			player := &videoplayer.VideoPlayerStub{}
+			player.PlayFilesWaitGroup.Add(1)
+			g.Assert(player.PlayFiles([]string{"s1.mp4", "s2.mp4"})).IsNil()
+			defaultPlayer := v.VideoPlayer
+			v.VideoPlayer = player
+			defer func() { v.VideoPlayer = defaultPlayer }()
+
+			authorized := func(method, path, body string) *httptest.ResponseRecorder {
+				w, r := testWR(method, path, body)
+				r.Header.Set("Authorization", "Bearer secret")
+				h.ServeHTTP(w, r)
+				return w
+			}
+
+			g.Assert(authorized("POST", "/api/player/next", "").Code).Equal(http.StatusNoContent)
+			g.Assert(player.ActiveIndex).Equal(1)
+			g.Assert(authorized("POST", "/api/player/previous", "").Code).Equal(http.StatusNoContent)
+			g.Assert(player.ActiveIndex).Equal(0)
+			g.Assert(authorized("POST", "/api/player/pause", "").Code).Equal(http.StatusNoContent)
+			g.Assert(player.Paused).IsTrue()
+			g.Assert(authorized("POST", "/api/player/resume", "").Code).Equal(http.StatusNoContent)
+			g.Assert(player.Paused).IsFalse()
+			g.Assert(authorized("POST", "/api/player/seek", `{"position": 30}`).Code).Equal(http.StatusNoContent)
+			g.Assert(player.Position).Equal(30.0)
+			g.Assert(authorized("POST", "/api/player/seek", `{"position": -1}`).Code).Equal(http.StatusBadRequest)
+
+			// only tokens in the playlist can be played
+			g.Assert(authorized("POST", "/api/player/goto/1", "").Code).Equal(http.StatusNotFound)
+		})
+
+		g.It("Should control the display power", func() {
+			h.APIToken = "secret"
+			defer func() { h.APIToken = "" }()
+			authorized := func(method, path string) *httptest.ResponseRecorder {
+				w, r := testWR(method, path, "")
+				r.Header.Set("Authorization", "Bearer secret")
+				h.ServeHTTP(w, r)
+				return w
+			}
+			g.Assert(authorized("POST", "/api/display/off").Code).Equal(http.StatusNotImplemented)
+
+			screen := &display.DisplayControllerStub{}
+			v.Display = screen
+			defer func() { v.Display = nil }()
+			g.Assert(authorized("POST", "/api/display/off").Code).Equal(http.StatusNoContent)
+			g.Assert(screen.Powered).IsFalse()
+
+			w := authorized("GET", "/api/display")
+			g.Assert(w.Code).Equal(http.StatusOK)
+			var data viewer.DisplayData
+			g.Assert(json.Unmarshal(w.Body.Bytes(), &data)).IsNil()
+			g.Assert(data).Equal(viewer.DisplayData{Controlled: true, On: false})
+
+			g.Assert(authorized("POST", "/api/display/on").Code).Equal(http.StatusNoContent)
+			g.Assert(screen.Powered).IsTrue()
+
+			screen.Err = fmt.Errorf("cec adapter not found")
+			g.Assert(authorized("POST", "/api/display/off").Code).Equal(http.StatusBadGateway)
+		})
+
+		g.It("Should return the token load states", func() {
+			w, r := testWR("GET", "/api/tokens", "")
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(http.StatusOK)
+			var statuses []viewer.TokenStatus
+			g.Assert(json.Unmarshal(w.Body.Bytes(), &statuses)).IsNil()
+			g.Assert(statuses).Equal([]viewer.TokenStatus{})
+		})
+
+		g.It("Should stage a token list", func() {
+			h.APIToken = "secret"
+			defer func() { h.APIToken = "" }()
+			authorized := func(method, path, body string) *httptest.ResponseRecorder {
+				w, r := testWR(method, path, body)
+				r.Header.Set("Authorization", "Bearer secret")
+				h.ServeHTTP(w, r)
+				return w
+			}
+			w, r := testWR("POST", "/api/stage", `{"token_meta_id_list": ["1"]}`)
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(http.StatusUnauthorized)
+			g.Assert(authorized("POST", "/api/stage", `{"token_meta_id_list": []}`).Code).Equal(http.StatusBadRequest)
+
+			// nothing is prefetched until the viewer starts, the stage is accepted and can be cancelled
+			g.Assert(authorized("POST", "/api/stage", `{"token_meta_id_list": ["1", "2"]}`).Code).Equal(http.StatusAccepted)
+			g.Assert(authorized("GET", "/api/stage", "").Body.String()).Equal("null\n")
+			g.Assert(authorized("DELETE", "/api/stage", "").Code).Equal(http.StatusNoContent)
+		})
+
+		g.It("Should report media cache usage", func() {
+			mediaDir, cache := v.MediaDir, v.Cache
+			defer func() { v.MediaDir, v.Cache = mediaDir, cache }()
+			v.MediaDir = filepath.Join(tmpdir, "media")
+			g.Assert(os.Mkdir(v.MediaDir, 0755)).IsNil()
+			g.Assert(ioutil.WriteFile(filepath.Join(v.MediaDir, "s1.mp4"), make([]byte, 10), 0644)).IsNil()
+			v.Cache = storage.NewCacheManager(v.MediaDir, 100)
+
+			w, r := testWR("GET", "/api/cache", "")
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(http.StatusOK)
+			var usage storage.CacheUsage
+			g.Assert(json.Unmarshal(w.Body.Bytes(), &usage)).IsNil()
+			g.Assert(usage.Used).Equal(int64(10))
+			g.Assert(usage.Quota).Equal(int64(100))
+			g.Assert(usage.Files[0].Name).Equal("s1.mp4")
+
+			v.Cache = nil
+			w, r = testWR("GET", "/api/cache", "")
+			h.ServeHTTP(w, r)
+			g.Assert(w.Code).Equal(http.StatusNotImplemented)
+		})
 	})
 }
 
@@ -0,0 +1,496 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// video player backends
+const (
+	PlayerVLC = "vlc"
+	PlayerMPV = "mpv"
+)
+
+// plaque and token meta databases
+const (
+	DBFirestore = "firestore"
+	DBLocal     = "local"
+)
+
+// display power controllers
+const (
+	DisplayNone = "none"
+	DisplayDPMS = "dpms"
+	DisplayCEC  = "cec"
+)
+
+// defaultConfigFile is loaded if present when no config file is specified with -config or MODA_CONFIG
+const defaultConfigFile = "config.yaml"
+
+// Config holds every setting needed to run a viewer, loaded from defaults, then a yaml/json file, then environment variables, then flags
+type Config struct {
+	ServiceAccountKey string          `yaml:"service_account_key"` // file path to firebase credentials
+	StorageBucket     string          `yaml:"storage_bucket"`      // url of firebase storage bucket holding archive media
+	PlaqueFile        string          `yaml:"plaque_file"`         // local copy of the plaque document for this viewer
+	MediaDir          string          `yaml:"media_dir"`           // directory where media files are stored
+	MetadataDir       string          `yaml:"metadata_dir"`        // directory where token meta json files are stored
+	ListenAddr        string          `yaml:"listen_addr"`         // address the plaque api listens on
+	PlaqueURL         string          `yaml:"plaque_url"`          // url opened by the plaque webview, derived from listen_addr if empty
+	APIToken          string          `yaml:"api_token"`           // bearer token required by api requests that control playback, control is disabled if empty
+	DB                string          `yaml:"db"`                  // plaque and token meta database, firestore or local
+	LocalDBDir        string          `yaml:"local_db_dir"`        // directory of plaque and token meta json files when db is local
+	Player            string          `yaml:"player"`              // video player backend, vlc or mpv
+	VLC               VLCConfig       `yaml:"vlc"`
+	MPV               MPVConfig       `yaml:"mpv"`
+	Downloads         DownloadsConfig `yaml:"downloads"`
+	Display           DisplayConfig   `yaml:"display"`
+	Cache             CacheConfig     `yaml:"cache"`
+	Media             MediaConfig     `yaml:"media"`
+}
+
+// VLCConfig holds settings for the http interface of the vlc player
+type VLCConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Password string `yaml:"password"`
+}
+
+// MPVConfig holds settings for the json ipc interface of the mpv player
+type MPVConfig struct {
+	Socket string `yaml:"socket"` // path of the unix socket mpv listens on
+}
+
+// DownloadsConfig holds settings for media downloads
+type DownloadsConfig struct {
+	Workers       int `yaml:"workers"`        // number of media files downloaded at once
+	PlaybackStart int `yaml:"playback_start"` // playback starts once this many files at the start of the playlist are ready, 0 waits for every file
+}
+
+// DisplayConfig holds settings for turning the screen off while the plaque schedule has the display off
+type DisplayConfig struct {
+	Controller string `yaml:"controller"`  // none, dpms or cec
+	XDisplay   string `yaml:"x_display"`   // X display controlled with dpms such as ':0', empty uses $DISPLAY
+	CECAddress string `yaml:"cec_address"` // cec logical address of the tv, '0' in most installs
+}
+
+// CacheConfig holds settings for the media files kept in media_dir
+type CacheConfig struct {
+	QuotaMB int `yaml:"quota_mb"` // megabytes media files may use, least recently used media not on the plaque is evicted above it, 0 keeps every file
+}
+
+// MediaConfig holds settings for probing downloaded media and transcoding what the device cannot play smoothly
+type MediaConfig struct {
+	FFprobe     string `yaml:"ffprobe"`      // path of ffprobe used to probe downloaded media, empty disables probing
+	FFmpeg      string `yaml:"ffmpeg"`       // path of ffmpeg used to transcode media beyond the device profile, empty disables transcoding
+	MaxWidth    int    `yaml:"max_width"`    // largest video the device decodes smoothly in either orientation, 0 is no limit
+	MaxHeight   int    `yaml:"max_height"`   // 0 is no limit
+	VideoCodecs string `yaml:"video_codecs"` // comma separated ffprobe names of the video codecs the device decodes smoothly, empty allows any
+}
+
+// VideoCodecList returns the video codecs of the device profile
+func (m MediaConfig) VideoCodecList() []string {
+	codecs := make([]string, 0)
+	for _, codec := range strings.Split(m.VideoCodecs, ",") {
+		if codec = strings.TrimSpace(codec); codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// Default returns a config matching the original single viewer setup
+func Default() *Config {
+	return &Config{
+		ServiceAccountKey: "./serviceAccountKey.json",
+		StorageBucket:     "moda-archive.appspot.com",
+		PlaqueFile:        "plaque.json",
+		MediaDir:          "media",
+		MetadataDir:       "metadata",
+		ListenAddr:        "127.0.0.1:8080",
+		DB:                DBFirestore,
+		LocalDBDir:        "db",
+		Player:            PlayerVLC,
+		VLC: VLCConfig{
+			Host:     "127.0.0.1",
+			Port:     9090,
+			Password: "m0da",
+		},
+		MPV: MPVConfig{
+			Socket: filepath.Join(os.TempDir(), "moda-mpv.sock"),
+		},
+		Downloads: DownloadsConfig{
+			Workers:       3,
+			PlaybackStart: 1,
+		},
+		Display: DisplayConfig{
+			Controller: DisplayNone,
+			CECAddress: "0",
+		},
+		Media: MediaConfig{
+			FFprobe:     "ffprobe",
+			MaxWidth:    1920,
+			MaxHeight:   1080,
+			VideoCodecs: "h264,hevc",
+		},
+	}
+}
+
+// ValidationError lists every problem found with a config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v config problem(s):\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// Load builds a config from a file, environment variables and command line args, and validates the result
+// precedence from lowest to highest is defaults, config file, environment, flags
+func Load(args []string) (*Config, error) {
+	path, explicit, err := configPath(args)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	problems := make([]string, 0)
+
+	if path != "" {
+		err = cfg.readFile(path)
+		if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+			problems = append(problems, fmt.Sprintf("config file %s: %v", path, err))
+		}
+	}
+
+	problems = append(problems, cfg.applyEnv()...)
+
+	fs := cfg.flagSet(new(string))
+	fs.SetOutput(io.Discard)
+	flagProblems, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, flagProblems...)
+
+	cfg.resolve()
+
+	if err := cfg.Validate(); err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			problems = append(problems, verr.Problems...)
+		} else {
+			return nil, err
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// Validate checks every field and returns a ValidationError listing all problems found
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// a local database runs without firebase credentials, only archive media downloads need them
+	switch c.DB {
+	case DBFirestore:
+		if c.ServiceAccountKey == "" {
+			add("service_account_key: must be set")
+		} else if _, err := os.Stat(c.ServiceAccountKey); err != nil {
+			add("service_account_key: %v", err)
+		}
+	case DBLocal:
+		if c.LocalDBDir == "" {
+			add("local_db_dir: must be set")
+		}
+	default:
+		add("db: %q must be %s or %s", c.DB, DBFirestore, DBLocal)
+	}
+	if c.StorageBucket == "" {
+		add("storage_bucket: must be set")
+	}
+	if c.PlaqueFile == "" {
+		add("plaque_file: must be set")
+	}
+	if c.MediaDir == "" {
+		add("media_dir: must be set")
+	}
+	if c.MetadataDir == "" {
+		add("metadata_dir: must be set")
+	}
+
+	listenPort := ""
+	if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		add("listen_addr: %v", err)
+	} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		add("listen_addr: invalid port %q", port)
+	} else {
+		listenPort = port
+	}
+
+	// an empty plaque url is derived from listen_addr, so it is only a problem of its own if listen_addr is valid
+	if c.PlaqueURL != "" || listenPort != "" {
+		if u, err := url.Parse(c.PlaqueURL); err != nil {
+			add("plaque_url: %v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("plaque_url: %q must be an absolute http(s) url", c.PlaqueURL)
+		}
+	}
+
+	// settings of the player backend that is not used are ignored
+	switch c.Player {
+	case PlayerVLC:
+		if c.VLC.Host == "" {
+			add("vlc.host: must be set")
+		}
+		if c.VLC.Port < 1 || c.VLC.Port > 65535 {
+			add("vlc.port: %v is out of range", c.VLC.Port)
+		} else if strconv.Itoa(c.VLC.Port) == listenPort {
+			add("vlc.port: %v is already used by listen_addr", c.VLC.Port)
+		}
+		if c.VLC.Password == "" {
+			add("vlc.password: must be set, vlc refuses http requests without a password")
+		}
+	case PlayerMPV:
+		if c.MPV.Socket == "" {
+			add("mpv.socket: must be set")
+		}
+	default:
+		add("player: %q must be %s or %s", c.Player, PlayerVLC, PlayerMPV)
+	}
+
+	if c.Downloads.Workers < 1 {
+		add("downloads.workers: must be at least 1")
+	}
+	if c.Downloads.PlaybackStart < 0 {
+		add("downloads.playback_start: must not be negative")
+	}
+
+	// the cache evicts any file in media_dir, so it must not hold the token metas
+	if c.Cache.QuotaMB < 0 {
+		add("cache.quota_mb: must not be negative")
+	} else if c.Cache.QuotaMB > 0 && c.MediaDir != "" && filepath.Clean(c.MediaDir) == filepath.Clean(c.MetadataDir) {
+		add("media_dir: must differ from metadata_dir when cache.quota_mb is set")
+	}
+
+	if c.Media.MaxWidth < 0 {
+		add("media.max_width: must not be negative")
+	}
+	if c.Media.MaxHeight < 0 {
+		add("media.max_height: must not be negative")
+	}
+	if c.Media.FFmpeg != "" && c.Media.FFprobe == "" {
+		add("media.ffprobe: must be set when media.ffmpeg is set")
+	}
+	// renditions are h264, so the profile must allow them to be played
+	if codecs := c.Media.VideoCodecList(); c.Media.FFmpeg != "" && len(codecs) > 0 {
+		h264 := false
+		for _, codec := range codecs {
+			h264 = h264 || codec == "h264"
+		}
+		if !h264 {
+			add("media.video_codecs: must include h264 when media.ffmpeg is set")
+		}
+	}
+
+	switch c.Display.Controller {
+	case DisplayNone, DisplayDPMS:
+	case DisplayCEC:
+		if c.Display.CECAddress == "" {
+			add("display.cec_address: must be set")
+		}
+	default:
+		add("display.controller: %q must be %s, %s or %s", c.Display.Controller, DisplayNone, DisplayDPMS, DisplayCEC)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// resolve fills in values derived from other fields
+func (c *Config) resolve() {
+	if c.PlaqueURL != "" {
+		return
+	}
+	host, port, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		return // reported by Validate
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	c.PlaqueURL = fmt.Sprintf("http://%s", net.JoinHostPort(host, port))
+}
+
+// readFile decodes a yaml or json file over the current values, unknown keys are reported as errors
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err == io.EOF { // empty file
+		return nil
+	}
+	return err
+}
+
+// applyEnv overrides values with any environment variables that are set, returning a problem for each that fails to parse
+func (c *Config) applyEnv() []string {
+	problems := make([]string, 0)
+	for _, f := range c.fields() {
+		val, ok := os.LookupEnv(f.env)
+		if !ok {
+			continue
+		}
+		if err := f.value.Set(val); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", f.env, err))
+		}
+	}
+	return problems
+}
+
+// flagSet returns a flag set bound to the config fields, configFile receives the -config value
+func (c *Config) flagSet(configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("moda-viewer", flag.ContinueOnError)
+	fs.StringVar(configFile, "config", "", "path to yaml or json config file (env MODA_CONFIG)")
+	for _, f := range c.fields() {
+		fs.Var(f.value, f.flag, fmt.Sprintf("%s (env %s)", f.usage, f.env))
+	}
+	return fs
+}
+
+// configPath returns the config file to load and whether it was explicitly requested
+func configPath(args []string) (string, bool, error) {
+	var path string
+	fs := Default().flagSet(&path)
+	// invalid flags are reported by Load along with every other problem, only -h prints usage
+	fs.SetOutput(io.Discard)
+	if _, err := parseFlags(fs, args); err != nil {
+		fs.SetOutput(os.Stderr)
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		return "", false, err
+	}
+	if path != "" {
+		return path, true, nil
+	}
+	if env := os.Getenv("MODA_CONFIG"); env != "" {
+		return env, true, nil
+	}
+	return defaultConfigFile, false, nil
+}
+
+// parseFlags parses args into fs, carrying on past each invalid flag and returning a problem for it
+// only flag.ErrHelp is returned as an error, so the caller can print usage
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	problems := make([]string, 0)
+	for {
+		err := fs.Parse(args)
+		if err == nil {
+			return problems, nil
+		}
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		// the flag set stops at the invalid flag, the args after it are left to parse
+		// a flag with bad syntax is not consumed, so it is dropped here to not parse it again
+		problems = append(problems, err.Error())
+		rest := fs.Args()
+		if len(rest) >= len(args) {
+			rest = rest[1:]
+		}
+		args = rest
+	}
+}
+
+// field is a setting which can be overridden by an environment variable and a flag
+type field struct {
+	flag  string
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) fields() []field {
+	return []field{
+		{"service-account-key", "MODA_SERVICE_ACCOUNT_KEY", "file path to firebase credentials", (*stringValue)(&c.ServiceAccountKey)},
+		{"storage-bucket", "MODA_STORAGE_BUCKET", "firebase storage bucket for archive media", (*stringValue)(&c.StorageBucket)},
+		{"plaque-file", "MODA_PLAQUE_FILE", "local plaque file", (*stringValue)(&c.PlaqueFile)},
+		{"media-dir", "MODA_MEDIA_DIR", "directory where media files are stored", (*stringValue)(&c.MediaDir)},
+		{"metadata-dir", "MODA_METADATA_DIR", "directory where token meta files are stored", (*stringValue)(&c.MetadataDir)},
+		{"listen", "MODA_LISTEN_ADDR", "address the plaque api listens on", (*stringValue)(&c.ListenAddr)},
+		{"plaque-url", "MODA_PLAQUE_URL", "url opened by the plaque webview", (*stringValue)(&c.PlaqueURL)},
+		{"api-token", "MODA_API_TOKEN", "bearer token required to control playback through the api", (*stringValue)(&c.APIToken)},
+		{"db", "MODA_DB", "plaque and token meta database, firestore or local", (*stringValue)(&c.DB)},
+		{"local-db-dir", "MODA_LOCAL_DB_DIR", "directory of plaque and token meta files when db is local", (*stringValue)(&c.LocalDBDir)},
+		{"player", "MODA_PLAYER", "video player backend, vlc or mpv", (*stringValue)(&c.Player)},
+		{"vlc-host", "MODA_VLC_HOST", "host of the vlc http interface", (*stringValue)(&c.VLC.Host)},
+		{"vlc-port", "MODA_VLC_PORT", "port of the vlc http interface", (*intValue)(&c.VLC.Port)},
+		{"vlc-password", "MODA_VLC_PASSWORD", "password of the vlc http interface", (*stringValue)(&c.VLC.Password)},
+		{"mpv-socket", "MODA_MPV_SOCKET", "path of the mpv ipc socket", (*stringValue)(&c.MPV.Socket)},
+		{"download-workers", "MODA_DOWNLOAD_WORKERS", "number of media files downloaded at once", (*intValue)(&c.Downloads.Workers)},
+		{"playback-start", "MODA_PLAYBACK_START", "number of files ready before playback starts, 0 waits for all", (*intValue)(&c.Downloads.PlaybackStart)},
+		{"display-controller", "MODA_DISPLAY_CONTROLLER", "display power controller, none, dpms or cec", (*stringValue)(&c.Display.Controller)},
+		{"x-display", "MODA_X_DISPLAY", "X display controlled with dpms", (*stringValue)(&c.Display.XDisplay)},
+		{"cec-address", "MODA_CEC_ADDRESS", "cec logical address of the tv", (*stringValue)(&c.Display.CECAddress)},
+		{"cache-quota-mb", "MODA_CACHE_QUOTA_MB", "megabytes of media kept in media dir, 0 keeps every file", (*intValue)(&c.Cache.QuotaMB)},
+		{"ffprobe", "MODA_FFPROBE", "path of ffprobe used to probe downloaded media, empty disables probing", (*stringValue)(&c.Media.FFprobe)},
+		{"ffmpeg", "MODA_FFMPEG", "path of ffmpeg used to transcode media the device cannot play, empty disables transcoding", (*stringValue)(&c.Media.FFmpeg)},
+		{"media-max-width", "MODA_MEDIA_MAX_WIDTH", "largest video width the device plays smoothly, 0 is no limit", (*intValue)(&c.Media.MaxWidth)},
+		{"media-max-height", "MODA_MEDIA_MAX_HEIGHT", "largest video height the device plays smoothly, 0 is no limit", (*intValue)(&c.Media.MaxHeight)},
+		{"media-video-codecs", "MODA_MEDIA_VIDEO_CODECS", "comma separated video codecs the device plays smoothly, empty allows any", (*stringValue)(&c.Media.VideoCodecs)},
+	}
+}
+
+type stringValue string
+
+func (s *stringValue) Set(val string) error {
+	*s = stringValue(val)
+	return nil
+}
+
+func (s *stringValue) String() string {
+	if s == nil {
+		return ""
+	}
+	return string(*s)
+}
+
+type intValue int
+
+func (i *intValue) Set(val string) error {
+	v, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", val)
+	}
+	*i = intValue(v)
+	return nil
+}
+
+func (i *intValue) String() string {
+	if i == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*i))
+}
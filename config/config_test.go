@@ -0,0 +1,220 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+
+	keyPath := filepath.Join(tmpdir, "key.json")
+	a.NoError(ioutil.WriteFile(keyPath, []byte("{}"), 0644))
+
+	configPath := filepath.Join(tmpdir, "viewer.yaml")
+	a.NoError(ioutil.WriteFile(configPath, []byte(`
+service_account_key: `+keyPath+`
+media_dir: /srv/media
+listen_addr: 127.0.0.1:8081
+vlc:
+  port: 9091
+`), 0644))
+
+	a.NoError(os.Setenv("MODA_MEDIA_DIR", "/srv/env-media"))
+	a.NoError(os.Setenv("MODA_VLC_PORT", "9092"))
+	defer os.Unsetenv("MODA_MEDIA_DIR")
+	defer os.Unsetenv("MODA_VLC_PORT")
+
+	cfg, err := Load([]string{"-config", configPath, "-vlc-port", "9093"})
+	a.NoError(err)
+
+	a.Equal(keyPath, cfg.ServiceAccountKey)                // from file
+	a.Equal("moda-archive.appspot.com", cfg.StorageBucket) // default
+	a.Equal("/srv/env-media", cfg.MediaDir)                // env overrides file
+	a.Equal(9093, cfg.VLC.Port)                            // flag overrides env
+	a.Equal("http://127.0.0.1:8081", cfg.PlaqueURL)        // derived from listen addr
+}
+
+func TestLoadJSON(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+
+	keyPath := filepath.Join(tmpdir, "key.json")
+	a.NoError(ioutil.WriteFile(keyPath, []byte("{}"), 0644))
+
+	configPath := filepath.Join(tmpdir, "viewer.json")
+	a.NoError(ioutil.WriteFile(configPath, []byte(`{"service_account_key": "`+keyPath+`", "listen_addr": "0.0.0.0:8082"}`), 0644))
+
+	cfg, err := Load([]string{"-config", configPath})
+	a.NoError(err)
+	a.Equal("0.0.0.0:8082", cfg.ListenAddr)
+	a.Equal("http://localhost:8082", cfg.PlaqueURL)
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+
+	configPath := filepath.Join(tmpdir, "viewer.yaml")
+	a.NoError(ioutil.WriteFile(configPath, []byte(`
+service_account_key: `+filepath.Join(tmpdir, "missing.json")+`
+storage_bucket: ""
+listen_addr: localhost
+vlc:
+  port: 70000
+  password: ""
+downloads:
+  workers: 0
+`), 0644))
+
+	a.NoError(os.Setenv("MODA_VLC_PORT", "not-a-port"))
+	defer os.Unsetenv("MODA_VLC_PORT")
+
+	_, err := Load([]string{"-config", configPath})
+	var verr *ValidationError
+	a.True(errors.As(err, &verr))
+	a.Len(verr.Problems, 7)
+
+	// invalid flags are reported with the rest, flags after them still apply
+	_, err = Load([]string{"-config", configPath, "-download-workers", "many", "-unknown", "-vlc-password", "m0da"})
+	a.True(errors.As(err, &verr))
+	a.Len(verr.Problems, 8)
+	a.Contains(verr.Error(), `invalid value "many" for flag -download-workers`)
+	a.Contains(verr.Error(), "flag provided but not defined: -unknown")
+	a.NotContains(verr.Error(), "vlc.password")
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		problems []string
+	}{
+		{"valid flags", []string{"-vlc-password", "m0da"}, []string{}},
+		{"three dashes", []string{"---x", "-vlc-password", "m0da"}, []string{"bad flag syntax: ---x"}},
+		{"no flag name", []string{"-=x", "-vlc-password", "m0da"}, []string{"bad flag syntax: -=x"}},
+		{"trailing flag without value", []string{"-vlc-password", "m0da", "-vlc-port"}, []string{"flag needs an argument: -vlc-port"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			c := Default()
+			var configFile string
+			fs := c.flagSet(&configFile)
+			fs.SetOutput(ioutil.Discard)
+			problems, err := parseFlags(fs, tt.args)
+			a.NoError(err)
+			a.Equal(tt.problems, problems)
+			a.Equal("m0da", c.VLC.Password, "flags around the invalid one still apply")
+		})
+	}
+}
+
+func TestLoadPlayer(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+
+	keyPath := filepath.Join(tmpdir, "key.json")
+	a.NoError(ioutil.WriteFile(keyPath, []byte("{}"), 0644))
+
+	// vlc settings are not checked when mpv is used
+	cfg, err := Load([]string{"-service-account-key", keyPath, "-player", "mpv", "-mpv-socket", "/run/mpv.sock", "-vlc-password", ""})
+	a.NoError(err)
+	a.Equal(PlayerMPV, cfg.Player)
+	a.Equal("/run/mpv.sock", cfg.MPV.Socket)
+
+	_, err = Load([]string{"-service-account-key", keyPath, "-player", "mplayer"})
+	var verr *ValidationError
+	a.True(errors.As(err, &verr))
+	a.Equal([]string{`player: "mplayer" must be vlc or mpv`}, verr.Problems)
+}
+
+func TestLoadDisplay(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+
+	keyPath := filepath.Join(tmpdir, "key.json")
+	a.NoError(ioutil.WriteFile(keyPath, []byte("{}"), 0644))
+
+	cfg, err := Load([]string{"-service-account-key", keyPath})
+	a.NoError(err)
+	a.Equal(DisplayNone, cfg.Display.Controller)
+
+	cfg, err = Load([]string{"-service-account-key", keyPath, "-display-controller", "cec", "-cec-address", "4"})
+	a.NoError(err)
+	a.Equal(DisplayCEC, cfg.Display.Controller)
+	a.Equal("4", cfg.Display.CECAddress)
+
+	_, err = Load([]string{"-service-account-key", keyPath, "-display-controller", "hdmi"})
+	var verr *ValidationError
+	a.True(errors.As(err, &verr))
+	a.Equal([]string{`display.controller: "hdmi" must be none, dpms or cec`}, verr.Problems)
+}
+
+func TestLoadLocalDB(t *testing.T) {
+	a := assert.New(t)
+	missingKey := filepath.Join(t.TempDir(), "missing.json")
+
+	// firebase credentials are not needed with a local database
+	cfg, err := Load([]string{"-service-account-key", missingKey, "-db", "local", "-local-db-dir", "/var/lib/moda"})
+	a.NoError(err)
+	a.Equal(DBLocal, cfg.DB)
+	a.Equal("/var/lib/moda", cfg.LocalDBDir)
+
+	_, err = Load([]string{"-service-account-key", missingKey, "-db", "sqlite"})
+	var verr *ValidationError
+	a.True(errors.As(err, &verr))
+	a.Equal([]string{`db: "sqlite" must be firestore or local`}, verr.Problems)
+}
+
+func TestLoadCache(t *testing.T) {
+	a := assert.New(t)
+	missingKey := filepath.Join(t.TempDir(), "missing.json")
+
+	cfg, err := Load([]string{"-db", "local", "-service-account-key", missingKey, "-cache-quota-mb", "24000"})
+	a.NoError(err)
+	a.Equal(24000, cfg.Cache.QuotaMB)
+
+	_, err = Load([]string{"-db", "local", "-service-account-key", missingKey, "-cache-quota-mb", "100", "-media-dir", "data", "-metadata-dir", "data/"})
+	var verr *ValidationError
+	a.True(errors.As(err, &verr))
+	a.Equal([]string{"media_dir: must differ from metadata_dir when cache.quota_mb is set"}, verr.Problems)
+}
+
+func TestLoadMedia(t *testing.T) {
+	a := assert.New(t)
+	missingKey := filepath.Join(t.TempDir(), "missing.json")
+
+	cfg, err := Load([]string{"-db", "local", "-service-account-key", missingKey})
+	a.NoError(err)
+	a.Equal("ffprobe", cfg.Media.FFprobe)
+	a.Equal([]string{"h264", "hevc"}, cfg.Media.VideoCodecList())
+
+	cfg, err = Load([]string{"-db", "local", "-service-account-key", missingKey, "-ffmpeg", "/usr/bin/ffmpeg", "-media-video-codecs", " h264, vp9 ,"})
+	a.NoError(err)
+	a.Equal([]string{"h264", "vp9"}, cfg.Media.VideoCodecList())
+
+	_, err = Load([]string{"-db", "local", "-service-account-key", missingKey, "-ffmpeg", "ffmpeg", "-ffprobe", "", "-media-video-codecs", "hevc", "-media-max-width", "-1"})
+	var verr *ValidationError
+	a.True(errors.As(err, &verr))
+	a.Equal([]string{
+		"media.max_width: must not be negative",
+		"media.ffprobe: must be set when media.ffmpeg is set",
+		"media.video_codecs: must include h264 when media.ffmpeg is set",
+	}, verr.Problems)
+}
+
+func TestLoadMissingConfigFile(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")})
+	var verr *ValidationError
+	a.True(errors.As(err, &verr))
+	a.Contains(verr.Error(), "missing.yaml")
+}
@@ -0,0 +1,31 @@
+package display
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// CECDisplay turns a tv on and off over HDMI-CEC with cec-client from libcec
+type CECDisplay struct {
+	Address string // cec logical address of the tv, '0' in most installs
+	command commandFunc
+}
+
+func NewCECDisplay(address string) *CECDisplay {
+	return &CECDisplay{Address: address, command: exec.Command}
+}
+
+func (c *CECDisplay) On(ctx context.Context) error {
+	return c.send(ctx, fmt.Sprintf("on %s", c.Address))
+}
+
+// Off puts the tv in standby, it stays reachable over cec to be turned back on
+func (c *CECDisplay) Off(ctx context.Context) error {
+	return c.send(ctx, fmt.Sprintf("standby %s", c.Address))
+}
+
+// send runs cec-client in single command mode with minimal logging, reading the command from stdin
+func (c *CECDisplay) send(ctx context.Context, command string) error {
+	return runCommand(ctx, c.command, command+"\n", "cec-client", "-s", "-d", "1")
+}
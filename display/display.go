@@ -0,0 +1,45 @@
+package display
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"jkurtz678/moda-viewer/process"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "[display] - ", log.Ldate|log.Ltime|log.Lshortfile)
+
+// commandTimeout limits how long a single power command may take, cec-client can hang when no adapter answers
+const commandTimeout = 15 * time.Second
+
+// DisplayController turns the screen showing the viewer on and off
+type DisplayController interface {
+	On(ctx context.Context) error
+	Off(ctx context.Context) error
+}
+
+// commandFunc builds the command for a program, replaced in tests
+type commandFunc func(name string, args ...string) *exec.Cmd
+
+// runCommand runs a power command with stdin as its input, including its output in the error if it fails
+func runCommand(ctx context.Context, command commandFunc, stdin string, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	cmd := command(name, args...)
+	var output bytes.Buffer
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	logger.Printf("running %s %s", name, strings.Join(args, " "))
+	err := process.Run(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
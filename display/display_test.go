@@ -0,0 +1,72 @@
+package display
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helperCommand returns a command func which runs TestHelperProcess in a child test binary in place of the real program
+// calls receives the program name, args and stdin of every command run
+func helperCommand(fail bool, calls *[]string) commandFunc {
+	return func(name string, args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProcess", "--", name}, args...)...)
+		cmd.Env = append(os.Environ(), "MODA_HELPER_PROCESS=1")
+		if fail {
+			cmd.Env = append(cmd.Env, "MODA_HELPER_FAIL=1")
+		}
+		*calls = append(*calls, strings.Join(append([]string{name}, args...), " "))
+		return cmd
+	}
+}
+
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("MODA_HELPER_PROCESS") != "1" {
+		return
+	}
+	stdin, _ := ioutil.ReadAll(os.Stdin)
+	if os.Getenv("MODA_HELPER_FAIL") == "1" {
+		fmt.Printf("no adapter found for %q", strings.TrimSpace(string(stdin)))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestDPMSDisplay(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	calls := make([]string, 0)
+
+	d := NewDPMSDisplay(":0")
+	d.command = helperCommand(false, &calls)
+	a.NoError(d.Off(ctx))
+	a.NoError(d.On(ctx))
+
+	d = NewDPMSDisplay("")
+	d.command = helperCommand(false, &calls)
+	a.NoError(d.Off(ctx))
+	a.Equal([]string{"xset -display :0 dpms force off", "xset -display :0 dpms force on", "xset dpms force off"}, calls)
+}
+
+func TestCECDisplay(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	calls := make([]string, 0)
+
+	c := NewCECDisplay("0")
+	c.command = helperCommand(false, &calls)
+	a.NoError(c.Off(ctx))
+	a.Equal([]string{"cec-client -s -d 1"}, calls)
+
+	// output of a failed command explains the error
+	c.command = helperCommand(true, &calls)
+	err := c.On(ctx)
+	a.Error(err)
+	a.Contains(err.Error(), `no adapter found for "on 0"`)
+}
@@ -0,0 +1,31 @@
+package display
+
+import (
+	"context"
+	"os/exec"
+)
+
+// DPMSDisplay turns a monitor on and off through the X server with xset dpms
+type DPMSDisplay struct {
+	XDisplay string // X display to control such as ':0', empty uses $DISPLAY
+	command  commandFunc
+}
+
+func NewDPMSDisplay(xDisplay string) *DPMSDisplay {
+	return &DPMSDisplay{XDisplay: xDisplay, command: exec.Command}
+}
+
+func (d *DPMSDisplay) On(ctx context.Context) error {
+	return d.xset(ctx, "dpms", "force", "on")
+}
+
+func (d *DPMSDisplay) Off(ctx context.Context) error {
+	return d.xset(ctx, "dpms", "force", "off")
+}
+
+func (d *DPMSDisplay) xset(ctx context.Context, args ...string) error {
+	if d.XDisplay != "" {
+		args = append([]string{"-display", d.XDisplay}, args...)
+	}
+	return runCommand(ctx, d.command, "", "xset", args...)
+}
@@ -0,0 +1,28 @@
+package display
+
+import "context"
+
+// DisplayControllerStub records power changes for tests
+type DisplayControllerStub struct {
+	Powered bool // true once turned on, false once turned off
+	Calls   int  // number of power changes requested
+	Err     error
+}
+
+func (d *DisplayControllerStub) On(ctx context.Context) error {
+	d.Calls++
+	if d.Err != nil {
+		return d.Err
+	}
+	d.Powered = true
+	return nil
+}
+
+func (d *DisplayControllerStub) Off(ctx context.Context) error {
+	d.Calls++
+	if d.Err != nil {
+		return d.Err
+	}
+	d.Powered = false
+	return nil
+}
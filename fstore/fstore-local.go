@@ -0,0 +1,270 @@
+package fstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/storage"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDocumentNotFound is returned by LocalClient when no file exists for a document id
+var ErrDocumentNotFound = errors.New("document not found")
+
+// defaultPollInterval is how often ListenPlaque checks a local plaque file for changes
+const defaultPollInterval = time.Second
+
+// documentIDChars are the characters of generated document ids, matching firestore auto ids
+const documentIDChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// LocalClient is a DBClient storing documents as json files in a local directory, for installations without internet
+// documents are stored at <dir>/<collection>/<document id>.json using the json field names, so they can be edited by hand
+type LocalClient struct {
+	Dir          string
+	PollInterval time.Duration // how often ListenPlaque checks the plaque file for changes
+
+	lock sync.Mutex // held while a document is read and rewritten by an update
+}
+
+// NewLocalClient returns a client storing documents in dir, creating the collection directories if needed
+func NewLocalClient(dir string) (*LocalClient, error) {
+	for _, collection := range []string{plaqueCollection, tokenMetaCollection} {
+		err := os.MkdirAll(filepath.Join(dir, collection), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("NewLocalClient - failed to create %s directory %s", collection, err)
+		}
+	}
+	return &LocalClient{Dir: dir, PollInterval: defaultPollInterval}, nil
+}
+
+// CreatePlaque creates a plaque file and returns the firestore version of it
+func (lc *LocalClient) CreatePlaque(ctx context.Context, plaque *Plaque) (*FirestorePlaque, error) {
+	documentID, err := lc.create(plaqueCollection, plaque)
+	if err != nil {
+		return nil, err
+	}
+	return &FirestorePlaque{Plaque: *plaque, DocumentID: documentID}, nil
+}
+
+// GetPlaque returns a plaque by document id
+func (lc *LocalClient) GetPlaque(ctx context.Context, documentID string) (*FirestorePlaque, error) {
+	plaque := new(Plaque)
+	err := lc.read(plaqueCollection, documentID, plaque)
+	if err != nil {
+		return nil, err
+	}
+	return &FirestorePlaque{Plaque: *plaque, DocumentID: documentID}, nil
+}
+
+// UpdatePlaque applies patch to the given document
+func (lc *LocalClient) UpdatePlaque(ctx context.Context, documentID string, patch *PlaquePatch) error {
+	updates, err := patch.fieldUpdates()
+	if err != nil {
+		return err
+	}
+	return lc.update(plaqueCollection, documentID, updates, new(Plaque))
+}
+
+// ListenPlaque calls the callback function with the plaque immediately, then each time the plaque file changes, until ctx is done
+// a file that is not valid json, such as one saved halfway through a hand edit, is skipped until it changes again
+func (lc *LocalClient) ListenPlaque(ctx context.Context, documentID string, cb func(plaque *FirestorePlaque) error) error {
+	path, err := lc.path(plaqueCollection, documentID)
+	if err != nil {
+		return err
+	}
+	interval := lc.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []byte
+	for {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("LocalClient.ListenPlaque - %w: %s", ErrDocumentNotFound, documentID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(data, last) {
+			last = data
+			plaque := new(Plaque)
+			err = json.Unmarshal(data, plaque)
+			if err != nil {
+				logger.Printf("LocalClient.ListenPlaque - ignoring invalid plaque file %s: %v", path, err)
+			} else {
+				err = cb(&FirestorePlaque{Plaque: *plaque, DocumentID: documentID})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CreateTokenMeta creates a token meta file and returns the firestore version of it
+func (lc *LocalClient) CreateTokenMeta(ctx context.Context, tokenMeta *TokenMeta) (*FirestoreTokenMeta, error) {
+	documentID, err := lc.create(tokenMetaCollection, tokenMeta)
+	if err != nil {
+		return nil, err
+	}
+	return &FirestoreTokenMeta{TokenMeta: *tokenMeta, DocumentID: documentID}, nil
+}
+
+// GetTokenMeta returns a TokenMeta by document id
+func (lc *LocalClient) GetTokenMeta(ctx context.Context, documentID string) (*FirestoreTokenMeta, error) {
+	tokenMeta := new(TokenMeta)
+	err := lc.read(tokenMetaCollection, documentID, tokenMeta)
+	if err != nil {
+		return nil, err
+	}
+	return &FirestoreTokenMeta{TokenMeta: *tokenMeta, DocumentID: documentID}, nil
+}
+
+// GetTokenMetaList looks up the token metas for a document id list
+func (lc *LocalClient) GetTokenMetaList(ctx context.Context, documentIDList []string) (*TokenMetaListResult, error) {
+	result := &TokenMetaListResult{
+		Found:    make([]*FirestoreTokenMeta, 0, len(documentIDList)),
+		NotFound: make([]string, 0),
+		Errors:   make(map[string]error),
+	}
+	for _, id := range documentIDList {
+		tokenMeta, err := lc.GetTokenMeta(ctx, id)
+		if errors.Is(err, ErrDocumentNotFound) {
+			result.NotFound = append(result.NotFound, id)
+		} else if err != nil {
+			result.Errors[id] = err
+		} else {
+			result.Found = append(result.Found, tokenMeta)
+		}
+	}
+	return result, nil
+}
+
+// UpdateTokenMeta applies patch to the given document
+func (lc *LocalClient) UpdateTokenMeta(ctx context.Context, documentID string, patch *TokenMetaPatch) error {
+	updates, err := patch.fieldUpdates()
+	if err != nil {
+		return err
+	}
+	return lc.update(tokenMetaCollection, documentID, updates, new(TokenMeta))
+}
+
+// path returns the file of a document, refusing ids which would point outside the collection directory
+func (lc *LocalClient) path(collection, documentID string) (string, error) {
+	if documentID == "" || documentID == "." || documentID == ".." || strings.ContainsAny(documentID, `/\`) {
+		return "", fmt.Errorf("LocalClient - invalid document id %q", documentID)
+	}
+	return filepath.Join(lc.Dir, collection, documentID+".json"), nil
+}
+
+// create writes doc under a new random document id and returns the id
+func (lc *LocalClient) create(collection string, doc interface{}) (string, error) {
+	documentID, err := newDocumentID()
+	if err != nil {
+		return "", fmt.Errorf("LocalClient.create - failed to generate document id %s", err)
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	return documentID, lc.write(collection, documentID, doc)
+}
+
+// read decodes the document into doc
+func (lc *LocalClient) read(collection, documentID string, doc interface{}) error {
+	path, err := lc.path(collection, documentID)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("LocalClient.read - %w: %s/%s", ErrDocumentNotFound, collection, documentID)
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, doc)
+	if err != nil {
+		return fmt.Errorf("LocalClient.read - invalid document %s: %s", path, err)
+	}
+	return nil
+}
+
+// write replaces the document file with doc, indented so it is easy to edit by hand
+func (lc *LocalClient) write(collection, documentID string, doc interface{}) error {
+	path, err := lc.path(collection, documentID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(path, data, 0644)
+}
+
+// update applies updates to the fields of an existing document, doc is the type of the document and is used to check the result
+// like firestore, either every update is applied or none are
+func (lc *LocalClient) update(collection, documentID string, updates []fieldUpdate, doc interface{}) error {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	fields := make(map[string]interface{})
+	err := lc.read(collection, documentID, &fields)
+	if err != nil {
+		return err
+	}
+	for _, u := range updates {
+		if u.Clear {
+			delete(fields, u.Field)
+			continue
+		}
+		// values are stored as their json form, the same as fields read from the file
+		data, err := json.Marshal(u.Value)
+		if err != nil {
+			return fmt.Errorf("LocalClient.update - invalid value for %s %s", u.Field, err)
+		}
+		fields[u.Field] = json.RawMessage(data)
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, doc)
+	if err != nil {
+		return fmt.Errorf("LocalClient.update - updated document is invalid %s", err)
+	}
+	return lc.write(collection, documentID, doc)
+}
+
+// newDocumentID returns a random 20 character id, like a firestore auto id
+func newDocumentID() (string, error) {
+	id := make([]byte, 20)
+	max := big.NewInt(int64(len(documentIDChars)))
+	for i := range id {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		id[i] = documentIDChars[n.Int64()]
+	}
+	return string(id), nil
+}
@@ -0,0 +1,119 @@
+package fstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalClient(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	client, err := NewLocalClient(dir)
+	a.NoError(err)
+
+	// create and retrieve
+	fp, err := client.CreatePlaque(ctx, &Plaque{Name: "test"})
+	a.NoError(err)
+	a.Len(fp.DocumentID, 20)
+	a.FileExists(filepath.Join(dir, plaqueCollection, fp.DocumentID+".json"))
+
+	fp2, err := client.GetPlaque(ctx, fp.DocumentID)
+	a.NoError(err)
+	a.Equal(fp, fp2)
+
+	_, err = client.GetPlaque(ctx, "missing")
+	a.True(errors.Is(err, ErrDocumentNotFound))
+	_, err = client.GetPlaque(ctx, "../token-meta/x")
+	a.Error(err)
+
+	// updates
+	a.NoError(client.UpdatePlaque(ctx, fp.DocumentID, &PlaquePatch{
+		Name:            String("update-test"),
+		TokenMetaIDList: &[]string{"m1", "m2"},
+		Schedule:        &Schedule{Timezone: "UTC"},
+		TokenWeights:    &map[string]int{"m1": 3},
+	}))
+	fp3, err := client.GetPlaque(ctx, fp.DocumentID)
+	a.NoError(err)
+	a.Equal("update-test", fp3.Plaque.Name)
+	a.Equal([]string{"m1", "m2"}, fp3.Plaque.TokenMetaIDList)
+	a.Equal("UTC", fp3.Plaque.Schedule.Timezone)
+	a.Equal(map[string]int{"m1": 3}, fp3.Plaque.TokenWeights)
+
+	a.NoError(client.UpdatePlaque(ctx, fp.DocumentID, &PlaquePatch{Clear: []PlaqueField{PlaqueSchedule, PlaqueTokenWeights}}))
+	fp4, err := client.GetPlaque(ctx, fp.DocumentID)
+	a.NoError(err)
+	a.Nil(fp4.Plaque.Schedule)
+	a.Nil(fp4.Plaque.TokenWeights)
+	a.Equal("update-test", fp4.Plaque.Name)
+
+	// invalid updates leave the document unchanged
+	a.Error(client.UpdatePlaque(ctx, fp.DocumentID, &PlaquePatch{Name: String("ignored"), Clear: []PlaqueField{PlaqueName}}))
+	a.Error(client.UpdatePlaque(ctx, fp.DocumentID, &PlaquePatch{}))
+	a.Error(client.UpdatePlaque(ctx, "missing", &PlaquePatch{Name: String("test")}))
+	fp5, err := client.GetPlaque(ctx, fp.DocumentID)
+	a.NoError(err)
+	a.Equal(fp4, fp5)
+
+	// token metas
+	m1, err := client.CreateTokenMeta(ctx, &TokenMeta{Name: "m1", MediaID: "m1", MediaType: ".mp4"})
+	a.NoError(err)
+	m2, err := client.CreateTokenMeta(ctx, &TokenMeta{Name: "m2"})
+	a.NoError(err)
+	a.NoError(client.UpdateTokenMeta(ctx, m2.DocumentID, &TokenMetaPatch{DisplayDuration: Int(30)}))
+	a.NoError(ioutil.WriteFile(filepath.Join(dir, tokenMetaCollection, "broken.json"), []byte("{"), 0644))
+	result, err := client.GetTokenMetaList(ctx, []string{m2.DocumentID, "missing", "broken", m1.DocumentID})
+	a.NoError(err)
+	a.Len(result.Found, 2)
+	a.Equal(30, result.Found[0].TokenMeta.DisplayDuration)
+	a.Equal(m1, result.Found[1])
+	a.Equal([]string{"missing"}, result.NotFound)
+	a.Len(result.Errors, 1)
+	a.Error(result.Errors["broken"])
+}
+
+func TestLocalListenPlaque(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	client, err := NewLocalClient(dir)
+	a.NoError(err)
+	client.PollInterval = 10 * time.Millisecond
+
+	fp, err := client.CreatePlaque(ctx, &Plaque{Name: "test"})
+	a.NoError(err)
+
+	names := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- client.ListenPlaque(ctx, fp.DocumentID, func(plaque *FirestorePlaque) error {
+			names <- plaque.Plaque.Name
+			return nil
+		})
+	}()
+	a.Equal("test", <-names)
+
+	// updates through the client and edits by hand are both picked up, a half saved edit is skipped
+	a.NoError(client.UpdatePlaque(ctx, fp.DocumentID, &PlaquePatch{Name: String("update-test")}))
+	a.Equal("update-test", <-names)
+
+	path := filepath.Join(dir, plaqueCollection, fp.DocumentID+".json")
+	a.NoError(ioutil.WriteFile(path, []byte(`{"name": "hand`), 0644))
+	time.Sleep(50 * time.Millisecond)
+	a.NoError(ioutil.WriteFile(path, []byte(`{"name": "hand-edit"}`), 0644))
+	a.Equal("hand-edit", <-names)
+
+	cancel()
+	a.True(errors.Is(<-done, context.Canceled))
+
+	// listening to a plaque that does not exist fails straight away
+	a.True(errors.Is(client.ListenPlaque(context.Background(), "missing", nil), ErrDocumentNotFound))
+}
@@ -3,8 +3,6 @@ package fstore
 import (
 	"context"
 	"fmt"
-
-	"cloud.google.com/go/firestore"
 )
 
 const plaqueCollection = "plaque"
@@ -54,9 +52,13 @@ func (fc *FirestoreClient) GetPlaque(ctx context.Context, documentID string) (*F
 	return &FirestorePlaque{Plaque: *plaque, DocumentID: ref.ID}, nil
 }
 
-// UpdatePlaque performs a list of updates to the given document
-func (fc *FirestoreClient) UpdatePlaque(ctx context.Context, documentID string, update []firestore.Update) error {
-	_, err := fc.Collection(plaqueCollection).Doc(documentID).Update(ctx, update)
+// UpdatePlaque applies patch to the given document
+func (fc *FirestoreClient) UpdatePlaque(ctx context.Context, documentID string, patch *PlaquePatch) error {
+	updates, err := patch.fieldUpdates()
+	if err != nil {
+		return err
+	}
+	_, err = fc.Collection(plaqueCollection).Doc(documentID).Update(ctx, firestoreUpdates(updates))
 	return err
 }
 
@@ -5,7 +5,6 @@ import (
 	"sync"
 	"testing"
 
-	"cloud.google.com/go/firestore"
 	"github.com/franela/goblin"
 	"github.com/stretchr/testify/assert"
 )
@@ -29,9 +28,7 @@ func TestPlaque(t *testing.T) {
 			g.Assert(fp2.DocumentID).Equal(fp.DocumentID)
 
 			// update
-			g.Assert(client.UpdatePlaque(ctx, fp2.DocumentID, []firestore.Update{{
-				Path: "name", Value: "update-test",
-			}})).IsNil()
+			g.Assert(client.UpdatePlaque(ctx, fp2.DocumentID, &PlaquePatch{Name: String("update-test")})).IsNil()
 
 			// confirm change
 			fp3, err := client.GetPlaque(ctx, fp2.DocumentID)
@@ -62,9 +59,7 @@ func TestListenPlaque(t *testing.T) {
 		a.NoError(err)
 	}()
 
-	a.NoError(client.UpdatePlaque(ctx, fp.DocumentID, []firestore.Update{{
-		Path: "name", Value: "update-test",
-	}}))
+	a.NoError(client.UpdatePlaque(ctx, fp.DocumentID, &PlaquePatch{Name: String("update-test")}))
 
 	wg.Wait()
 
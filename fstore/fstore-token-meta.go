@@ -3,6 +3,8 @@ package fstore
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
@@ -10,6 +12,9 @@ import (
 
 const tokenMetaCollection = "token-meta"
 
+// tokenMetaBatchSize is the most token metas read by a single GetAll call
+const tokenMetaBatchSize = 100
+
 // CreateTokenMeta creates a token meta and returns the firestore version of it
 func (fc *FirestoreClient) CreateTokenMeta(ctx context.Context, tokenMeta *TokenMeta) (*FirestoreTokenMeta, error) {
 	ref, _, err := fc.Collection(tokenMetaCollection).Add(ctx, tokenMeta)
@@ -55,19 +60,82 @@ func (fc *FirestoreClient) GetTokenMeta(ctx context.Context, documentID string)
 	return &FirestoreTokenMeta{TokenMeta: *tokenMeta, DocumentID: ref.ID}, nil
 }
 
-// GetTokenMetaList returns a list of token metas for a document id list
-func (fc *FirestoreClient) GetTokenMetaList(ctx context.Context, documentIDList []string) ([]*FirestoreTokenMeta, error) {
+// GetTokenMetaList looks up the token metas for a document id list with batched GetAll calls, run in parallel
+// ids in a batch that fails are returned in the result errors, an error is only returned if every batch fails, such as when offline
+func (fc *FirestoreClient) GetTokenMetaList(ctx context.Context, documentIDList []string) (*TokenMetaListResult, error) {
+	result := &TokenMetaListResult{
+		Found:    make([]*FirestoreTokenMeta, 0, len(documentIDList)),
+		NotFound: make([]string, 0),
+		Errors:   make(map[string]error),
+	}
 
-	tokenMetaList := make([]*FirestoreTokenMeta, 0, len(documentIDList))
+	// an invalid id would fail the whole GetAll call, so it is left out of the batches
+	ids := make([]string, 0, len(documentIDList))
 	for _, id := range documentIDList {
-		firestoreTokenMeta, err := fc.GetTokenMeta(ctx, id)
-		if err != nil {
-			return nil, err
+		if id == "" || strings.Contains(id, "/") {
+			result.Errors[id] = fmt.Errorf("invalid token meta document id %q", id)
+			continue
 		}
-		tokenMetaList = append(tokenMetaList, firestoreTokenMeta)
+		ids = append(ids, id)
 	}
 
-	return tokenMetaList, nil
+	type batch struct {
+		ids   []string
+		snaps []*firestore.DocumentSnapshot
+		err   error
+	}
+	batches := make([]*batch, 0, len(ids)/tokenMetaBatchSize+1)
+	for start := 0; start < len(ids); start += tokenMetaBatchSize {
+		end := start + tokenMetaBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batches = append(batches, &batch{ids: ids[start:end]})
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range batches {
+		refs := make([]*firestore.DocumentRef, 0, len(b.ids))
+		for _, id := range b.ids {
+			refs = append(refs, fc.Collection(tokenMetaCollection).Doc(id))
+		}
+		wg.Add(1)
+		go func(b *batch, refs []*firestore.DocumentRef) {
+			defer wg.Done()
+			b.snaps, b.err = fc.GetAll(ctx, refs)
+		}(b, refs)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, b := range batches {
+		if b.err != nil {
+			failed++
+			for _, id := range b.ids {
+				result.Errors[id] = b.err
+			}
+			continue
+		}
+		// snapshots are returned in the order of the refs
+		for i, snap := range b.snaps {
+			id := b.ids[i]
+			if !snap.Exists() {
+				result.NotFound = append(result.NotFound, id)
+				continue
+			}
+			tokenMeta := new(TokenMeta)
+			err := snap.DataTo(tokenMeta)
+			if err != nil {
+				result.Errors[id] = err
+				continue
+			}
+			result.Found = append(result.Found, &FirestoreTokenMeta{TokenMeta: *tokenMeta, DocumentID: id})
+		}
+	}
+	if failed > 0 && failed == len(batches) {
+		return nil, fmt.Errorf("FirestoreClient.GetTokenMetaList - failed to get token metas %s", batches[0].err)
+	}
+	return result, nil
 }
 
 // GetTokenMetaByQuery returns a list of token meta by a given firestore query
@@ -93,9 +161,13 @@ func (fc *FirestoreClient) GetTokenMetaByQuery(ctx context.Context, query Firest
 	return tokenMetaList, nil
 }
 
-// UpdateTokenMeta performs a list of updates to the given document
-func (fc *FirestoreClient) UpdateTokenMeta(ctx context.Context, documentID string, update []firestore.Update) error {
-	_, err := fc.Collection(tokenMetaCollection).Doc(documentID).Update(ctx, update)
+// UpdateTokenMeta applies patch to the given document
+func (fc *FirestoreClient) UpdateTokenMeta(ctx context.Context, documentID string, patch *TokenMetaPatch) error {
+	updates, err := patch.fieldUpdates()
+	if err != nil {
+		return err
+	}
+	_, err = fc.Collection(tokenMetaCollection).Doc(documentID).Update(ctx, firestoreUpdates(updates))
 	return err
 }
 
@@ -4,7 +4,6 @@ import (
 	"context"
 	"testing"
 
-	"cloud.google.com/go/firestore"
 	"github.com/franela/goblin"
 )
 
@@ -28,9 +27,7 @@ func TestTokenMeta(t *testing.T) {
 			g.Assert(ftm2.TokenMeta.ExternalMediaURL).Equal(tm.ExternalMediaURL)
 
 			// update
-			g.Assert(client.UpdateTokenMeta(ctx, ftm2.DocumentID, []firestore.Update{{
-				Path: "name", Value: "update-test",
-			}})).IsNil()
+			g.Assert(client.UpdateTokenMeta(ctx, ftm2.DocumentID, &TokenMetaPatch{Name: String("update-test")})).IsNil()
 
 			// confirm change
 			ftm3, err := client.GetTokenMeta(ctx, ftm2.DocumentID)
@@ -51,9 +48,12 @@ func TestTokenMeta(t *testing.T) {
 			ftm3, err := client.CreateTokenMeta(ctx, tm3)
 			g.Assert(err).IsNil()
 
-			tmList, err := client.GetTokenMetaList(ctx, []string{ftm1.DocumentID, ftm2.DocumentID, ftm3.DocumentID})
+			tmList, err := client.GetTokenMetaList(ctx, []string{ftm1.DocumentID, ftm2.DocumentID, "deleted", ftm3.DocumentID})
 			g.Assert(err).IsNil()
-			g.Assert(len(tmList)).Equal(3)
+			g.Assert(len(tmList.Found)).Equal(3)
+			g.Assert(tmList.Found[2].DocumentID).Equal(ftm3.DocumentID)
+			g.Assert(tmList.NotFound).Equal([]string{"deleted"})
+			g.Assert(len(tmList.Errors)).Equal(0)
 
 			queryMetas, err := client.GetTokenMetaByQuery(ctx, FirestoreQuery{Path: "artist", Op: "==", Value: "van gogh"})
 			g.Assert(err).IsNil()
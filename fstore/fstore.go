@@ -10,16 +10,18 @@ import (
 	"google.golang.org/api/option"
 )
 
+var logger = log.New(os.Stdout, "[fstore] - ", log.Ldate|log.Ltime|log.Lshortfile)
+
 type DBClient interface {
 	CreatePlaque(ctx context.Context, plaque *Plaque) (*FirestorePlaque, error)
 	GetPlaque(ctx context.Context, documentID string) (*FirestorePlaque, error)
-	UpdatePlaque(ctx context.Context, documentID string, update []firestore.Update) error
+	UpdatePlaque(ctx context.Context, documentID string, patch *PlaquePatch) error
 	ListenPlaque(ctx context.Context, documentID string, cb func(plaque *FirestorePlaque) error) error
 
 	CreateTokenMeta(ctx context.Context, tokenMeta *TokenMeta) (*FirestoreTokenMeta, error)
 	GetTokenMeta(ctx context.Context, documentID string) (*FirestoreTokenMeta, error)
-	GetTokenMetaList(ctx context.Context, documentIDList []string) ([]*FirestoreTokenMeta, error)
-	UpdateTokenMeta(ctx context.Context, documentID string, update []firestore.Update) error
+	GetTokenMetaList(ctx context.Context, documentIDList []string) (*TokenMetaListResult, error)
+	UpdateTokenMeta(ctx context.Context, documentID string, patch *TokenMetaPatch) error
 }
 
 type FirestoreClient struct {
@@ -40,6 +42,19 @@ func NewFirestoreClient(ctx context.Context, credentialsFile string) (*Firestore
 	return &FirestoreClient{Client: client}, nil
 }
 
+// firestoreUpdates translates patch field updates to firestore updates, cleared fields are deleted
+func firestoreUpdates(updates []fieldUpdate) []firestore.Update {
+	fu := make([]firestore.Update, 0, len(updates))
+	for _, u := range updates {
+		value := u.Value
+		if u.Clear {
+			value = firestore.Delete
+		}
+		fu = append(fu, firestore.Update{Path: u.Field, Value: value})
+	}
+	return fu
+}
+
 func NewFirestoreTestClient(ctx context.Context) *FirestoreClient {
 	err := os.Setenv("PROJECT", "moda-viewer")
 	if err != nil {
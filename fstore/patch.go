@@ -0,0 +1,186 @@
+package fstore
+
+import (
+	"fmt"
+)
+
+// PlaqueField names a plaque field, by its stored name
+type PlaqueField string
+
+const (
+	PlaqueName                   = PlaqueField("name")
+	PlaqueWalletAddress          = PlaqueField("wallet_address")
+	PlaqueTokenMetaIDList        = PlaqueField("token_meta_id_list")
+	PlaqueDefaultDisplayDuration = PlaqueField("default_display_duration")
+	PlaquePlayOrder              = PlaqueField("play_order")
+	PlaqueTokenWeights           = PlaqueField("token_weights")
+	PlaqueSchedule               = PlaqueField("schedule")
+	PlaqueStagedTokenMetaIDList  = PlaqueField("staged_token_meta_id_list")
+)
+
+// PlaquePatch is a partial update of a plaque, nil fields are left unchanged
+// a field is set to its zero value, such as removing the schedule, by listing it in Clear
+type PlaquePatch struct {
+	Name                   *string
+	WalletAddress          *string
+	TokenMetaIDList        *[]string
+	DefaultDisplayDuration *int
+	PlayOrder              *PlayOrder
+	TokenWeights           *map[string]int
+	Schedule               *Schedule
+	StagedTokenMetaIDList  *[]string
+	Clear                  []PlaqueField
+}
+
+// TokenMetaField names a token meta field, by its stored name
+type TokenMetaField string
+
+const (
+	TokenMetaName             = TokenMetaField("name")
+	TokenMetaArtist           = TokenMetaField("artist")
+	TokenMetaDescription      = TokenMetaField("description")
+	TokenMetaPublicLink       = TokenMetaField("public_link")
+	TokenMetaMediaID          = TokenMetaField("media_id")
+	TokenMetaMediaType        = TokenMetaField("media_type")
+	TokenMetaExternalMediaURL = TokenMetaField("external_media_url")
+	TokenMetaMediaSHA256      = TokenMetaField("media_sha256")
+	TokenMetaMediaSize        = TokenMetaField("media_size")
+	TokenMetaDisplayDuration  = TokenMetaField("display_duration")
+)
+
+// TokenMetaPatch is a partial update of a token meta, nil fields are left unchanged
+// a field is set to its zero value by listing it in Clear
+type TokenMetaPatch struct {
+	Name             *string
+	Artist           *string
+	Description      *string
+	PublicLink       *string
+	MediaID          *string
+	MediaType        *string
+	ExternalMediaURL *string
+	MediaSHA256      *string
+	MediaSize        *int64
+	DisplayDuration  *int
+	Clear            []TokenMetaField
+}
+
+// String returns a pointer to s, for setting patch fields
+func String(s string) *string {
+	return &s
+}
+
+// Int returns a pointer to i, for setting patch fields
+func Int(i int) *int {
+	return &i
+}
+
+// Int64 returns a pointer to i, for setting patch fields
+func Int64(i int64) *int64 {
+	return &i
+}
+
+// fieldUpdate sets or clears a single top level field of a stored document
+type fieldUpdate struct {
+	Field string
+	Value interface{} // ignored when Clear is true
+	Clear bool
+}
+
+// fieldUpdates returns the stored fields changed by the patch
+// a patch that changes nothing, sets and clears the same field or clears an unknown field is refused
+func (p *PlaquePatch) fieldUpdates() ([]fieldUpdate, error) {
+	set := make([]fieldUpdate, 0)
+	add := func(field PlaqueField, value interface{}) {
+		set = append(set, fieldUpdate{Field: string(field), Value: value})
+	}
+	if p.Name != nil {
+		add(PlaqueName, *p.Name)
+	}
+	if p.WalletAddress != nil {
+		add(PlaqueWalletAddress, *p.WalletAddress)
+	}
+	if p.TokenMetaIDList != nil {
+		add(PlaqueTokenMetaIDList, *p.TokenMetaIDList)
+	}
+	if p.DefaultDisplayDuration != nil {
+		add(PlaqueDefaultDisplayDuration, *p.DefaultDisplayDuration)
+	}
+	if p.PlayOrder != nil {
+		add(PlaquePlayOrder, *p.PlayOrder)
+	}
+	if p.TokenWeights != nil {
+		add(PlaqueTokenWeights, *p.TokenWeights)
+	}
+	if p.Schedule != nil {
+		add(PlaqueSchedule, *p.Schedule)
+	}
+	if p.StagedTokenMetaIDList != nil {
+		add(PlaqueStagedTokenMetaIDList, *p.StagedTokenMetaIDList)
+	}
+
+	clear := make([]string, 0, len(p.Clear))
+	for _, field := range p.Clear {
+		switch field {
+		case PlaqueName, PlaqueWalletAddress, PlaqueTokenMetaIDList, PlaqueDefaultDisplayDuration, PlaquePlayOrder, PlaqueTokenWeights, PlaqueSchedule,
+			PlaqueStagedTokenMetaIDList:
+			clear = append(clear, string(field))
+		default:
+			return nil, fmt.Errorf("PlaquePatch - unknown field %q", field)
+		}
+	}
+	return mergeUpdates("PlaquePatch", set, clear)
+}
+
+// fieldUpdates returns the stored fields changed by the patch
+// a patch that changes nothing, sets and clears the same field or clears an unknown field is refused
+func (p *TokenMetaPatch) fieldUpdates() ([]fieldUpdate, error) {
+	set := make([]fieldUpdate, 0)
+	addString := func(field TokenMetaField, value *string) {
+		if value != nil {
+			set = append(set, fieldUpdate{Field: string(field), Value: *value})
+		}
+	}
+	addString(TokenMetaName, p.Name)
+	addString(TokenMetaArtist, p.Artist)
+	addString(TokenMetaDescription, p.Description)
+	addString(TokenMetaPublicLink, p.PublicLink)
+	addString(TokenMetaMediaID, p.MediaID)
+	addString(TokenMetaMediaType, p.MediaType)
+	addString(TokenMetaExternalMediaURL, p.ExternalMediaURL)
+	addString(TokenMetaMediaSHA256, p.MediaSHA256)
+	if p.MediaSize != nil {
+		set = append(set, fieldUpdate{Field: string(TokenMetaMediaSize), Value: *p.MediaSize})
+	}
+	if p.DisplayDuration != nil {
+		set = append(set, fieldUpdate{Field: string(TokenMetaDisplayDuration), Value: *p.DisplayDuration})
+	}
+
+	clear := make([]string, 0, len(p.Clear))
+	for _, field := range p.Clear {
+		switch field {
+		case TokenMetaName, TokenMetaArtist, TokenMetaDescription, TokenMetaPublicLink, TokenMetaMediaID, TokenMetaMediaType,
+			TokenMetaExternalMediaURL, TokenMetaMediaSHA256, TokenMetaMediaSize, TokenMetaDisplayDuration:
+			clear = append(clear, string(field))
+		default:
+			return nil, fmt.Errorf("TokenMetaPatch - unknown field %q", field)
+		}
+	}
+	return mergeUpdates("TokenMetaPatch", set, clear)
+}
+
+// mergeUpdates appends clears of fields to set, refusing empty patches and fields which are both set and cleared
+func mergeUpdates(patch string, set []fieldUpdate, clear []string) ([]fieldUpdate, error) {
+	updates := set
+	for _, field := range clear {
+		for _, u := range set {
+			if u.Field == field {
+				return nil, fmt.Errorf("%s - field %q is both set and cleared", patch, field)
+			}
+		}
+		updates = append(updates, fieldUpdate{Field: field, Clear: true})
+	}
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("%s - no fields to update", patch)
+	}
+	return updates, nil
+}
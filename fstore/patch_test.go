@@ -0,0 +1,38 @@
+package fstore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatch(t *testing.T) {
+	a := assert.New(t)
+
+	updates, err := (&PlaquePatch{
+		WalletAddress:   String("wallet"),
+		TokenMetaIDList: &[]string{},
+		Clear:           []PlaqueField{PlaqueSchedule},
+	}).fieldUpdates()
+	a.NoError(err)
+	a.Equal([]firestore.Update{
+		{Path: "wallet_address", Value: "wallet"},
+		{Path: "token_meta_id_list", Value: []string{}},
+		{Path: "schedule", Value: firestore.Delete},
+	}, firestoreUpdates(updates))
+
+	updates, err = (&TokenMetaPatch{MediaSize: Int64(1024), Clear: []TokenMetaField{TokenMetaMediaSHA256}}).fieldUpdates()
+	a.NoError(err)
+	a.Equal([]firestore.Update{
+		{Path: "media_size", Value: int64(1024)},
+		{Path: "media_sha256", Value: firestore.Delete},
+	}, firestoreUpdates(updates))
+
+	_, err = (&PlaquePatch{}).fieldUpdates()
+	a.EqualError(err, "PlaquePatch - no fields to update")
+	_, err = (&PlaquePatch{Name: String("test"), Clear: []PlaqueField{PlaqueName}}).fieldUpdates()
+	a.EqualError(err, `PlaquePatch - field "name" is both set and cleared`)
+	_, err = (&TokenMetaPatch{Clear: []TokenMetaField{"title"}}).fieldUpdates()
+	a.EqualError(err, `TokenMetaPatch - unknown field "title"`)
+}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"fmt"
 	"sync"
-
-	"cloud.google.com/go/firestore"
 )
 
 type FstoreClientStub struct {
@@ -23,7 +21,7 @@ func (f *FstoreClientStub) GetPlaque(ctx context.Context, documentID string) (*F
 }
 
 // UpdatePlaque return err to simulate offline client
-func (f *FstoreClientStub) UpdatePlaque(ctx context.Context, documentID string, update []firestore.Update) error {
+func (f *FstoreClientStub) UpdatePlaque(ctx context.Context, documentID string, patch *PlaquePatch) error {
 	return fmt.Errorf("error offline")
 }
 
@@ -38,12 +36,12 @@ func (f *FstoreClientStub) GetTokenMeta(ctx context.Context, documentID string)
 }
 
 // GetTokenMetaList return err to simulate offline client
-func (f *FstoreClientStub) GetTokenMetaList(ctx context.Context, documentIDList []string) ([]*FirestoreTokenMeta, error) {
+func (f *FstoreClientStub) GetTokenMetaList(ctx context.Context, documentIDList []string) (*TokenMetaListResult, error) {
 	return nil, fmt.Errorf("error offline")
 }
 
 // UpdateTokenMeta return err to simulate offline client
-func (f *FstoreClientStub) UpdateTokenMeta(ctx context.Context, documentID string, update []firestore.Update) error {
+func (f *FstoreClientStub) UpdateTokenMeta(ctx context.Context, documentID string, patch *TokenMetaPatch) error {
 	return fmt.Errorf("error offline")
 }
 
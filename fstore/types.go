@@ -13,6 +13,9 @@ type TokenMeta struct {
 	MediaID          string `json:"media_id" firestore:"media_id"`
 	MediaType        string `json:"media_type" firestore:"media_type"`                 // file extension of media file, e.g. '.mp4'
 	ExternalMediaURL string `json:"external_media_url" firestore:"external_media_url"` // url of source media file on external server (e.g. opensea servers)
+	MediaSHA256      string `json:"media_sha256" firestore:"media_sha256"`             // optional hex encoded sha256 of media file, downloads are verified against it
+	MediaSize        int64  `json:"media_size" firestore:"media_size"`                 // optional size in bytes of media file, downloads are verified against it
+	DisplayDuration  int    `json:"display_duration" firestore:"display_duration"`     // optional seconds the token is shown before the next token, overrides the plaque default
 }
 
 type FirestoreTokenMeta struct {
@@ -30,16 +33,54 @@ func (tm *FirestoreTokenMeta) MediaFileName() string {
 }
 
 type Plaque struct {
+	Name                   string         `json:"name" firestore:"name"`
+	WalletAddress          string         `json:"wallet_address" firestore:"wallet_address"`
+	TokenMetaIDList        []string       `json:"token_meta_id_list" firestore:"token_meta_id_list"`                         // list of token meta document ids which the plaque will display
+	DefaultDisplayDuration int            `json:"default_display_duration" firestore:"default_display_duration"`             // optional seconds each token is shown, 0 plays videos at their natural length
+	PlayOrder              PlayOrder      `json:"play_order" firestore:"play_order"`                                         // order tokens are played in, empty is sequential
+	TokenWeights           map[string]int `json:"token_weights" firestore:"token_weights"`                                   // relative weight of each token meta id for weighted play order, missing tokens have weight 1
+	Schedule               *Schedule      `json:"schedule,omitempty" firestore:"schedule"`                                   // optional time windows with their own tokens, TokenMetaIDList plays outside every window
+	StagedTokenMetaIDList  []string       `json:"staged_token_meta_id_list,omitempty" firestore:"staged_token_meta_id_list"` // optional token list downloaded in the background, replaces TokenMetaIDList once all its media is local
+}
+
+// Schedule changes what a plaque displays by time of day and weekday
+type Schedule struct {
+	Timezone string           `json:"timezone" firestore:"timezone"` // IANA time zone of the window times, e.g. 'America/New_York', empty is the viewer local time
+	Windows  []ScheduleWindow `json:"windows" firestore:"windows"`   // the first window containing the current time is used
+}
+
+// ScheduleWindow is a daily time range which displays its own token list, or turns the display off
+type ScheduleWindow struct {
 	Name            string   `json:"name" firestore:"name"`
-	WalletAddress   string   `json:"wallet_address" firestore:"wallet_address"`
-	TokenMetaIDList []string `json:"token_meta_id_list" firestore:"token_meta_id_list"` // list of token meta document ids which the plaque will display
+	Weekdays        []int    `json:"weekdays" firestore:"weekdays"`                     // days the window starts on, 0 is sunday, empty is every day
+	Start           string   `json:"start" firestore:"start"`                           // start time as 'HH:MM'
+	End             string   `json:"end" firestore:"end"`                               // end time as 'HH:MM', windows ending at or before their start continue past midnight
+	TokenMetaIDList []string `json:"token_meta_id_list" firestore:"token_meta_id_list"` // token meta document ids displayed during the window
+	DisplayOff      bool     `json:"display_off" firestore:"display_off"`               // display nothing during the window, TokenMetaIDList is ignored
 }
 
+// PlayOrder is the order a plaque plays its tokens in
+type PlayOrder string
+
+const (
+	PlayOrderSequential      = PlayOrder("sequential")        // tokens play in token meta id list order
+	PlayOrderShuffle         = PlayOrder("shuffle")           // each token is followed by a random other token
+	PlayOrderShuffleNoRepeat = PlayOrder("shuffle_no_repeat") // tokens play in random order, every token plays once before any repeats
+	PlayOrderWeighted        = PlayOrder("weighted")          // each token is followed by a random other token, chosen in proportion to token weights
+)
+
 type FirestorePlaque struct {
 	DocumentID string `json:"document_id"`
 	Plaque     Plaque `json:"plaque"`
 }
 
+// TokenMetaListResult is the outcome of looking up a list of token metas, each requested id is in one of Found, NotFound or Errors
+type TokenMetaListResult struct {
+	Found    []*FirestoreTokenMeta // in the requested order
+	NotFound []string              // ids with no document, such as deleted tokens
+	Errors   map[string]error      // ids whose document could not be read
+}
+
 type FirestoreQuery struct {
 	Path  string
 	Op    string
@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	cloud.google.com/go/firestore v1.6.1
+	cloud.google.com/go/storage v1.10.0
 	firebase.google.com/go v3.13.0+incompatible
 	github.com/CedArctic/go-vlc-ctrl v0.5.0
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -12,4 +13,5 @@ require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/stretchr/testify v1.7.2
 	google.golang.org/api v0.59.0
+	gopkg.in/yaml.v3 v3.0.1
 )
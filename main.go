@@ -2,23 +2,43 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"jkurtz678/moda-viewer/api"
+	"jkurtz678/moda-viewer/config"
 	"jkurtz678/moda-viewer/fstore"
 	"jkurtz678/moda-viewer/storage"
 	"jkurtz678/moda-viewer/viewer"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout is how long open api requests have to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 
+	// load and validate config before launching anything
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("config error - %v", err)
+	}
+
 	//TODO decrypt gpg file
 
 	// install python dependencies
 	log.Printf("Checking python dependencies...")
 	cmd := exec.Command("pip", "install", "-r", "webview/requirements.txt")
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		log.Fatalf("pip dependency install error - %v", err)
 	}
@@ -44,17 +64,52 @@ func main() {
 		log.Printf("VLC found in path")
 	} */
 
-	serviceAccountKey := "./serviceAccountKey.json"
-	fstoreClient, err := fstore.NewFirestoreClient(context.Background(), serviceAccountKey)
+	// ctx is done on interrupt or terminate, shutting everything down cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var dbClient fstore.DBClient
+	if cfg.DB == config.DBLocal {
+		log.Printf("using local database in %s", cfg.LocalDBDir)
+		dbClient, err = fstore.NewLocalClient(cfg.LocalDBDir)
+	} else {
+		dbClient, err = fstore.NewFirestoreClient(ctx, cfg.ServiceAccountKey)
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
-	storageClient := storage.NewFirebaseStorageClient("moda-archive.appspot.com", serviceAccountKey, "./media")
-	viewer := viewer.NewViewer(fstoreClient, storageClient)
+	storageClient := storage.NewFirebaseStorageClient(ctx, cfg.StorageBucket, cfg.ServiceAccountKey, cfg.MediaDir, cfg.Downloads.Workers)
+	viewer := viewer.NewViewer(cfg, dbClient, storageClient)
 	plaqueAPIHandler := api.NewPlaqueAPIHandler(viewer)
+	plaqueAPIHandler.APIToken = cfg.APIToken
+
+	// requests use ctx so event streams end on shutdown instead of holding the server open
+	server := &http.Server{
+		Addr:        cfg.ListenAddr,
+		Handler:     plaqueAPIHandler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
 	go func() {
-		log.Fatal(viewer.Startup())
+		log.Printf("plaque api listening on %s", cfg.ListenAddr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
-	log.Fatal(http.ListenAndServe("127.0.0.1:8080", plaqueAPIHandler))
+	// startup blocks until ctx is done and the plaque and player have exited
+	startupErr := viewer.Startup(ctx)
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("api shutdown error - %v", err)
+	}
+
+	if startupErr != nil {
+		log.Fatalf("viewer startup error - %v", startupErr)
+	}
+	log.Printf("viewer stopped")
 }
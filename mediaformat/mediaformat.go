@@ -0,0 +1,185 @@
+package mediaformat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var logger = log.New(os.Stdout, "[mediaformat] - ", log.Ldate|log.Ltime|log.Lshortfile)
+
+// RenditionSuffix is added to the name of a media file, before the extension, for its playback-safe rendition
+const RenditionSuffix = ".playback"
+
+// Info is the format of a media file as probed by ffprobe
+type Info struct {
+	Container  string  `json:"container"`             // ffprobe format name, such as 'mov,mp4,m4a,3gp,3g2,mj2'
+	VideoCodec string  `json:"video_codec,omitempty"` // ffprobe codec name of the first video stream, such as 'h264'
+	AudioCodec string  `json:"audio_codec,omitempty"` // ffprobe codec name of the first audio stream, empty if silent
+	Width      int     `json:"width,omitempty"`       // coded width of the video in pixels, before rotation
+	Height     int     `json:"height,omitempty"`      // coded height of the video in pixels, before rotation
+	Duration   float64 `json:"duration,omitempty"`    // seconds, 0 for still images
+	Rotation   int     `json:"rotation,omitempty"`    // degrees clockwise the video is rotated for display, 0, 90, 180 or 270
+	Still      bool    `json:"still,omitempty"`       // file is a still image
+}
+
+// Profile is what the device decodes smoothly, media beyond it is transcoded when transcoding is enabled
+type Profile struct {
+	MaxWidth    int      // largest video in either orientation, so portrait video fits a landscape profile, 0 is no limit
+	MaxHeight   int      // 0 is no limit
+	VideoCodecs []string // ffprobe names of the video codecs decoded smoothly, empty allows any
+}
+
+// Exceeds returns why info is beyond the profile, empty if the device plays it smoothly
+// still images and files without video are never beyond the profile
+func (p Profile) Exceeds(info *Info) []string {
+	reasons := make([]string, 0)
+	if info.Still || info.VideoCodec == "" {
+		return reasons
+	}
+	if len(p.VideoCodecs) > 0 && !containsString(p.VideoCodecs, info.VideoCodec) {
+		reasons = append(reasons, fmt.Sprintf("video codec %s is not one of %s", info.VideoCodec, strings.Join(p.VideoCodecs, ", ")))
+	}
+	if !p.fits(info.Width, info.Height) {
+		reasons = append(reasons, fmt.Sprintf("resolution %vx%v is above %vx%v", info.Width, info.Height, p.MaxWidth, p.MaxHeight))
+	}
+	return reasons
+}
+
+// fits returns whether a width x height video fits the profile in either orientation
+func (p Profile) fits(width, height int) bool {
+	if p.MaxWidth <= 0 || p.MaxHeight <= 0 {
+		return true
+	}
+	long, short := maxInt(width, height), minInt(width, height)
+	return long <= maxInt(p.MaxWidth, p.MaxHeight) && short <= minInt(p.MaxWidth, p.MaxHeight)
+}
+
+// Report is the result of processing a media file, kept with the local metadata so files are not probed again
+type Report struct {
+	File      string   `json:"file"`                // name of the original media file
+	Size      int64    `json:"size"`                // size of the original when probed, a file with a different size is probed again
+	SHA256    string   `json:"sha256,omitempty"`    // hex encoded sha256 of the original when probed, a file with different content is processed again
+	Info      *Info    `json:"info,omitempty"`      // nil if probing failed
+	Exceeds   []string `json:"exceeds,omitempty"`   // why the original is beyond the device profile
+	Rendition string   `json:"rendition,omitempty"` // name of the transcoded rendition beside the original, played in its place
+	Error     string   `json:"error,omitempty"`     // probe or transcode error, the original is played
+}
+
+// Processor probes downloaded media files and prepares a rendition of those the device cannot play smoothly
+type Processor interface {
+	// Process returns the report of the media file at path, reusing what previous found if the file is unchanged
+	Process(ctx context.Context, path string, previous *Report) *Report
+}
+
+// commandFunc builds the command for a program, replaced in tests
+type commandFunc func(name string, args ...string) *exec.Cmd
+
+// Pipeline is a Processor which probes with ffprobe and transcodes with ffmpeg
+type Pipeline struct {
+	FFprobe string // path of ffprobe
+	FFmpeg  string // path of ffmpeg, empty only probes media
+	Profile Profile
+	command commandFunc
+}
+
+func NewPipeline(ffprobe, ffmpeg string, profile Profile) *Pipeline {
+	return &Pipeline{FFprobe: ffprobe, FFmpeg: ffmpeg, Profile: profile, command: exec.Command}
+}
+
+// Process probes the media file at path, then transcodes it into a rendition beside it if it is beyond the profile and ffmpeg is set
+// the probe and rendition of previous are reused if the file size and sha256 have not changed, otherwise the file is processed again
+// failures are recorded in the report, the original file is played if there is no rendition
+func (p *Pipeline) Process(ctx context.Context, path string, previous *Report) *Report {
+	report := &Report{File: filepath.Base(path)}
+	stat, err := os.Stat(path)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Size = stat.Size()
+	report.SHA256, err = fileSHA256(path)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	// a file downloaded again with different content keeps its name, so only the same size and content reuse previous
+	unchanged := previous != nil && previous.Size == report.Size && previous.SHA256 == report.SHA256
+	if unchanged && previous.Info != nil {
+		report.Info = previous.Info
+	} else {
+		report.Info, err = p.Probe(ctx, path)
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+	}
+
+	report.Exceeds = p.Profile.Exceeds(report.Info)
+	if len(report.Exceeds) == 0 || p.FFmpeg == "" {
+		return report
+	}
+	rendition := filepath.Join(filepath.Dir(path), RenditionName(report.File))
+	_, err = os.Stat(rendition)
+	if err != nil || !unchanged || previous.Rendition != filepath.Base(rendition) {
+		logger.Printf("Pipeline.Process - transcoding %s: %s", report.File, strings.Join(report.Exceeds, ", "))
+		err = p.Transcode(ctx, path, rendition, report.Info)
+		if err != nil {
+			report.Error = err.Error()
+			return report
+		}
+	}
+	report.Rendition = filepath.Base(rendition)
+	return report
+}
+
+// fileSHA256 returns the hex encoded sha256 of the contents of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sha := sha256.New()
+	_, err = io.Copy(sha, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
+
+// RenditionName returns the name of the playback-safe rendition of the media file name, always an mp4
+func RenditionName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + RenditionSuffix + ".mp4"
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
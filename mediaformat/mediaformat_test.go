@@ -0,0 +1,166 @@
+package mediaformat
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// probeOutput is ffprobe output of a rotated 4k hevc video with aac audio
+const probeOutput = `{
+	"streams": [
+		{"codec_type": "video", "codec_name": "hevc", "width": 3840, "height": 2160, "disposition": {"attached_pic": 0},
+			"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]},
+		{"codec_type": "audio", "codec_name": "aac", "disposition": {"attached_pic": 0}}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "12.500000"}
+}`
+
+// gifProbeOutput is ffprobe output of an animated 4k gif
+const gifProbeOutput = `{
+	"streams": [
+		{"codec_type": "video", "codec_name": "gif", "width": 3840, "height": 2160, "disposition": {"attached_pic": 0}}
+	],
+	"format": {"format_name": "gif", "duration": "4.200000"}
+}`
+
+// helperCommand returns a command func which runs TestHelperProcess in a child test binary in place of ffprobe and ffmpeg
+// calls receives the program name and args of every command run
+func helperCommand(fail bool, calls *[]string) commandFunc {
+	return func(name string, args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestHelperProcess", "--", name}, args...)...)
+		cmd.Env = append(os.Environ(), "MODA_HELPER_PROCESS=1")
+		if fail {
+			cmd.Env = append(cmd.Env, "MODA_HELPER_FAIL=1")
+		}
+		if strings.HasSuffix(args[len(args)-1], ".gif") {
+			cmd.Env = append(cmd.Env, "MODA_HELPER_GIF=1")
+		}
+		*calls = append(*calls, strings.Join(append([]string{name}, args...), " "))
+		return cmd
+	}
+}
+
+// TestHelperProcess prints probeOutput for ffprobe, gifProbeOutput for gif files, and writes the output file, its last arg, for ffmpeg
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("MODA_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if os.Getenv("MODA_HELPER_FAIL") == "1" {
+		fmt.Fprintf(os.Stderr, "%s: invalid data found when processing input", args[len(args)-1])
+		os.Exit(1)
+	}
+	switch args[1] {
+	case "ffprobe":
+		if os.Getenv("MODA_HELPER_GIF") == "1" {
+			fmt.Print(gifProbeOutput)
+			break
+		}
+		fmt.Print(probeOutput)
+	case "ffmpeg":
+		ioutil.WriteFile(args[len(args)-1], []byte("rendition"), 0644)
+	}
+	os.Exit(0)
+}
+
+func TestProfile(t *testing.T) {
+	a := assert.New(t)
+	profile := Profile{MaxWidth: 1920, MaxHeight: 1080, VideoCodecs: []string{"h264"}}
+
+	a.Empty(profile.Exceeds(&Info{VideoCodec: "h264", Width: 1920, Height: 1080}))
+	a.Empty(profile.Exceeds(&Info{VideoCodec: "h264", Width: 1080, Height: 1920}), "portrait video fits a landscape profile")
+	a.Empty(profile.Exceeds(&Info{VideoCodec: "png", Width: 8000, Height: 8000, Still: true}))
+	a.Empty(profile.Exceeds(&Info{AudioCodec: "mp3"}))
+	a.Equal([]string{"video codec hevc is not one of h264", "resolution 3840x2160 is above 1920x1080"}, profile.Exceeds(&Info{VideoCodec: "hevc", Width: 3840, Height: 2160}))
+	a.Empty(Profile{}.Exceeds(&Info{VideoCodec: "hevc", Width: 3840, Height: 2160}))
+
+	// renditions keep the aspect ratio as displayed, with even sizes
+	width, height := profile.renditionSize(&Info{Width: 4096, Height: 2160})
+	a.Equal([]int{1920, 1012}, []int{width, height})
+	width, height = profile.renditionSize(&Info{Width: 3840, Height: 2160, Rotation: 90})
+	a.Equal([]int{1080, 1920}, []int{width, height})
+	width, height = profile.renditionSize(&Info{Width: 1279, Height: 720})
+	a.Equal([]int{1278, 720}, []int{width, height})
+}
+
+func TestPipeline(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	path := filepath.Join(tmpdir, "s1.mov")
+	a.NoError(ioutil.WriteFile(path, []byte("original"), 0644))
+	calls := make([]string, 0)
+
+	// probing only reports what is beyond the profile
+	p := NewPipeline("ffprobe", "", Profile{MaxWidth: 1920, MaxHeight: 1080, VideoCodecs: []string{"h264"}})
+	p.command = helperCommand(false, &calls)
+	info := &Info{Container: "mov,mp4,m4a,3gp,3g2,mj2", VideoCodec: "hevc", AudioCodec: "aac", Width: 3840, Height: 2160, Duration: 12.5, Rotation: 90}
+	sha, err := fileSHA256(path)
+	a.NoError(err)
+	report := p.Process(ctx, path, nil)
+	a.Equal(&Report{File: "s1.mov", Size: 8, SHA256: sha, Info: info, Exceeds: []string{"video codec hevc is not one of h264", "resolution 3840x2160 is above 1920x1080"}}, report)
+	a.Equal([]string{"ffprobe -v error -print_format json -show_format -show_streams " + path}, calls)
+
+	// with ffmpeg a rendition is transcoded beside the original, reusing the earlier probe
+	p.FFmpeg = "ffmpeg"
+	report = p.Process(ctx, path, report)
+	a.Equal("s1.playback.mp4", report.Rendition)
+	a.Empty(report.Error)
+	a.Len(calls, 2)
+	a.True(strings.HasPrefix(calls[1], "ffmpeg -nostdin -y -v error -i "+path))
+	a.Contains(calls[1], "-vf scale=1080:1920")
+	data, err := ioutil.ReadFile(filepath.Join(tmpdir, "s1.playback.mp4"))
+	a.NoError(err)
+	a.Equal("rendition", string(data))
+
+	// an existing rendition is not transcoded again
+	a.Equal(report, p.Process(ctx, path, report))
+	a.Len(calls, 2)
+
+	// an original downloaded again with different content of the same size is probed and transcoded again
+	a.NoError(ioutil.WriteFile(path, []byte("replaced"), 0644))
+	replaced := p.Process(ctx, path, report)
+	a.NotEqual(report.SHA256, replaced.SHA256)
+	a.Equal("s1.playback.mp4", replaced.Rendition)
+	a.Len(calls, 4)
+	a.True(strings.HasPrefix(calls[2], "ffprobe"))
+	a.True(strings.HasPrefix(calls[3], "ffmpeg"))
+
+	// a changed file is probed again, and failures are reported
+	a.NoError(os.Remove(filepath.Join(tmpdir, "s1.playback.mp4")))
+	p.command = helperCommand(true, &calls)
+	report = p.Process(ctx, path, &Report{File: "s1.mov", Size: 3, Info: info})
+	a.Nil(report.Info)
+	a.Contains(report.Error, "invalid data found when processing input")
+	report = p.Process(ctx, path, &Report{File: "s1.mov", Size: 8, SHA256: replaced.SHA256, Info: info})
+	a.Equal(info, report.Info)
+	a.Empty(report.Rendition)
+	a.Contains(report.Error, "ffmpeg failed")
+	files, err := ioutil.ReadDir(tmpdir)
+	a.NoError(err)
+	a.Len(files, 1, "temp rendition is removed")
+
+	// animated gifs are images, they are not transcoded whatever their size
+	gif := filepath.Join(tmpdir, "s2.gif")
+	a.NoError(ioutil.WriteFile(gif, []byte("animated"), 0644))
+	p.command = helperCommand(false, &calls)
+	calls = calls[:0]
+	report = p.Process(ctx, gif, nil)
+	a.Equal(&Report{File: "s2.gif", Size: 8, SHA256: report.SHA256, Info: &Info{Container: "gif", VideoCodec: "gif", Width: 3840, Height: 2160, Still: true}, Exceeds: []string{}}, report)
+	a.Len(calls, 1)
+
+	report = p.Process(ctx, filepath.Join(tmpdir, "missing.mp4"), nil)
+	a.Equal("missing.mp4", report.File)
+	a.NotEmpty(report.Error)
+}
@@ -0,0 +1,86 @@
+package mediaformat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"jkurtz678/moda-viewer/process"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ffprobeOutput is the part of the ffprobe -show_format -show_streams json output mapped into Info
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType   string `json:"codec_type"`
+		CodecName   string `json:"codec_name"`
+		Width       int    `json:"width"`
+		Height      int    `json:"height"`
+		Disposition struct {
+			AttachedPic int `json:"attached_pic"` // cover art of an audio file, not a video
+		} `json:"disposition"`
+		Tags struct {
+			Rotate string `json:"rotate"` // degrees clockwise, older ffprobe versions
+		} `json:"tags"`
+		SideDataList []struct {
+			Rotation float64 `json:"rotation"` // degrees counterclockwise of the display matrix, newer ffprobe versions
+		} `json:"side_data_list"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+}
+
+// Probe returns the container, codecs, resolution, duration and rotation of the media file at path
+func (p *Pipeline) Probe(ctx context.Context, path string) (*Info, error) {
+	cmd := p.command(p.FFprobe, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := process.Run(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("Pipeline.Probe - ffprobe failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var output ffprobeOutput
+	err = json.Unmarshal(stdout.Bytes(), &output)
+	if err != nil {
+		return nil, fmt.Errorf("Pipeline.Probe - invalid ffprobe output %s", err)
+	}
+	return output.info(), nil
+}
+
+// info maps the ffprobe output of the first video and audio streams into Info
+func (o *ffprobeOutput) info() *Info {
+	info := &Info{Container: o.Format.FormatName}
+	// image formats are read by the image2 demuxer, a *_pipe demuxer for each codec or the gif demuxer, animated gifs are shown as images too
+	info.Still = info.Container == "image2" || info.Container == "gif" || strings.HasSuffix(info.Container, "_pipe")
+	if !info.Still {
+		info.Duration, _ = strconv.ParseFloat(o.Format.Duration, 64)
+	}
+
+	for _, stream := range o.Streams {
+		switch {
+		case stream.CodecType == "video" && stream.Disposition.AttachedPic == 0 && info.VideoCodec == "":
+			info.VideoCodec = stream.CodecName
+			info.Width = stream.Width
+			info.Height = stream.Height
+			rotation := 0
+			if stream.Tags.Rotate != "" {
+				rotation, _ = strconv.Atoi(stream.Tags.Rotate)
+			}
+			for _, side := range stream.SideDataList {
+				if side.Rotation != 0 {
+					rotation = -int(math.Round(side.Rotation))
+				}
+			}
+			info.Rotation = ((rotation % 360) + 360) % 360
+		case stream.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = stream.CodecName
+		}
+	}
+	return info
+}
@@ -0,0 +1,68 @@
+package mediaformat
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ProcessorStub returns the report in Reports for each file name, writing an empty rendition file beside the original if it has one
+// files without a report are reported as playable with no info
+type ProcessorStub struct {
+	Reports map[string]*Report
+	Gate    chan struct{} // if set, each file waits to receive from Gate before it is processed, so tests can hold processing
+	lock    sync.Mutex
+	calls   []string
+	active  int
+	most    int
+}
+
+func (p *ProcessorStub) Process(ctx context.Context, path string, previous *Report) *Report {
+	name := filepath.Base(path)
+	p.lock.Lock()
+	p.calls = append(p.calls, name)
+	report, ok := p.Reports[name]
+	p.active++
+	if p.active > p.most {
+		p.most = p.active
+	}
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		p.active--
+		p.lock.Unlock()
+	}()
+	if p.Gate != nil {
+		select {
+		case <-p.Gate:
+		case <-ctx.Done():
+			return &Report{File: name, Error: ctx.Err().Error()}
+		}
+	}
+	if !ok {
+		return &Report{File: name}
+	}
+	if report.Rendition != "" {
+		rendition := filepath.Join(filepath.Dir(path), report.Rendition)
+		if _, err := os.Stat(rendition); err != nil {
+			ioutil.WriteFile(rendition, []byte{}, 0644)
+		}
+	}
+	return report
+}
+
+// MostActive returns the most files that were processed at once
+func (p *ProcessorStub) MostActive() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.most
+}
+
+// Calls returns the names of the files processed, in order
+func (p *ProcessorStub) Calls() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.calls...)
+}
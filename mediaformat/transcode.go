@@ -0,0 +1,66 @@
+package mediaformat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/process"
+	"jkurtz678/moda-viewer/storage"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Transcode writes an h264 and aac mp4 of the media file src to dst, scaled down to fit the profile
+// ffmpeg writes to a temp file beside dst which is renamed once complete, so dst is never a partial rendition
+func (p *Pipeline) Transcode(ctx context.Context, src, dst string, info *Info) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*"+storage.TempSuffix)
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	width, height := p.Profile.renditionSize(info)
+	args := []string{
+		"-nostdin", "-y", "-v", "error",
+		"-i", src,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p",
+		"-vf", fmt.Sprintf("scale=%v:%v", width, height),
+		"-c:a", "aac", "-b:a", "160k",
+		"-movflags", "+faststart",
+		"-f", "mp4", tmp.Name(),
+	}
+	cmd := p.command(p.FFmpeg, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = process.Run(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("Pipeline.Transcode - ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// renditionSize returns the even width and height the rendition of info is scaled to, its displayed size fitted to the profile
+// ffmpeg applies the rotation while transcoding, so the size is of the video as displayed
+func (p Profile) renditionSize(info *Info) (int, int) {
+	width, height := info.Width, info.Height
+	if info.Rotation == 90 || info.Rotation == 270 {
+		width, height = height, width
+	}
+	scale := 1.0
+	if !p.fits(width, height) {
+		boxWidth, boxHeight := maxInt(p.MaxWidth, p.MaxHeight), minInt(p.MaxWidth, p.MaxHeight)
+		if height > width {
+			boxWidth, boxHeight = boxHeight, boxWidth
+		}
+		scale = math.Min(float64(boxWidth)/float64(width), float64(boxHeight)/float64(height))
+	}
+	even := func(n int) int {
+		return int(math.Floor(float64(n)*scale/2)) * 2
+	}
+	return even(width), even(height)
+}
@@ -0,0 +1,68 @@
+package process
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "[process] - ", log.Ldate|log.Ltime|log.Lshortfile)
+
+// StopTimeout is how long a child process has to exit after being interrupted before it is killed
+var StopTimeout = 5 * time.Second
+
+// Run starts cmd and waits for it to exit
+// when ctx is done the process is interrupted so it can shut down cleanly, and killed if it has not exited after StopTimeout
+// the error from cmd.Wait is returned, which is not nil for a process that was stopped by a signal
+func Run(ctx context.Context, cmd *exec.Cmd) error {
+	return run(ctx, cmd, nil)
+}
+
+// run is Run, calling started with the pid once the process has started
+func run(ctx context.Context, cmd *exec.Cmd, started func(pid int)) error {
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	if started != nil {
+		started(cmd.Process.Pid)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Printf("Run - stopping %s (pid %v)", cmd.Path, cmd.Process.Pid)
+	err = interrupt(cmd.Process)
+	if err != nil {
+		logger.Printf("Run - failed to interrupt %s, killing: %v", cmd.Path, err)
+		cmd.Process.Kill()
+	}
+
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(StopTimeout):
+		logger.Printf("Run - %s did not exit within %v, killing", cmd.Path, StopTimeout)
+		cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+// interrupt asks the process to exit, windows does not support sending interrupts so the process is killed
+func interrupt(p *os.Process) error {
+	if runtime.GOOS == "windows" {
+		return p.Kill()
+	}
+	return p.Signal(os.Interrupt)
+}
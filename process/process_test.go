@@ -0,0 +1,100 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helperCommand returns a command which runs TestHelperProcess in a child test binary as a fake executable
+func helperCommand(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess", "--", mode)
+	cmd.Env = append(os.Environ(), "MODA_HELPER_PROCESS=1")
+	return cmd
+}
+
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("MODA_HELPER_PROCESS") != "1" {
+		return
+	}
+	mode := os.Args[len(os.Args)-1]
+	switch mode {
+	case "exit":
+		os.Exit(3)
+	case "crash":
+		fmt.Println("starting player")
+		fmt.Fprint(os.Stderr, "segmentation fault")
+		os.Exit(2)
+	case "graceful":
+		// exits cleanly once interrupted
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		fmt.Println("ready")
+		<-interrupts
+		os.Exit(0)
+	case "stubborn":
+		// ignores interrupts and has to be killed
+		signal.Ignore(os.Interrupt)
+		fmt.Println("ready")
+		time.Sleep(time.Minute)
+	}
+	os.Exit(0)
+}
+
+func TestRun(t *testing.T) {
+	a := assert.New(t)
+
+	t.Run("returns exit error", func(t *testing.T) {
+		err := Run(context.Background(), helperCommand("exit"))
+		var exitErr *exec.ExitError
+		a.ErrorAs(err, &exitErr)
+		a.Equal(3, exitErr.ExitCode())
+	})
+
+	t.Run("interrupts process when context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cmd := helperCommand("graceful")
+		ready := startAfterReady(t, cmd)
+		go func() {
+			<-ready
+			cancel()
+		}()
+		a.NoError(Run(ctx, cmd))
+	})
+
+	t.Run("kills process that ignores interrupt", func(t *testing.T) {
+		defer func(timeout time.Duration) { StopTimeout = timeout }(StopTimeout)
+		StopTimeout = 200 * time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+		cmd := helperCommand("stubborn")
+		ready := startAfterReady(t, cmd)
+		go func() {
+			<-ready
+			cancel()
+		}()
+		start := time.Now()
+		a.Error(Run(ctx, cmd))
+		a.GreaterOrEqual(time.Since(start), StopTimeout)
+	})
+}
+
+// startAfterReady returns a channel closed once cmd prints its first line, so signals are not sent before handlers are installed
+func startAfterReady(t *testing.T, cmd *exec.Cmd) <-chan struct{} {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		stdout.Read(buf)
+		close(ready)
+	}()
+	return ready
+}
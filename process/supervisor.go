@@ -0,0 +1,160 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinBackoff  = time.Second
+	defaultMaxBackoff  = time.Minute
+	defaultStableAfter = time.Minute
+	maxLineLength      = 4096 // longest output line buffered before it is logged
+)
+
+// Status describes a supervised process
+type Status struct {
+	Name       string    `json:"name"`
+	Running    bool      `json:"running"`
+	Pid        int       `json:"pid"`      // pid of the running process, 0 if not running
+	Restarts   int       `json:"restarts"` // times the process was restarted after exiting
+	StartedAt  time.Time `json:"started_at"`
+	LastExit   string    `json:"last_exit"` // reason the process last exited, empty if it has not exited
+	LastExitAt time.Time `json:"last_exit_at"`
+}
+
+// Supervisor runs a child process, restarting it with exponential backoff whenever it exits
+// stdout and stderr of the process are written line by line to Logger
+type Supervisor struct {
+	Name        string
+	Command     func() *exec.Cmd // builds a new command for every start, an exec.Cmd cannot be reused
+	Logger      *log.Logger
+	MinBackoff  time.Duration // delay before the first restart, doubled after each restart up to MaxBackoff
+	MaxBackoff  time.Duration
+	StableAfter time.Duration // a run lasting at least this long resets the backoff
+
+	lock   sync.Mutex
+	status Status
+}
+
+// NewSupervisor returns a supervisor for command with default backoff, logging output with the process name as prefix
+func NewSupervisor(name string, command func() *exec.Cmd) *Supervisor {
+	return &Supervisor{
+		Name:        name,
+		Command:     command,
+		Logger:      log.New(os.Stdout, fmt.Sprintf("[%s] - ", name), log.Ldate|log.Ltime),
+		MinBackoff:  defaultMinBackoff,
+		MaxBackoff:  defaultMaxBackoff,
+		StableAfter: defaultStableAfter,
+		status:      Status{Name: name},
+	}
+}
+
+// Run starts the process and restarts it every time it exits, until ctx is done
+// the running process is then stopped as described by Run, and nil is returned once it has exited
+func (s *Supervisor) Run(ctx context.Context) error {
+	backoff := s.MinBackoff
+	for {
+		cmd := s.Command()
+		stdout := &lineWriter{logger: s.Logger, stream: "stdout"}
+		stderr := &lineWriter{logger: s.Logger, stream: "stderr"}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		started := time.Now()
+		err := run(ctx, cmd, func(pid int) { s.started(pid, started) })
+		stdout.flush()
+		stderr.flush()
+		if ctx.Err() != nil {
+			s.exited("stopped")
+			return nil
+		}
+
+		reason := "exited"
+		if err != nil {
+			reason = err.Error()
+		}
+		s.exited(reason)
+
+		if time.Since(started) >= s.StableAfter {
+			backoff = s.MinBackoff
+		}
+		logger.Printf("Supervisor.Run - %s %s, restarting in %v", s.Name, reason, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+
+		s.lock.Lock()
+		s.status.Restarts++
+		s.lock.Unlock()
+	}
+}
+
+// Status returns the current state of the supervised process
+func (s *Supervisor) Status() Status {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := s.status
+	status.Name = s.Name
+	return status
+}
+
+func (s *Supervisor) started(pid int, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Running = true
+	s.status.Pid = pid
+	s.status.StartedAt = at
+}
+
+func (s *Supervisor) exited(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Running = false
+	s.status.Pid = 0
+	s.status.LastExit = reason
+	s.status.LastExitAt = time.Now()
+}
+
+// lineWriter logs process output one line at a time
+type lineWriter struct {
+	logger *log.Logger
+	stream string
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Printf("%s: %s", w.stream, bytes.TrimRight(w.buf[:i], "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > maxLineLength {
+		w.flush()
+	}
+	return len(p), nil
+}
+
+// flush logs any output left without a trailing newline
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.logger.Printf("%s: %s", w.stream, w.buf)
+		w.buf = nil
+	}
+}
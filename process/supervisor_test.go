@@ -0,0 +1,84 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while the supervisor is logging to it
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestSupervisor(t *testing.T) {
+	a := assert.New(t)
+
+	t.Run("restarts crashed process and captures output", func(t *testing.T) {
+		output := &syncBuffer{}
+		s := NewSupervisor("player", func() *exec.Cmd { return helperCommand("crash") })
+		s.Logger = log.New(output, "", 0)
+		s.MinBackoff = 10 * time.Millisecond
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- s.Run(ctx) }()
+
+		a.Eventually(func() bool { return s.Status().Restarts >= 2 }, 5*time.Second, 10*time.Millisecond)
+		cancel()
+		a.NoError(<-done)
+
+		status := s.Status()
+		a.Equal("player", status.Name)
+		a.False(status.Running)
+		a.Contains(output.String(), "stdout: starting player\n")
+		a.Contains(output.String(), "stderr: segmentation fault\n")
+	})
+
+	t.Run("reports exit reason and running process", func(t *testing.T) {
+		s := NewSupervisor("plaque", func() *exec.Cmd { return helperCommand("exit") })
+		s.Logger = log.New(&syncBuffer{}, "", 0)
+		s.MinBackoff = time.Minute // stays waiting after the first exit
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- s.Run(ctx) }()
+
+		a.Eventually(func() bool { return s.Status().LastExit != "" }, 5*time.Second, 10*time.Millisecond)
+		status := s.Status()
+		a.Equal("exit status 3", status.LastExit)
+		a.Equal(0, status.Restarts)
+		a.False(status.Running)
+		cancel()
+		a.NoError(<-done)
+
+		s = NewSupervisor("plaque", func() *exec.Cmd { return helperCommand("graceful") })
+		s.Logger = log.New(&syncBuffer{}, "", 0)
+		ctx, cancel = context.WithCancel(context.Background())
+		go func() { done <- s.Run(ctx) }()
+		a.Eventually(func() bool { return s.Status().Running }, 5*time.Second, 10*time.Millisecond)
+		a.NotZero(s.Status().Pid)
+		cancel()
+		a.NoError(<-done)
+		a.Equal("stopped", s.Status().LastExit)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"jkurtz678/moda-viewer/config"
 	"jkurtz678/moda-viewer/fstore"
 	"jkurtz678/moda-viewer/viewer"
 	"log"
@@ -14,7 +15,6 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
 )
 
@@ -57,7 +57,7 @@ func nameLocalPlaque(name string) {
 
 	plaque.Plaque.Name = name
 
-	err = fc.UpdatePlaque(ctx, plaque.DocumentID, []firestore.Update{{Path: "name", Value: name}})
+	err = fc.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{Name: &name})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -87,7 +87,7 @@ func assignArtistToPlaque(name string) {
 		metaIDs = append(metaIDs, m.DocumentID)
 	}
 
-	err = fc.UpdatePlaque(ctx, plaque.DocumentID, []firestore.Update{{Path: "token_meta_id_list", Value: metaIDs}})
+	err = fc.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{TokenMetaIDList: &metaIDs})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -96,15 +96,12 @@ func assignArtistToPlaque(name string) {
 }
 
 func getScriptClients() (*viewer.Viewer, *fstore.FirestoreClient) {
-	fc, err := fstore.NewFirestoreClient(context.Background(), "./serviceAccountKey.json")
+	cfg := config.Default()
+	fc, err := fstore.NewFirestoreClient(context.Background(), cfg.ServiceAccountKey)
 	if err != nil {
 		log.Fatal(err)
 	}
-	v := viewer.NewViewer(fc, nil)
-
-	v.PlaqueFile = "./plaque.json"
-	v.MediaDir = "./media"
-	v.MetadataDir = "./metadata"
+	v := viewer.NewViewer(cfg, fc, nil)
 
 	return v, fc
 }
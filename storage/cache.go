@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheIndexFile holds the last access time of each media file, sd cards are usually mounted without atime so it is tracked here
+const CacheIndexFile = ".cache-index.json"
+
+// CacheFile is a media file in the cache, partial downloads are listed under the name of the file they will become
+type CacheFile struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	LastAccess  time.Time `json:"last_access"`
+	Pinned      bool      `json:"pinned"`
+	Downloading bool      `json:"downloading"` // true for partial downloads and files being downloaded, which are never evicted
+}
+
+// CacheUsage reports the disk used by the media directory
+type CacheUsage struct {
+	Dir         string      `json:"dir"`
+	Quota       int64       `json:"quota"`       // bytes media files may use, 0 is no limit
+	Used        int64       `json:"used"`        // bytes used by media files, including partial downloads
+	Pinned      int64       `json:"pinned"`      // bytes used by pinned files, which are never evicted
+	Downloading int64       `json:"downloading"` // bytes used by downloads in progress, which are never evicted
+	OverQuota   bool        `json:"over_quota"`  // true if pinned files and downloads alone use more than the quota
+	Files       []CacheFile `json:"files"`       // most recently used first
+}
+
+// CacheManager keeps the media directory under a disk quota by evicting the least recently used files that are not pinned
+// files are pinned while the plaque references them, access times are persisted to CacheIndexFile in the directory
+type CacheManager struct {
+	Dir   string
+	Quota int64 // bytes media files may use, 0 keeps every file
+	// Active reports whether the named media file is being downloaded, nil if downloads are only known by their partial file
+	Active func(name string) bool
+
+	lock     sync.Mutex
+	accessed map[string]time.Time // last access by file name, nil until the index file is read
+	pinned   map[string]bool
+	now      func() time.Time // clock for access times, time.Now if nil
+}
+
+// NewCacheManager returns a cache manager for the media files in dir
+func NewCacheManager(dir string, quota int64) *CacheManager {
+	return &CacheManager{Dir: dir, Quota: quota}
+}
+
+// Touch records that the named media files were used now
+func (cm *CacheManager) Touch(names ...string) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.readIndex()
+	now := cm.clock()
+	for _, name := range names {
+		cm.accessed[name] = now
+	}
+	return cm.writeIndex()
+}
+
+// Pin replaces the pinned files, which are never evicted
+func (cm *CacheManager) Pin(names []string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.pinned = make(map[string]bool, len(names))
+	for _, name := range names {
+		cm.pinned[name] = true
+	}
+}
+
+// Evict removes the least recently used files that are not pinned or downloading until the media directory is under quota, returning the removed names
+// if pinned files and downloads alone are over quota every other file is removed and the rest are kept
+func (cm *CacheManager) Evict() ([]string, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	usage, err := cm.usage()
+	if err != nil || cm.Quota <= 0 || usage.Used <= cm.Quota {
+		return nil, err
+	}
+
+	// least recently used first
+	files := usage.Files
+	sort.SliceStable(files, func(i, j int) bool { return files[i].LastAccess.Before(files[j].LastAccess) })
+
+	removed := make([]string, 0)
+	used := usage.Used
+	for _, f := range files {
+		if used <= cm.Quota {
+			break
+		}
+		if f.Pinned || f.Downloading {
+			continue
+		}
+		path := filepath.Join(cm.Dir, f.Name)
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, fmt.Errorf("CacheManager.Evict - failed to remove %s %s", path, err)
+		}
+		logger.Printf("CacheManager.Evict - evicted %s, %v bytes last used %v", f.Name, f.Size, f.LastAccess)
+		removed = append(removed, f.Name)
+		delete(cm.accessed, f.Name)
+		used -= f.Size
+	}
+	if used > cm.Quota {
+		logger.Printf("CacheManager.Evict - pinned and downloading media uses %v bytes, over the quota of %v bytes", used, cm.Quota)
+	}
+	return removed, cm.writeIndex()
+}
+
+// Usage returns the size, last access, pin and download state of every media file
+func (cm *CacheManager) Usage() (*CacheUsage, error) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.usage()
+}
+
+// usage lists the media directory, cm.lock must be held
+// files without a recorded access use their modification time, which is when they were downloaded
+func (cm *CacheManager) usage() (*CacheUsage, error) {
+	cm.readIndex()
+	usage := &CacheUsage{Dir: cm.Dir, Quota: cm.Quota, Files: make([]CacheFile, 0)}
+	infos, err := ioutil.ReadDir(cm.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("CacheManager.Usage - failed to read media dir %s", err)
+	}
+
+	files := make(map[string]*CacheFile)
+	for _, info := range infos {
+		if info.IsDir() || info.Name() == CacheIndexFile || strings.HasSuffix(info.Name(), TempSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), PartialSuffix)
+		f, ok := files[name]
+		if !ok {
+			f = &CacheFile{Name: name, Pinned: cm.pinned[name], Downloading: cm.Active != nil && cm.Active(name)}
+			files[name] = f
+		}
+		if name != info.Name() {
+			f.Downloading = true
+		}
+		f.Size += info.Size()
+		if info.ModTime().After(f.LastAccess) {
+			f.LastAccess = info.ModTime()
+		}
+	}
+
+	for name, f := range files {
+		if accessed, ok := cm.accessed[name]; ok {
+			f.LastAccess = accessed
+		}
+		usage.Used += f.Size
+		switch {
+		case f.Pinned:
+			usage.Pinned += f.Size
+		case f.Downloading:
+			usage.Downloading += f.Size
+		}
+		usage.Files = append(usage.Files, *f)
+	}
+	sort.Slice(usage.Files, func(i, j int) bool {
+		if usage.Files[i].LastAccess.Equal(usage.Files[j].LastAccess) {
+			return usage.Files[i].Name < usage.Files[j].Name
+		}
+		return usage.Files[i].LastAccess.After(usage.Files[j].LastAccess)
+	})
+	usage.OverQuota = cm.Quota > 0 && usage.Pinned+usage.Downloading > cm.Quota
+
+	// forget access times of files removed outside the cache manager
+	for name := range cm.accessed {
+		if _, ok := files[name]; !ok {
+			delete(cm.accessed, name)
+		}
+	}
+	return usage, nil
+}
+
+// readIndex loads access times from the index file on first use, a missing or invalid index starts empty
+func (cm *CacheManager) readIndex() {
+	if cm.accessed != nil {
+		return
+	}
+	cm.accessed = make(map[string]time.Time)
+	data, err := ioutil.ReadFile(filepath.Join(cm.Dir, CacheIndexFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Printf("CacheManager - failed to read cache index, access times reset: %v", err)
+		}
+		return
+	}
+	err = json.Unmarshal(data, &cm.accessed)
+	if err != nil {
+		logger.Printf("CacheManager - invalid cache index, access times reset: %v", err)
+		cm.accessed = make(map[string]time.Time)
+	}
+}
+
+// writeIndex saves access times to the index file, cm.lock must be held
+func (cm *CacheManager) writeIndex() error {
+	data, err := json.Marshal(cm.accessed)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(cm.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(cm.Dir, CacheIndexFile), data, 0644)
+}
+
+func (cm *CacheManager) clock() time.Time {
+	if cm.now != nil {
+		return cm.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheManager(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+	write := func(name string, size int, modTime time.Time) {
+		path := filepath.Join(tmpdir, name)
+		a.NoError(ioutil.WriteFile(path, make([]byte, size), 0644))
+		a.NoError(os.Chtimes(path, modTime, modTime))
+	}
+	start := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	write("s1.mp4", 40, start)
+	write("s2.mp4", 30, start.Add(time.Minute))
+	write("s3.mp4", 20, start.Add(2*time.Minute))
+	write("s4.mp4"+PartialSuffix, 10, start.Add(3*time.Minute))
+	write("plaque.json"+TempSuffix, 100, start)
+
+	now := start.Add(time.Hour)
+	cm := NewCacheManager(tmpdir, 0)
+	cm.now = func() time.Time { return now }
+
+	// untouched files were last used when downloaded, temp files are not media
+	usage, err := cm.Usage()
+	a.NoError(err)
+	a.Equal(int64(100), usage.Used)
+	a.Equal([]string{"s4.mp4", "s3.mp4", "s2.mp4", "s1.mp4"}, cacheFileNames(usage.Files))
+
+	// without a quota nothing is evicted
+	removed, err := cm.Evict()
+	a.NoError(err)
+	a.Empty(removed)
+
+	// the least recently used unpinned files are evicted until under quota, partial downloads are kept
+	a.NoError(cm.Touch("s1.mp4"))
+	cm.Pin([]string{"s2.mp4"})
+	cm.Quota = 80
+	removed, err = cm.Evict()
+	a.NoError(err)
+	a.Equal([]string{"s3.mp4"}, removed)
+	a.FileExists(filepath.Join(tmpdir, "s4.mp4"+PartialSuffix))
+
+	usage, err = cm.Usage()
+	a.NoError(err)
+	a.Equal(int64(80), usage.Used)
+	a.Equal(int64(30), usage.Pinned)
+	a.Equal(int64(10), usage.Downloading)
+	a.False(usage.OverQuota)
+	a.Equal([]CacheFile{
+		{Name: "s1.mp4", Size: 40, LastAccess: now},
+		{Name: "s4.mp4", Size: 10, LastAccess: start.Add(3 * time.Minute).Local(), Downloading: true},
+		{Name: "s2.mp4", Size: 30, LastAccess: start.Add(time.Minute).Local(), Pinned: true},
+	}, usage.Files)
+
+	// access times are kept across restarts
+	cm = NewCacheManager(tmpdir, 60)
+	removed, err = cm.Evict()
+	a.NoError(err)
+	a.Equal([]string{"s2.mp4"}, removed)
+	usage, err = cm.Usage()
+	a.NoError(err)
+	a.True(usage.Files[0].LastAccess.Equal(now))
+
+	// files being downloaded are not evicted
+	cm.Active = func(name string) bool { return name == "s1.mp4" }
+	cm.Quota = 10
+	removed, err = cm.Evict()
+	a.NoError(err)
+	a.Empty(removed)
+	usage, err = cm.Usage()
+	a.NoError(err)
+	a.Equal(int64(50), usage.Downloading)
+	a.True(usage.OverQuota)
+	cm.Active = nil
+
+	// pinned files are kept even when they alone are over quota
+	cm.Pin([]string{"s1.mp4"})
+	cm.Quota = 10
+	removed, err = cm.Evict()
+	a.NoError(err)
+	a.Empty(removed)
+	usage, err = cm.Usage()
+	a.NoError(err)
+	a.True(usage.OverQuota)
+}
+
+func cacheFileNames(files []CacheFile) []string {
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
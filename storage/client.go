@@ -1,10 +1,12 @@
 package storage
 
 import (
+	"context"
 	"log"
 	"os"
-	"path/filepath"
-	"strings"
+	"sync"
+
+	gcs "cloud.google.com/go/storage"
 )
 
 var logger = log.New(os.Stdout, "[storage] - ", log.Ldate|log.Ltime|log.Lshortfile)
@@ -13,57 +15,35 @@ type FirebaseStorageClient struct {
 	storageBucketURL string // url of firebase storage bucket
 	credentialsFile  string // file path to firebase credentials
 	mediaDir         string // path to directory where media files are stored
-	downloadQueue    chan string
+	jobs             chan *downloadJob
+	done             <-chan struct{} // closed when the client context is done and workers have stopped taking jobs
+	progress         progressTracker // progress of downloads since the client was last idle
+	verified         verifiedFiles   // files that passed verification during this run
+
+	flightLock sync.Mutex
+	flights    map[string]*flight // downloads in progress by local path
+
+	bucketLock   sync.Mutex
+	bucketHandle *gcs.BucketHandle // long lived handle to the archive bucket, created on first use
 }
 
-func NewFirebaseStorageClient(storageBucketURL, credentialsFile, mediaDir string) *FirebaseStorageClient {
+// NewFirebaseStorageClient returns a client which downloads at most workers files at once
+// workers stop once ctx is done, cancelling their downloads
+func NewFirebaseStorageClient(ctx context.Context, storageBucketURL, credentialsFile, mediaDir string, workers int) *FirebaseStorageClient {
 	client := &FirebaseStorageClient{
 		storageBucketURL: storageBucketURL,
 		credentialsFile:  credentialsFile,
 		mediaDir:         mediaDir,
-		downloadQueue:    make(chan string, 10),
-	}
-
-	// start one worker who will wait on the downloadQueue
-	go client.handleQueue()
-
-	return client
-}
-
-// downloadFileFromFirebase will check if a file already exists locally, otherwise will download it from firebase
-func (sc *FirebaseStorageClient) AttemptDownloadFromFirebase(fileURI string) (bool, error) {
-	localPath := filepath.Join(sc.mediaDir, fileURI)
-	logger.Printf("DownloadFileFromFirebase – attempting download %s", localPath)
-
-	exists, err := FileExists(localPath)
-	if err != nil {
-		return false, err
+		jobs:             make(chan *downloadJob),
+		done:             ctx.Done(),
 	}
-	if exists {
-		logger.Println("File already exists, skipping download")
-		return false, nil
-	}
-
-	sc.downloadQueue <- fileURI
 
-	return true, nil
-}
-
-// AttemptDownloadFromURL will insert a url into the download queue
-func (sc *FirebaseStorageClient) AttemptDownloadFromURL(url string) (bool, error) {
-	splitURL := strings.Split(url, "/")
-	fileName := splitURL[len(splitURL)-1]
-	localPath := filepath.Join(sc.mediaDir, fileName)
-	exists, err := FileExists(localPath)
-	if err != nil {
-		return false, err
+	if workers < 1 {
+		workers = 1
 	}
-	if exists {
-		logger.Println("File already exists, skipping download")
-		return false, nil
+	for i := 0; i < workers; i++ {
+		go client.worker(ctx)
 	}
 
-	sc.downloadQueue <- url
-
-	return true, nil
+	return client
 }
@@ -2,111 +2,317 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
+	gcs "cloud.google.com/go/storage"
 	firebase "firebase.google.com/go"
 	"google.golang.org/api/option"
 )
 
+const (
+	maxDownloadAttempts = 2               // times a download that fails verification is fetched before giving up
+	maxResumeAttempts   = 5               // times an interrupted download is resumed before giving up
+	resumeDelay         = 2 * time.Second // pause before resuming an interrupted download
+)
+
 // MediaClient contains methods for managing media files videos/images/gifs
+// downloads are verified against the given checksum, failing with a *VerificationError if they do not match
+// downloads run on a bounded pool of workers, each call blocks until its download completes or ctx is done
 type MediaClient interface {
-	DownloadFileFromArchive(fileURI string) error
-	DownloadFileFromURL(fileURL string) error
+	DownloadFileFromArchive(ctx context.Context, fileURI string, checksum Checksum) error
+	DownloadFileFromURL(ctx context.Context, fileURL string, checksum Checksum) error
+	Progress() Progress
 }
 
-func (sc *FirebaseStorageClient) handleQueue() {
-	for fileURI := range sc.downloadQueue {
-		var err error
-		if strings.Contains(fileURI, "https://") {
-			err = sc.DownloadFileFromURL(fileURI)
-		} else {
-			err = sc.DownloadFileFromArchive(fileURI)
-		}
-		if err != nil {
-			logger.Printf("error downloading file %+v", err)
-		}
-	}
+func (sc *FirebaseStorageClient) DownloadFileFromURL(ctx context.Context, fileURL string, checksum Checksum) error {
+	localPath := filepath.Join(sc.mediaDir, filepath.Base(fileURL))
+	return sc.submit(ctx, localPath, func(ctx context.Context) error {
+		return sc.downloadFromURL(ctx, fileURL, localPath, checksum)
+	})
 }
-func (sc *FirebaseStorageClient) DownloadFileFromURL(fileURL string) error {
+
+func (sc *FirebaseStorageClient) DownloadFileFromArchive(ctx context.Context, fileURI string, checksum Checksum) error {
+	localPath := filepath.Join(sc.mediaDir, fileURI)
+	return sc.submit(ctx, localPath, func(ctx context.Context) error {
+		return sc.downloadFromArchive(ctx, fileURI, localPath, checksum)
+	})
+}
+
+func (sc *FirebaseStorageClient) downloadFromURL(ctx context.Context, fileURL, localPath string, checksum Checksum) error {
 	logger.Printf("downloadFileFromURL - %s", fileURL)
 
-	// first check if file exists
-	localPath := filepath.Join(sc.mediaDir, filepath.Base(fileURL))
-	exists, err := FileExists(localPath)
+	// first check if a verified file exists
+	exp := expectation{Checksum: checksum}
+	ok, err := sc.verifyExisting(localPath, exp)
 	if err != nil {
 		return fmt.Errorf("FirebaseStorageClient.DownloadFileFromURL - error checking file status %s", err)
 	}
-	if exists {
+	if ok {
 		log.Print("FirebaseStorageClient.DownloadFileFromURL - File already exists, skipping download")
 		return nil
 	}
 
-	resp, err := http.Get(fileURL)
+	for attempt := 1; attempt <= maxDownloadAttempts; attempt++ {
+		err = sc.fetch(ctx, sc.urlOpener(fileURL), localPath, exp)
+		var verr *VerificationError
+		if !errors.As(err, &verr) {
+			return err
+		}
+		logger.Printf("FirebaseStorageClient.DownloadFileFromURL - attempt %v of %v failed verification: %v", attempt, maxDownloadAttempts, err)
+	}
+	return err
+}
+
+func (sc *FirebaseStorageClient) downloadFromArchive(ctx context.Context, fileURI, localPath string, checksum Checksum) error {
+	logger.Printf("downloadFileFromFirebase – %s", fileURI)
+
+	exp := sc.archiveExpectation(ctx, fileURI, checksum)
+	ok, err := sc.verifyExisting(localPath, exp)
 	if err != nil {
-		return err
+		return fmt.Errorf("FirebaseStorageClient.downloadFileFromFirebase - error checking file status %s", err)
+	}
+	if ok {
+		log.Print("FirebaseStorageClient.downloadFileFromFirebase - File already exists, skipping download")
+		return nil
 	}
-	defer resp.Body.Close()
 
+	for attempt := 1; attempt <= maxDownloadAttempts; attempt++ {
+		err = sc.fetch(ctx, sc.archiveOpener(fileURI), localPath, exp)
+		var verr *VerificationError
+		if !errors.As(err, &verr) {
+			return err
+		}
+		logger.Printf("FirebaseStorageClient.DownloadFileFromArchive - attempt %v of %v failed verification: %v", attempt, maxDownloadAttempts, err)
+	}
+	if err == nil {
+		log.Printf("FirebaseStorageClient.downloadFileFromFirebase - download complete for file %s", localPath)
+	}
+	return err
+}
+
+// openFunc opens media for reading from offset
+// resumed is false if the source ignored offset and is sending the whole file, size is the size of the whole file or -1 if unknown
+type openFunc func(ctx context.Context, offset int64) (body io.ReadCloser, resumed bool, size int64, err error)
+
+// errRangeNotSatisfiable is returned by an openFunc when offset is past the end of the media
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// urlOpener opens media on an external server, using a range request to resume
+func (sc *FirebaseStorageClient) urlOpener(fileURL string) openFunc {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, bool, int64, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, http.NoBody)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return resp.Body, false, resp.ContentLength, nil
+		case http.StatusPartialContent:
+			size := int64(-1)
+			if resp.ContentLength >= 0 {
+				size = offset + resp.ContentLength
+			}
+			return resp.Body, true, size, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, false, 0, errRangeNotSatisfiable
+		}
+		return nil, false, 0, fmt.Errorf("FirebaseStorageClient.DownloadFileFromURL - unexpected status %s for %s", resp.Status, fileURL)
+	}
+}
+
+// archiveOpener opens an object in the firebase storage bucket, using a range read to resume
+func (sc *FirebaseStorageClient) archiveOpener(fileURI string) openFunc {
+	return func(ctx context.Context, offset int64) (io.ReadCloser, bool, int64, error) {
+		bucket, err := sc.bucket()
+		if err != nil {
+			return nil, false, 0, err
+		}
+		rc, err := bucket.Object(fileURI).NewRangeReader(ctx, offset, -1)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		return rc, true, rc.Attrs.Size, nil
+	}
+}
+
+// fetch streams media from open into the partial file for localPath, resuming from wherever a previous fetch stopped
+// the partial file is only moved to localPath once it passes verification
+// if the source keeps failing the partial file is kept so a later fetch can resume it
+func (sc *FirebaseStorageClient) fetch(ctx context.Context, open openFunc, localPath string, exp expectation) error {
 	// create media dir if it does not exist, does nothing if already exists
-	err = os.MkdirAll(sc.mediaDir, os.ModePerm)
+	err := os.MkdirAll(sc.mediaDir, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("FirebaseStorageClient.performDownload - Failed to create media dir %s error %s", sc.mediaDir, err)
+		return fmt.Errorf("FirebaseStorageClient.fetch - Failed to create media dir %s error %s", sc.mediaDir, err)
 	}
 
-	// Create the file
-	out, err := os.Create(localPath)
+	out, err := OpenPartial(localPath)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	return err
+	progress := &progressWriter{tracker: &sc.progress, name: filepath.Base(localPath), total: exp.Size}
+	for attempt := 1; ; attempt++ {
+		err = resume(ctx, open, out.File, exp, progress)
+		if err == nil {
+			break
+		}
+		if attempt >= maxResumeAttempts || ctx.Err() != nil {
+			out.Sync()
+			out.Close()
+			return fmt.Errorf("FirebaseStorageClient.fetch - download of %s stopped after %v attempt(s): %w", localPath, attempt, err)
+		}
+		logger.Printf("FirebaseStorageClient.fetch - download of %s interrupted, resuming in %v: %v", localPath, resumeDelay, err)
+		select {
+		case <-time.After(resumeDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	err = verifyFile(out.Name(), exp)
+	if err != nil {
+		out.Abort() // start from scratch next time
+		return err
+	}
+	err = out.Commit()
+	if err != nil {
+		return err
+	}
+	sc.verified.add(localPath, exp)
+	return nil
 }
 
-func (sc *FirebaseStorageClient) DownloadFileFromArchive(fileURI string) error {
-	localPath := filepath.Join(sc.mediaDir, fileURI)
-	logger.Printf("downloadFileFromFirebase – %s", fileURI)
+// resume appends the rest of the media to f, starting over if the source cannot continue from the current size of f
+// bytes written are reported to progress
+func resume(ctx context.Context, open openFunc, f *os.File, exp expectation, progress *progressWriter) error {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if exp.Size > 0 && offset == exp.Size {
+		return nil // already complete
+	}
+	if exp.Size > 0 && offset > exp.Size {
+		offset, err = 0, truncate(f)
+		if err != nil {
+			return err
+		}
+	}
 
-	exists, err := FileExists(localPath)
+	body, resumed, size, err := open(ctx, offset)
+	if errors.Is(err, errRangeNotSatisfiable) {
+		offset, err = 0, truncate(f)
+		if err != nil {
+			return err
+		}
+		body, resumed, size, err = open(ctx, 0)
+	}
 	if err != nil {
-		return fmt.Errorf("FirebaseStorageClient.downloadFileFromFirebase - error checking file status %s", err)
+		return err
 	}
-	if exists {
-		log.Print("FirebaseStorageClient.downloadFileFromFirebase - File already exists, skipping download")
-		return nil
+	defer body.Close()
+
+	if offset > 0 && resumed {
+		logger.Printf("resume - continuing %s from byte %v", f.Name(), offset)
+	} else if offset > 0 {
+		offset, err = 0, truncate(f)
+		if err != nil {
+			return err
+		}
 	}
-	data, err := sc.retrieveFileFromFirebase(fileURI)
+
+	if progress.total <= 0 && size > 0 {
+		progress.total = size
+	}
+	progress.done = offset
+	progress.tracker.update(progress.name, progress.done, progress.total)
+
+	_, err = io.Copy(io.MultiWriter(f, progress), body)
+	return err
+}
+
+func truncate(f *os.File) error {
+	err := f.Truncate(0)
 	if err != nil {
-		return fmt.Errorf("FirebaseStorageClient.DownloadFileFromArchive - retrieveFile %s error %s", fileURI, err)
+		return err
 	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
 
-	log.Println("FirebaseStorageClient.DownloadFileFromArchive - Writing file...")
+// verifyExisting returns true if a file exists at localPath and passes verification
+// an existing file that fails verification is removed so it will be fetched again
+func (sc *FirebaseStorageClient) verifyExisting(localPath string, exp expectation) (bool, error) {
+	exists, err := FileExists(localPath)
+	if err != nil || !exists {
+		return false, err
+	}
+	if sc.verified.check(localPath, exp) {
+		return true, nil
+	}
 
-	// create media dir if it does not exist, does nothing if already exists
-	err = os.MkdirAll(sc.mediaDir, os.ModePerm)
+	err = verifyFile(localPath, exp)
+	var verr *VerificationError
+	if errors.As(err, &verr) {
+		logger.Printf("FirebaseStorageClient.verifyExisting - removing invalid file to fetch again: %v", err)
+		return false, os.Remove(localPath)
+	}
 	if err != nil {
-		return fmt.Errorf("FirebaseStorageClient.performDownload - Failed to create media dir %s error %s", sc.mediaDir, err)
+		return false, err
 	}
+	sc.verified.add(localPath, exp)
+	return true, nil
+}
+
+// archiveExpectation adds the size and hashes cloud storage reports for fileURI to checksum
+// if the archive cannot be reached, only checksum is used
+func (sc *FirebaseStorageClient) archiveExpectation(ctx context.Context, fileURI string, checksum Checksum) expectation {
+	exp := expectation{Checksum: checksum}
 
-	err = os.WriteFile(localPath, data, 0644)
+	bucket, err := sc.bucket()
 	if err != nil {
-		return fmt.Errorf("FirebaseStorageClient.performDownload - WriteFile %s error %s", fileURI, err)
+		logger.Printf("FirebaseStorageClient.archiveExpectation - archive unavailable, verifying %s against metadata only: %v", fileURI, err)
+		return exp
 	}
-	log.Printf("FirebaseStorageClient.downloadFileFromFirebase - download complete for file %s", localPath)
-	return nil
+	attrs, err := bucket.Object(fileURI).Attrs(ctx)
+	if err != nil {
+		logger.Printf("FirebaseStorageClient.archiveExpectation - failed to get attributes, verifying %s against metadata only: %v", fileURI, err)
+		return exp
+	}
+
+	if exp.Size == 0 {
+		exp.Size = attrs.Size
+	}
+	exp.md5 = attrs.MD5
+	exp.crc32c = attrs.CRC32C
+	exp.hasCRC32C = true
+	return exp
 }
 
-// downloadFromCloudStorage will retrieve a file from firebase storage
-func (sc *FirebaseStorageClient) retrieveFileFromFirebase(fileURI string) ([]byte, error) {
+// bucket returns the long lived handle to the firebase storage bucket, creating it on first use
+func (sc *FirebaseStorageClient) bucket() (*gcs.BucketHandle, error) {
+	sc.bucketLock.Lock()
+	defer sc.bucketLock.Unlock()
+	if sc.bucketHandle != nil {
+		return sc.bucketHandle, nil
+	}
+
 	config := &firebase.Config{
 		StorageBucket: sc.storageBucketURL,
 	}
@@ -125,17 +331,6 @@ func (sc *FirebaseStorageClient) retrieveFileFromFirebase(fileURI string) ([]byt
 	if err != nil {
 		return nil, err
 	}
-	log.Println("FirebaseStorageClient.retrieveFileFromFirebase - reading from bucket")
-
-	rc, err := bucket.Object(fileURI).NewReader(context.Background())
-	if err != nil {
-		return nil, err
-	}
-	defer rc.Close()
-
-	data, err := ioutil.ReadAll(rc)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	sc.bucketHandle = bucket
+	return bucket, nil
 }
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeDownload(t *testing.T) {
+	ctx := context.Background()
+	a := assert.New(t)
+	content := bytes.Repeat([]byte("a sunday on la grande jatte "), 1000)
+
+	t.Run("resumes partial file with range request", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		var ranges []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			http.ServeContent(w, r, "s1.mp4", time.Time{}, bytes.NewReader(content))
+		}))
+		defer server.Close()
+
+		a.NoError(ioutil.WriteFile(filepath.Join(tmpdir, "s1.mp4"+PartialSuffix), content[:100], 0644))
+
+		sc := NewFirebaseStorageClient(ctx, "", "", tmpdir, 1)
+		a.NoError(sc.DownloadFileFromURL(ctx, server.URL+"/s1.mp4", Checksum{Size: int64(len(content))}))
+		a.Equal([]string{"bytes=100-"}, ranges)
+
+		data, err := ioutil.ReadFile(filepath.Join(tmpdir, "s1.mp4"))
+		a.NoError(err)
+		a.Equal(content, data)
+
+		exists, err := FileExists(filepath.Join(tmpdir, "s1.mp4"+PartialSuffix))
+		a.NoError(err)
+		a.False(exists)
+	})
+
+	t.Run("starts over if server ignores range", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		}))
+		defer server.Close()
+
+		a.NoError(ioutil.WriteFile(filepath.Join(tmpdir, "s1.mp4"+PartialSuffix), []byte("stale partial data"), 0644))
+
+		sc := NewFirebaseStorageClient(ctx, "", "", tmpdir, 1)
+		a.NoError(sc.DownloadFileFromURL(ctx, server.URL+"/s1.mp4", Checksum{}))
+
+		data, err := ioutil.ReadFile(filepath.Join(tmpdir, "s1.mp4"))
+		a.NoError(err)
+		a.Equal(content, data)
+	})
+}
+
+func TestDownloadPool(t *testing.T) {
+	ctx := context.Background()
+	a := assert.New(t)
+	content := bytes.Repeat([]byte("starry night "), 1000)
+
+	var lock sync.Mutex
+	active, maxActive, requests := 0, 0, 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		active++
+		requests++
+		if active > maxActive {
+			maxActive = active
+		}
+		wait := release
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			active--
+			lock.Unlock()
+		}()
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content[:10])
+		w.(http.Flusher).Flush()
+		select {
+		case <-wait:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(content[10:])
+	}))
+	defer server.Close()
+
+	t.Run("limits concurrent downloads and reports progress", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		sc := NewFirebaseStorageClient(ctx, "", "", tmpdir, 2)
+
+		files := []string{"s1.mp4", "s2.mp4", "s3.mp4", "s4.mp4"}
+		errs := make(chan error, len(files))
+		for _, file := range files {
+			go func(file string) {
+				errs <- sc.DownloadFileFromURL(context.Background(), server.URL+"/"+file, Checksum{})
+			}(file)
+		}
+
+		// two downloads start and stall, the others wait for a worker
+		a.Eventually(func() bool {
+			p := sc.Progress()
+			states := map[DownloadState]int{}
+			for _, f := range p.Files {
+				states[f.State]++
+			}
+			return len(p.Files) == 4 && states[DownloadActive] == 2 && states[DownloadQueued] == 2 && p.BytesDone == 20
+		}, time.Second, 10*time.Millisecond)
+
+		close(release)
+		for range files {
+			a.NoError(<-errs)
+		}
+		a.Equal(2, maxActive)
+
+		p := sc.Progress()
+		a.Len(p.Files, 4)
+		for _, f := range p.Files {
+			a.Equal(DownloadDone, f.State)
+			a.Equal(int64(len(content)), f.BytesTotal)
+		}
+		a.Equal(int64(4*len(content)), p.BytesDone)
+		a.Equal(p.BytesTotal, p.BytesDone)
+	})
+
+	t.Run("cancels download through context", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		sc := NewFirebaseStorageClient(ctx, "", "", tmpdir, 1)
+		lock.Lock()
+		release = make(chan struct{}) // stall every request again
+		lock.Unlock()
+
+		downloadCtx, cancel := context.WithCancel(ctx)
+		errs := make(chan error, 2)
+		go func() { errs <- sc.DownloadFileFromURL(downloadCtx, server.URL+"/s1.mp4", Checksum{}) }()
+		go func() { errs <- sc.DownloadFileFromURL(downloadCtx, server.URL+"/s2.mp4", Checksum{}) }()
+
+		a.Eventually(func() bool { return sc.Progress().BytesDone == 10 }, time.Second, 10*time.Millisecond)
+		cancel()
+		a.ErrorIs(<-errs, context.Canceled)
+		a.ErrorIs(<-errs, context.Canceled)
+
+		a.Eventually(func() bool {
+			for _, f := range sc.Progress().Files {
+				if f.State != DownloadFailed {
+					return false
+				}
+			}
+			return true
+		}, time.Second, 10*time.Millisecond)
+
+		exists, err := FileExists(filepath.Join(tmpdir, "s1.mp4"))
+		a.NoError(err)
+		a.False(exists)
+	})
+
+	t.Run("stops downloads when client context is done", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		clientCtx, stop := context.WithCancel(ctx)
+		sc := NewFirebaseStorageClient(clientCtx, "", "", tmpdir, 1)
+
+		errs := make(chan error, 1)
+		go func() { errs <- sc.DownloadFileFromURL(ctx, server.URL+"/s1.mp4", Checksum{}) }()
+		a.Eventually(func() bool { return sc.Progress().BytesDone == 10 }, time.Second, 10*time.Millisecond)
+		stop()
+		a.ErrorIs(<-errs, context.Canceled)
+
+		// partial download is kept to resume after restart
+		exists, err := FileExists(filepath.Join(tmpdir, "s1.mp4"+PartialSuffix))
+		a.NoError(err)
+		a.True(exists)
+
+		a.ErrorIs(sc.DownloadFileFromURL(ctx, server.URL+"/s2.mp4", Checksum{}), errClientStopped)
+	})
+
+	t.Run("shares a download of the same file", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		sc := NewFirebaseStorageClient(ctx, "", "", tmpdir, 2)
+		lock.Lock()
+		release = make(chan struct{})
+		requests = 0
+		lock.Unlock()
+
+		// a load, a retry and a prefetch of the same token, and another url with the same file name
+		loadCtx, cancel := context.WithCancel(ctx)
+		errs := make(chan error, 3)
+		go func() { errs <- sc.DownloadFileFromURL(loadCtx, server.URL+"/a/s1.mp4", Checksum{}) }()
+		a.Eventually(func() bool { return sc.Progress().BytesDone == 10 }, time.Second, 10*time.Millisecond)
+		go func() { errs <- sc.DownloadFileFromURL(ctx, server.URL+"/a/s1.mp4", Checksum{}) }()
+		go func() { errs <- sc.DownloadFileFromURL(ctx, server.URL+"/b/s1.mp4", Checksum{}) }()
+
+		// the first caller giving up does not cancel the download the others wait for
+		a.Eventually(func() bool {
+			sc.flightLock.Lock()
+			defer sc.flightLock.Unlock()
+			return sc.flights[filepath.Join(tmpdir, "s1.mp4")].waiters == 3
+		}, time.Second, 10*time.Millisecond)
+		cancel()
+		a.ErrorIs(<-errs, context.Canceled)
+
+		lock.Lock()
+		close(release)
+		lock.Unlock()
+		a.NoError(<-errs)
+		a.NoError(<-errs)
+
+		lock.Lock()
+		a.Equal(1, requests)
+		lock.Unlock()
+		data, err := ioutil.ReadFile(filepath.Join(tmpdir, "s1.mp4"))
+		a.NoError(err)
+		a.Equal(content, data)
+		a.Len(sc.Progress().Files, 1)
+		a.Empty(sc.flights)
+	})
+}
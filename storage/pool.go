@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+)
+
+// errClientStopped is returned for downloads submitted after the client context is done
+var errClientStopped = errors.New("storage client stopped")
+
+// downloadJob is a download waiting for a free worker
+type downloadJob struct {
+	ctx      context.Context
+	name     string // local file name, used to report progress
+	download func(ctx context.Context) error
+	done     chan error // receives the result of download, buffered so the worker never blocks
+}
+
+// worker runs downloads from the job queue, one at a time, until ctx is done
+func (sc *FirebaseStorageClient) worker(ctx context.Context) {
+	for {
+		select {
+		case job := <-sc.jobs:
+			sc.run(ctx, job)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run downloads job, cancelling the download if either the job or the client context is done
+func (sc *FirebaseStorageClient) run(ctx context.Context, job *downloadJob) {
+	jobCtx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-jobCtx.Done():
+		}
+	}()
+
+	// skip downloads that were cancelled while waiting for a worker
+	err := jobCtx.Err()
+	if ctx.Err() != nil {
+		err = errClientStopped
+	}
+	if err == nil {
+		sc.progress.start(job.name)
+		err = job.download(jobCtx)
+	}
+	sc.progress.finish(job.name, err)
+	job.done <- err
+}
+
+// flight is a download shared by every caller asking for the same local file while it runs
+type flight struct {
+	done    chan struct{} // closed once err is set
+	err     error
+	waiters int                // callers still waiting, the download is cancelled when the last one gives up
+	cancel  context.CancelFunc // cancels the download
+}
+
+// submit downloads to localPath on the next free worker and blocks until it completes or ctx is done
+// callers asking for a localPath already being downloaded wait for that download instead of starting another into the same partial file
+func (sc *FirebaseStorageClient) submit(ctx context.Context, localPath string, download func(ctx context.Context) error) error {
+	sc.flightLock.Lock()
+	f, ok := sc.flights[localPath]
+	if !ok || f.waiters == 0 {
+		// a flight without waiters is cancelled, the new one starts once it has stopped writing
+		previous := f
+		flightCtx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		if sc.flights == nil {
+			sc.flights = make(map[string]*flight)
+		}
+		sc.flights[localPath] = f
+		go sc.fly(flightCtx, localPath, f, previous, download)
+	}
+	f.waiters++
+	sc.flightLock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		sc.flightLock.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+		}
+		sc.flightLock.Unlock()
+		return ctx.Err()
+	}
+}
+
+// fly runs the download of f after previous, the cancelled download of the same file if any, has stopped
+func (sc *FirebaseStorageClient) fly(ctx context.Context, localPath string, f, previous *flight, download func(ctx context.Context) error) {
+	defer f.cancel()
+	if previous != nil {
+		<-previous.done
+	}
+	err := sc.queue(ctx, localPath, download)
+
+	sc.flightLock.Lock()
+	if sc.flights[localPath] == f {
+		delete(sc.flights, localPath)
+	}
+	f.err = err
+	sc.flightLock.Unlock()
+	close(f.done)
+}
+
+// queue queues download for the next free worker and blocks until it has stopped
+func (sc *FirebaseStorageClient) queue(ctx context.Context, localPath string, download func(ctx context.Context) error) error {
+	job := &downloadJob{
+		ctx:      ctx,
+		name:     filepath.Base(localPath),
+		download: download,
+		done:     make(chan error, 1),
+	}
+	sc.progress.queue(job.name)
+
+	select {
+	case sc.jobs <- job:
+	case <-ctx.Done():
+		sc.progress.finish(job.name, ctx.Err())
+		return ctx.Err()
+	case <-sc.done:
+		sc.progress.finish(job.name, errClientStopped)
+		return errClientStopped
+	}
+
+	// the worker sees a cancelled context and stops the download, waiting for it keeps the partial file to one writer
+	return <-job.done
+}
+
+// Downloading reports whether the media file name is being downloaded or waiting for a worker
+func (sc *FirebaseStorageClient) Downloading(name string) bool {
+	sc.flightLock.Lock()
+	defer sc.flightLock.Unlock()
+	_, ok := sc.flights[filepath.Join(sc.mediaDir, name)]
+	return ok
+}
+
+// Progress returns the progress of every download since the client was last idle
+func (sc *FirebaseStorageClient) Progress() Progress {
+	return sc.progress.snapshot()
+}
@@ -0,0 +1,119 @@
+package storage
+
+import "sync"
+
+// DownloadState is the state of a single media download
+type DownloadState string
+
+const (
+	DownloadQueued = DownloadState("queued")      // waiting for a free worker
+	DownloadActive = DownloadState("downloading") // worker is checking or fetching the file
+	DownloadDone   = DownloadState("done")        // file is local and verified
+	DownloadFailed = DownloadState("failed")      // download failed or was cancelled
+)
+
+// FileProgress is the progress of a single media download
+type FileProgress struct {
+	File       string        `json:"file"`
+	State      DownloadState `json:"state"`
+	BytesDone  int64         `json:"bytes_done"`
+	BytesTotal int64         `json:"bytes_total"` // 0 until the size of the file is known
+	Error      string        `json:"error,omitempty"`
+}
+
+// Progress is the aggregated progress of downloads submitted since the media client was last idle
+type Progress struct {
+	Files      []FileProgress `json:"files"` // in the order downloads were submitted
+	BytesDone  int64          `json:"bytes_done"`
+	BytesTotal int64          `json:"bytes_total"`
+}
+
+// progressTracker records download progress, starting a fresh batch when a download is queued while no others are pending
+type progressTracker struct {
+	lock    sync.Mutex
+	files   map[string]*FileProgress
+	order   []string
+	pending int // downloads queued or in progress
+}
+
+func (pt *progressTracker) queue(name string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if pt.pending == 0 || pt.files == nil {
+		pt.files = make(map[string]*FileProgress)
+		pt.order = nil
+	}
+	pt.pending++
+	if _, ok := pt.files[name]; !ok {
+		pt.order = append(pt.order, name)
+	}
+	pt.files[name] = &FileProgress{File: name, State: DownloadQueued}
+}
+
+func (pt *progressTracker) start(name string) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if fp, ok := pt.files[name]; ok {
+		fp.State = DownloadActive
+	}
+}
+
+// update sets the bytes written so far and the total size of a download, a total of 0 leaves the known total unchanged
+func (pt *progressTracker) update(name string, done, total int64) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	fp, ok := pt.files[name]
+	if !ok {
+		return
+	}
+	fp.BytesDone = done
+	if total > 0 {
+		fp.BytesTotal = total
+	}
+}
+
+func (pt *progressTracker) finish(name string, err error) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.pending--
+	fp, ok := pt.files[name]
+	if !ok {
+		return
+	}
+	if err != nil {
+		fp.State = DownloadFailed
+		fp.Error = err.Error()
+		return
+	}
+	fp.State = DownloadDone
+	if fp.BytesTotal > fp.BytesDone {
+		fp.BytesDone = fp.BytesTotal
+	}
+}
+
+func (pt *progressTracker) snapshot() Progress {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	p := Progress{Files: make([]FileProgress, 0, len(pt.order))}
+	for _, name := range pt.order {
+		fp := *pt.files[name]
+		p.Files = append(p.Files, fp)
+		p.BytesDone += fp.BytesDone
+		p.BytesTotal += fp.BytesTotal
+	}
+	return p
+}
+
+// progressWriter reports bytes written to a download in progress
+type progressWriter struct {
+	tracker *progressTracker
+	name    string
+	done    int64
+	total   int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.done += int64(len(p))
+	pw.tracker.update(pw.name, pw.done, pw.total)
+	return len(p), nil
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,7 +12,7 @@ type FirebaseStorageClientStub struct {
 }
 
 // DownloadFileFromArchive creates empty file for tests
-func (sc *FirebaseStorageClientStub) DownloadFileFromArchive(fileURI string) error {
+func (sc *FirebaseStorageClientStub) DownloadFileFromArchive(ctx context.Context, fileURI string, checksum Checksum) error {
 	logger.Printf("FirebaseStorageClientStub.DownloadFileFromArchive - %s", fileURI)
 	f, err := os.Create(filepath.Join(sc.MediaDir, fileURI))
 	if err != nil {
@@ -26,7 +27,7 @@ func (sc *FirebaseStorageClientStub) DownloadFileFromArchive(fileURI string) err
 }
 
 // DownloadFileFromURL creates empty file for tests
-func (sc *FirebaseStorageClientStub) DownloadFileFromURL(fileURL string) error {
+func (sc *FirebaseStorageClientStub) DownloadFileFromURL(ctx context.Context, fileURL string, checksum Checksum) error {
 	logger.Printf("FirebaseStorageClientStub.DownloadFileFromURL - %s", fileURL)
 	f, err := os.Create(filepath.Join(sc.MediaDir, filepath.Base(fileURL)))
 	if err != nil {
@@ -39,3 +40,8 @@ func (sc *FirebaseStorageClientStub) DownloadFileFromURL(fileURL string) error {
 
 	return nil
 }
+
+// Progress reports no downloads for tests
+func (sc *FirebaseStorageClientStub) Progress() Progress {
+	return Progress{}
+}
@@ -2,7 +2,16 @@ package storage
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	TempSuffix    = ".tmp"     // suffix of temp files written by WriteFileAtomic
+	PartialSuffix = ".partial" // suffix of media files that are still downloading
 )
 
 // FileExists returns true if file exists, false if not found
@@ -16,3 +25,118 @@ func FileExists(filePath string) (bool, error) {
 	}
 	return true, nil
 }
+
+// WriteFileAtomic writes data to a temp file next to path, syncs it to disk and renames it over path
+// readers will see either the old file or the complete new file, never a partial write
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*"+TempSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// AtomicFile is a file written under a partial name, which only appears at its final path once committed
+// closing without committing keeps the partial file, Abort removes it
+type AtomicFile struct {
+	*os.File
+	path string // final path of file
+}
+
+// OpenPartial opens the partial file for path without truncating it, so an interrupted download can continue where it stopped
+// the file is renamed to path on Commit
+func OpenPartial(path string) (*AtomicFile, error) {
+	f, err := os.OpenFile(path+PartialSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{File: f, path: path}, nil
+}
+
+// Commit syncs the partial file to disk and renames it to its final path
+func (f *AtomicFile) Commit() error {
+	err := f.File.Sync()
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	err = f.File.Close()
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	err = os.Rename(f.File.Name(), f.path)
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Abort closes and removes the partial file, safe to call after Commit
+func (f *AtomicFile) Abort() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+// RemoveIncompleteFiles deletes temp files left in dir by a crash or power loss, returning the removed paths
+// partial media files are kept so their downloads can resume
+func RemoveIncompleteFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	removed := make([]string, 0)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), TempSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		err = os.Remove(path)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// syncDir flushes a directory entry so a rename inside it survives power loss
+// windows does not support syncing directories, so it is skipped there
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
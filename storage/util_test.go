@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+	path := filepath.Join(tmpdir, "plaque.json")
+
+	a.NoError(WriteFileAtomic(path, []byte("first"), 0644))
+	a.NoError(WriteFileAtomic(path, []byte("second"), 0644))
+
+	data, err := ioutil.ReadFile(path)
+	a.NoError(err)
+	a.Equal("second", string(data))
+
+	files, err := ioutil.ReadDir(tmpdir)
+	a.NoError(err)
+	a.Len(files, 1)
+}
+
+func TestOpenPartial(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+	path := filepath.Join(tmpdir, "s1.mp4")
+
+	// aborted file never appears at final path
+	f, err := OpenPartial(path)
+	a.NoError(err)
+	_, err = f.Write([]byte("partial"))
+	a.NoError(err)
+	exists, err := FileExists(path)
+	a.NoError(err)
+	a.False(exists)
+	f.Abort()
+	exists, err = FileExists(path + PartialSuffix)
+	a.NoError(err)
+	a.False(exists)
+
+	// closed file keeps its contents for the next open
+	f, err = OpenPartial(path)
+	a.NoError(err)
+	_, err = f.Write([]byte("comp"))
+	a.NoError(err)
+	a.NoError(f.Close())
+
+	// committed file is moved to final path
+	f, err = OpenPartial(path)
+	a.NoError(err)
+	_, err = f.Seek(0, io.SeekEnd)
+	a.NoError(err)
+	_, err = f.Write([]byte("lete"))
+	a.NoError(err)
+	a.NoError(f.Commit())
+	f.Abort() // safe after commit
+
+	data, err := ioutil.ReadFile(path)
+	a.NoError(err)
+	a.Equal("complete", string(data))
+}
+
+func TestRemoveIncompleteFiles(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+
+	for _, name := range []string{"plaque.json", "plaque.json.123.tmp", "s1.mp4", "s2.mp4.partial"} {
+		a.NoError(ioutil.WriteFile(filepath.Join(tmpdir, name), []byte("data"), 0644))
+	}
+
+	removed, err := RemoveIncompleteFiles(tmpdir)
+	a.NoError(err)
+	a.Equal([]string{filepath.Join(tmpdir, "plaque.json.123.tmp")}, removed)
+
+	// partial media is kept to resume
+	for _, name := range []string{"plaque.json", "s1.mp4", "s2.mp4.partial"} {
+		_, err := os.Stat(filepath.Join(tmpdir, name))
+		a.NoError(err)
+	}
+
+	// missing dir is not an error
+	removed, err = RemoveIncompleteFiles(filepath.Join(tmpdir, "missing"))
+	a.NoError(err)
+	a.Empty(removed)
+}
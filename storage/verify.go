@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checksum holds the expected size and content hash of a media file, zero values are not checked
+type Checksum struct {
+	SHA256 string // hex encoded sha256 of file contents
+	Size   int64  // size of file in bytes
+}
+
+// VerificationError is returned when a media file does not match its expected size or checksum
+type VerificationError struct {
+	Path     string // path of file that failed verification
+	Check    string // check that failed, one of size, sha256, md5 or crc32c
+	Expected string
+	Actual   string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("media file %s failed %s verification - expected %s, got %s", e.Path, e.Check, e.Expected, e.Actual)
+}
+
+// expectation combines the checksum from token metadata with any attributes reported by the archive
+type expectation struct {
+	Checksum
+	md5       []byte // raw md5 reported by cloud storage, empty for composite objects
+	crc32c    uint32 // crc32c reported by cloud storage
+	hasCRC32C bool
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// verifyFile checks the file at path against exp, always failing empty files
+func verifyFile(path string, exp expectation) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = verifySize(path, info.Size(), exp)
+	if err != nil {
+		return err
+	}
+	return verifyHashes(path, f, exp)
+}
+
+func verifySize(path string, size int64, exp expectation) error {
+	if size == 0 {
+		return &VerificationError{Path: path, Check: "size", Expected: "non-empty file", Actual: "0"}
+	}
+	if exp.Size != 0 && exp.Size != size {
+		return &VerificationError{Path: path, Check: "size", Expected: fmt.Sprint(exp.Size), Actual: fmt.Sprint(size)}
+	}
+	return nil
+}
+
+// verifyHashes reads r once, computing only the hashes that exp has values for
+func verifyHashes(path string, r io.Reader, exp expectation) error {
+	var sha, md hash.Hash
+	var crc hash.Hash32
+	writers := make([]io.Writer, 0, 3)
+	if exp.SHA256 != "" {
+		sha = sha256.New()
+		writers = append(writers, sha)
+	}
+	if len(exp.md5) > 0 {
+		md = md5.New()
+		writers = append(writers, md)
+	}
+	if exp.hasCRC32C {
+		crc = crc32.New(crc32cTable)
+		writers = append(writers, crc)
+	}
+	if len(writers) == 0 {
+		return nil
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		return err
+	}
+
+	if sha != nil {
+		actual := hex.EncodeToString(sha.Sum(nil))
+		if !strings.EqualFold(actual, exp.SHA256) {
+			return &VerificationError{Path: path, Check: "sha256", Expected: exp.SHA256, Actual: actual}
+		}
+	}
+	if md != nil {
+		actual := md.Sum(nil)
+		if !bytes.Equal(actual, exp.md5) {
+			return &VerificationError{Path: path, Check: "md5", Expected: hex.EncodeToString(exp.md5), Actual: hex.EncodeToString(actual)}
+		}
+	}
+	if crc != nil && crc.Sum32() != exp.crc32c {
+		return &VerificationError{Path: path, Check: "crc32c", Expected: fmt.Sprint(exp.crc32c), Actual: fmt.Sprint(crc.Sum32())}
+	}
+	return nil
+}
+
+// verifiedFiles remembers files that passed verification so unchanged files are not hashed again on every load
+type verifiedFiles struct {
+	lock  sync.Mutex
+	files map[string]verifiedFile
+}
+
+type verifiedFile struct {
+	size    int64
+	modTime time.Time
+	exp     string // expectation the file was verified against
+}
+
+// check returns true if the file at path is unchanged since it was verified against exp
+func (vf *verifiedFiles) check(path string, exp expectation) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	entry, ok := vf.files[path]
+	return ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) && entry.exp == fmt.Sprintf("%+v", exp)
+}
+
+// add records that the file at path passed verification against exp
+func (vf *verifiedFiles) add(path string, exp expectation) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	vf.lock.Lock()
+	defer vf.lock.Unlock()
+	if vf.files == nil {
+		vf.files = make(map[string]verifiedFile)
+	}
+	vf.files[path] = verifiedFile{size: info.Size(), modTime: info.ModTime(), exp: fmt.Sprintf("%+v", exp)}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadVerification(t *testing.T) {
+	ctx := context.Background()
+	a := assert.New(t)
+	content := []byte("starry night media")
+	sum := sha256.Sum256(content)
+	checksum := Checksum{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	tmpdir := t.TempDir()
+	sc := NewFirebaseStorageClient(ctx, "", "", tmpdir, 1)
+	localPath := filepath.Join(tmpdir, "s1.mp4")
+
+	t.Run("downloads and verifies file", func(t *testing.T) {
+		a.NoError(sc.DownloadFileFromURL(ctx, server.URL+"/s1.mp4", checksum))
+		data, err := ioutil.ReadFile(localPath)
+		a.NoError(err)
+		a.Equal(content, data)
+		a.Equal(1, requests)
+	})
+
+	t.Run("skips verified existing file", func(t *testing.T) {
+		a.NoError(sc.DownloadFileFromURL(ctx, server.URL+"/s1.mp4", checksum))
+		a.Equal(1, requests)
+	})
+
+	t.Run("fetches corrupted existing file again", func(t *testing.T) {
+		a.NoError(ioutil.WriteFile(localPath, []byte("starry night mediA"), 0644))
+		a.NoError(sc.DownloadFileFromURL(ctx, server.URL+"/s1.mp4", checksum))
+		data, err := ioutil.ReadFile(localPath)
+		a.NoError(err)
+		a.Equal(content, data)
+		a.Equal(2, requests)
+	})
+
+	t.Run("fetches empty existing file again", func(t *testing.T) {
+		a.NoError(ioutil.WriteFile(localPath, []byte{}, 0644))
+		a.NoError(sc.DownloadFileFromURL(ctx, server.URL+"/s1.mp4", Checksum{}))
+		data, err := ioutil.ReadFile(localPath)
+		a.NoError(err)
+		a.Equal(content, data)
+		a.Equal(3, requests)
+	})
+
+	t.Run("returns verification error for mismatched download", func(t *testing.T) {
+		err := sc.DownloadFileFromURL(ctx, server.URL+"/s2.mp4", Checksum{Size: 5})
+		var verr *VerificationError
+		a.True(errors.As(err, &verr))
+		a.Equal("size", verr.Check)
+		a.Equal(3+maxDownloadAttempts, requests)
+
+		exists, err := FileExists(filepath.Join(tmpdir, "s2.mp4"))
+		a.NoError(err)
+		a.False(exists)
+	})
+}
+
+func TestVerifyHashes(t *testing.T) {
+	a := assert.New(t)
+	path := filepath.Join(t.TempDir(), "s1.mp4")
+	a.NoError(ioutil.WriteFile(path, []byte("irises"), 0644))
+
+	a.NoError(verifyFile(path, expectation{}))
+	a.NoError(verifyFile(path, expectation{crc32c: crc32.Checksum([]byte("irises"), crc32cTable), hasCRC32C: true}))
+
+	var verr *VerificationError
+	err := verifyFile(path, expectation{crc32c: 1, hasCRC32C: true})
+	a.True(errors.As(err, &verr))
+	a.Equal("crc32c", verr.Check)
+
+	err = verifyFile(path, expectation{md5: []byte{1, 2, 3}})
+	a.True(errors.As(err, &verr))
+	a.Equal("md5", verr.Check)
+}
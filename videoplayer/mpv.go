@@ -0,0 +1,272 @@
+package videoplayer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jkurtz678/moda-viewer/process"
+	"log"
+	"net"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// mpvTimeout limits how long a single ipc command may take
+const mpvTimeout = 5 * time.Second
+
+// MPVPlayer plays media with mpv, controlled through its json ipc unix socket
+type MPVPlayer struct {
+	socket     string              // path of the mpv ipc socket
+	supervisor *process.Supervisor // restarts mpv if it exits
+	stopped    chan struct{}       // closed when InitPlayer returns
+	stopOnce   sync.Once
+
+	lock      sync.Mutex
+	requestID int
+}
+
+func NewMPVPlayer(socket string) *MPVPlayer {
+	m := &MPVPlayer{
+		socket:  socket,
+		stopped: make(chan struct{}),
+	}
+	m.supervisor = process.NewSupervisor("mpv", m.command)
+	return m
+}
+
+// InitPlayer runs mpv, restarting it whenever it exits, until ctx is done and mpv has been stopped
+func (m *MPVPlayer) InitPlayer(ctx context.Context) error {
+	defer m.stopOnce.Do(func() { close(m.stopped) })
+	log.Println("MPVPlayer.InitPlayer() - running player")
+	return m.supervisor.Run(ctx)
+}
+
+// ProcessStatus returns restart count and last exit reason of the mpv process
+func (m *MPVPlayer) ProcessStatus() process.Status {
+	return m.supervisor.Status()
+}
+
+// command returns the command which starts mpv idle, looping its playlist and listening on the ipc socket
+// images are shown until the viewer moves on to the next file
+func (m *MPVPlayer) command() *exec.Cmd {
+	return exec.Command("mpv",
+		"--idle=yes",
+		"--force-window=yes",
+		"--fullscreen",
+		"--loop-playlist=inf",
+		"--image-display-duration=inf",
+		"--no-terminal",
+		fmt.Sprintf("--input-ipc-server=%s", m.socket),
+	)
+}
+
+func (m *MPVPlayer) PlayFiles(filepaths []string) error {
+	log.Printf("MPVPlayer.PlayFiles() - playing playlist of %v file(s)", len(filepaths))
+	_, err := m.send("playlist-clear")
+	if err != nil {
+		// ipc socket will typically not exist here because mpv has not yet started up, wait a moment and then try again
+		log.Printf("MPVPlayer.PlayFiles error: %v, waiting 1 second and then trying again...", err)
+		select {
+		case <-time.After(time.Second):
+		case <-m.stopped:
+			return errPlayerStopped
+		}
+		return m.PlayFiles(filepaths)
+	}
+
+	for i, filepath := range filepaths {
+		mode := "append"
+		if i == 0 {
+			mode = "replace"
+		}
+		err = m.loadFile(filepath, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendFiles adds files to the end of the playlist without interrupting the file that is playing
+func (m *MPVPlayer) AppendFiles(filepaths []string) error {
+	log.Printf("MPVPlayer.AppendFiles() - appending %v file(s) to playlist", len(filepaths))
+	for _, filepath := range filepaths {
+		err := m.loadFile(filepath, "append")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFile adds a file to the playlist, paths are query escaped for vlc so they are unescaped for mpv
+func (m *MPVPlayer) loadFile(filepath, mode string) error {
+	path, err := url.QueryUnescape(filepath)
+	if err != nil {
+		return err
+	}
+	_, err = m.send("loadfile", path, mode)
+	return err
+}
+
+func (m *MPVPlayer) Next() error {
+	_, err := m.send("playlist-next")
+	return err
+}
+
+func (m *MPVPlayer) Previous() error {
+	_, err := m.send("playlist-prev")
+	return err
+}
+
+func (m *MPVPlayer) Pause() error {
+	_, err := m.send("set_property", "pause", true)
+	return err
+}
+
+func (m *MPVPlayer) Resume() error {
+	_, err := m.send("set_property", "pause", false)
+	return err
+}
+
+func (m *MPVPlayer) Seek(seconds float64) error {
+	_, err := m.send("seek", seconds, "absolute")
+	return err
+}
+
+// PlayIndex plays the file at index of the playlist, mpv rejects indexes outside the playlist
+func (m *MPVPlayer) PlayIndex(index int) error {
+	var count int
+	err := m.getProperty("playlist-count", &count)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= count {
+		return ErrInvalidIndex
+	}
+	_, err = m.send("set_property", "playlist-pos", index)
+	return err
+}
+
+// RemoveIndex removes the file at index from the playlist, if it is playing mpv moves on to the next file
+func (m *MPVPlayer) RemoveIndex(index int) error {
+	var count int
+	err := m.getProperty("playlist-count", &count)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= count {
+		return ErrInvalidIndex
+	}
+	_, err = m.send("playlist-remove", index)
+	return err
+}
+
+// GetStatus returns the current file and playback progress of mpv, properties mpv has no value for are left at their zero value
+func (m *MPVPlayer) GetStatus() (*PlayerStatus, error) {
+	status := &PlayerStatus{PlaylistIndex: -1, State: PlayerStopped}
+	var volume float64
+	var paused bool
+	properties := []struct {
+		name string
+		out  interface{}
+	}{
+		{"filename", &status.File},
+		{"playlist-pos", &status.PlaylistIndex},
+		{"time-pos", &status.Position},
+		{"duration", &status.Duration},
+		{"volume", &volume},
+		{"pause", &paused},
+	}
+	for _, p := range properties {
+		err := m.getProperty(p.name, p.out)
+		if err == errMPVPropertyUnavailable {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status.Volume = int(volume)
+	if status.File != "" {
+		status.State = PlayerPlaying
+		if paused {
+			status.State = PlayerPaused
+		}
+	}
+	return status, nil
+}
+
+// getProperty decodes the value of an mpv property into out
+func (m *MPVPlayer) getProperty(name string, out interface{}) error {
+	data, err := m.send("get_property", name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// mpvRequest and mpvResponse are single lines of the mpv json ipc protocol
+type mpvRequest struct {
+	Command   []interface{} `json:"command"`
+	RequestID int           `json:"request_id"`
+}
+
+type mpvResponse struct {
+	Error     string          `json:"error"`
+	Data      json.RawMessage `json:"data"`
+	RequestID int             `json:"request_id"`
+	Event     string          `json:"event"`
+}
+
+// errMPVPropertyUnavailable is returned for properties without a value, such as the file name while idle
+var errMPVPropertyUnavailable = errors.New("MPVPlayer - property unavailable")
+
+// send runs a command over the ipc socket and returns the data of its response
+func (m *MPVPlayer) send(command ...interface{}) (json.RawMessage, error) {
+	m.lock.Lock()
+	m.requestID++
+	id := m.requestID
+	m.lock.Unlock()
+
+	conn, err := net.DialTimeout("unix", m.socket, mpvTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(mpvTimeout))
+
+	err = json.NewEncoder(conn).Encode(mpvRequest{Command: command, RequestID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	// mpv also writes events to every connection, skip lines until the response to this request
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var res mpvResponse
+		err = json.Unmarshal(scanner.Bytes(), &res)
+		if err != nil {
+			return nil, fmt.Errorf("MPVPlayer.send - invalid response %q: %v", scanner.Text(), err)
+		}
+		if res.Event != "" || res.RequestID != id {
+			continue
+		}
+		switch res.Error {
+		case "success":
+			return res.Data, nil
+		case "property unavailable":
+			return nil, errMPVPropertyUnavailable
+		}
+		return nil, fmt.Errorf("MPVPlayer.send - command %v failed: %s", command, res.Error)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("MPVPlayer.send - connection closed before response to %v", command)
+}
@@ -0,0 +1,75 @@
+package videoplayer
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMPVPlayer(t *testing.T) {
+	a := assert.New(t)
+	socket := filepath.Join(t.TempDir(), "mpv.sock")
+	server, err := NewMPVServerStub(socket)
+	a.NoError(err)
+	defer server.Close()
+
+	player := NewMPVPlayer(socket)
+
+	// idle player has no file name
+	status, err := player.GetStatus()
+	a.NoError(err)
+	a.Equal(&PlayerStatus{PlaylistIndex: -1, State: PlayerStopped, Volume: 100}, status)
+
+	// paths are escaped for vlc and unescaped before being sent to mpv
+	a.NoError(player.PlayFiles([]string{url.QueryEscape("media/starry night.mp4"), url.QueryEscape("media/s2.mp4")}))
+	a.Equal([]string{"media/starry night.mp4", "media/s2.mp4"}, server.Playlist())
+
+	a.NoError(player.AppendFiles([]string{url.QueryEscape("media/s3.png")}))
+	a.Equal([]string{"media/starry night.mp4", "media/s2.mp4", "media/s3.png"}, server.Playlist())
+
+	status, err = player.GetStatus()
+	a.NoError(err)
+	a.Equal(&PlayerStatus{File: "starry night.mp4", PlaylistIndex: 0, Position: 12.5, Duration: 60, State: PlayerPlaying, Volume: 100}, status)
+
+	// controls move through the playlist, wrapping around its ends
+	a.NoError(player.Previous())
+	status, err = player.GetStatus()
+	a.NoError(err)
+	a.Equal("s3.png", status.File)
+	a.Equal(2, status.PlaylistIndex)
+	a.NoError(player.Next())
+	a.NoError(player.Next())
+	status, err = player.GetStatus()
+	a.NoError(err)
+	a.Equal(1, status.PlaylistIndex)
+
+	a.NoError(player.PlayIndex(2))
+	a.NoError(player.Seek(30))
+	a.NoError(player.Pause())
+	status, err = player.GetStatus()
+	a.NoError(err)
+	a.Equal(&PlayerStatus{File: "s3.png", PlaylistIndex: 2, Position: 30, Duration: 60, State: PlayerPaused, Volume: 100}, status)
+	a.NoError(player.Resume())
+	status, err = player.GetStatus()
+	a.NoError(err)
+	a.Equal(PlayerPlaying, status.State)
+	a.Equal(ErrInvalidIndex, player.PlayIndex(3))
+
+	// removing a file before the playing one keeps the playing file
+	a.NoError(player.RemoveIndex(0))
+	a.Equal([]string{"media/s2.mp4", "media/s3.png"}, server.Playlist())
+	status, err = player.GetStatus()
+	a.NoError(err)
+	a.Equal("s3.png", status.File)
+	a.Equal(1, status.PlaylistIndex)
+	a.Equal(ErrInvalidIndex, player.RemoveIndex(2))
+
+	// replacing the playlist drops the old files
+	a.NoError(player.PlayFiles([]string{url.QueryEscape("moda-logo.png")}))
+	a.Equal([]string{"moda-logo.png"}, server.Playlist())
+
+	_, err = player.send("quit-watch-later")
+	a.Error(err)
+}
@@ -1,9 +1,15 @@
 package videoplayer
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"sync"
 )
 
@@ -11,15 +17,23 @@ type VideoPlayerStub struct {
 	PlayerInit              bool
 	ActivePlaylistFilepaths []string
 	PlayFilesWaitGroup      sync.WaitGroup
+	ActiveIndex             int // playlist index of the playing file
+	Paused                  bool
+	Position                float64 // seconds into the playing file, only changed by Seek
+	Duration                float64 // length reported for every file, 0 like an image
 }
 
-func (v *VideoPlayerStub) InitPlayer() {
+func (v *VideoPlayerStub) InitPlayer(ctx context.Context) error {
 	v.PlayerInit = true
+	return nil
 }
 
 func (v *VideoPlayerStub) PlayFiles(filepaths []string) error {
 	log.Printf("%+v", v.ActivePlaylistFilepaths)
 	v.ActivePlaylistFilepaths = filepaths
+	v.ActiveIndex = 0
+	v.Paused = false
+	v.Position = 0
 
 	if len(filepaths) == 1 && filepaths[0] == "moda-logo.png" {
 		return nil
@@ -28,23 +42,224 @@ func (v *VideoPlayerStub) PlayFiles(filepaths []string) error {
 	return nil
 }
 
-// return ffirst filename in list, need to decode query string because we encode when sending to vlc
-func (v *VideoPlayerStub) GetStatus() (*VLCStatus, error) {
+func (v *VideoPlayerStub) AppendFiles(filepaths []string) error {
+	v.ActivePlaylistFilepaths = append(v.ActivePlaylistFilepaths, filepaths...)
+	return nil
+}
+
+func (v *VideoPlayerStub) Next() error {
+	return v.PlayIndex((v.ActiveIndex + 1) % len(v.ActivePlaylistFilepaths))
+}
+
+func (v *VideoPlayerStub) Previous() error {
+	return v.PlayIndex((v.ActiveIndex + len(v.ActivePlaylistFilepaths) - 1) % len(v.ActivePlaylistFilepaths))
+}
+
+func (v *VideoPlayerStub) Pause() error {
+	v.Paused = true
+	return nil
+}
+
+func (v *VideoPlayerStub) Resume() error {
+	v.Paused = false
+	return nil
+}
+
+func (v *VideoPlayerStub) Seek(seconds float64) error {
+	v.Position = seconds
+	return nil
+}
+
+func (v *VideoPlayerStub) PlayIndex(index int) error {
+	if index < 0 || index >= len(v.ActivePlaylistFilepaths) {
+		return ErrInvalidIndex
+	}
+	v.ActiveIndex = index
+	v.Position = 0
+	return nil
+}
+
+// RemoveIndex removes the file at index, the file after it plays if it was playing and the playing file keeps its place otherwise
+func (v *VideoPlayerStub) RemoveIndex(index int) error {
+	if index < 0 || index >= len(v.ActivePlaylistFilepaths) {
+		return ErrInvalidIndex
+	}
+	filepaths := make([]string, 0, len(v.ActivePlaylistFilepaths)-1)
+	filepaths = append(filepaths, v.ActivePlaylistFilepaths[:index]...)
+	v.ActivePlaylistFilepaths = append(filepaths, v.ActivePlaylistFilepaths[index+1:]...)
+	if index < v.ActiveIndex {
+		v.ActiveIndex--
+	} else if index == v.ActiveIndex {
+		v.Position = 0
+	}
+	if v.ActiveIndex >= len(v.ActivePlaylistFilepaths) {
+		v.ActiveIndex = 0
+	}
+	return nil
+}
+
+// return active filename in list, need to decode query string because we encode when sending to vlc
+func (v *VideoPlayerStub) GetStatus() (*PlayerStatus, error) {
 	if len(v.ActivePlaylistFilepaths) > 0 {
-		unescape, err := url.QueryUnescape(v.ActivePlaylistFilepaths[0])
+		unescape, err := url.QueryUnescape(v.ActivePlaylistFilepaths[v.ActiveIndex])
 		if err != nil {
 			return nil, err
 		}
-		filename := filepath.Base(unescape)
-		return &VLCStatus{
-			Information: Information{
-				Category{
-					Meta{
-						Filename: filename,
-					},
-				},
-			},
+		state := PlayerPlaying
+		if v.Paused {
+			state = PlayerPaused
+		}
+		return &PlayerStatus{
+			File:          filepath.Base(unescape),
+			PlaylistIndex: v.ActiveIndex,
+			Position:      v.Position,
+			Duration:      v.Duration,
+			State:         state,
+			Volume:        100,
 		}, nil
 	}
-	return nil, nil
+	return &PlayerStatus{PlaylistIndex: -1, State: PlayerStopped}, nil
+}
+
+// MPVServerStub is a fake mpv json ipc server for tests, it keeps a playlist and answers the commands MPVPlayer sends
+// files are 60 seconds long, the player starts 12.5 seconds into the first file
+type MPVServerStub struct {
+	listener net.Listener
+	lock     sync.Mutex
+	playlist []string
+	pos      int     // playlist index of the playing file
+	timePos  float64 // seconds into the playing file
+	paused   bool
+}
+
+// NewMPVServerStub listens on the unix socket at path
+func NewMPVServerStub(path string) (*MPVServerStub, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &MPVServerStub{listener: listener, timePos: 12.5}
+	go s.serve()
+	return s, nil
+}
+
+func (s *MPVServerStub) Close() error {
+	return s.listener.Close()
+}
+
+// Playlist returns the files loaded into the fake player
+func (s *MPVServerStub) Playlist() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.playlist...)
+}
+
+func (s *MPVServerStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *MPVServerStub) handle(conn net.Conn) {
+	defer conn.Close()
+	enc := json.NewEncoder(conn)
+	// mpv sends events to every client, the player has to skip them
+	enc.Encode(map[string]string{"event": "idle"})
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req mpvRequest
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil {
+			enc.Encode(mpvResponse{Error: "invalid json"})
+			continue
+		}
+		data, errStr := s.run(req.Command)
+		res := map[string]interface{}{"error": errStr, "request_id": req.RequestID}
+		if data != nil {
+			res["data"] = data
+		}
+		enc.Encode(res)
+	}
+}
+
+func (s *MPVServerStub) run(command []interface{}) (interface{}, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	args := make([]string, 0, len(command))
+	for _, arg := range command {
+		args = append(args, fmt.Sprint(arg))
+	}
+	switch {
+	case len(args) == 1 && args[0] == "playlist-clear":
+		s.playlist = nil
+		s.pos = 0
+	case len(args) == 3 && args[0] == "loadfile" && args[2] == "replace":
+		s.playlist = []string{args[1]}
+		s.pos = 0
+	case len(args) == 3 && args[0] == "loadfile" && args[2] == "append":
+		s.playlist = append(s.playlist, args[1])
+	case len(args) == 2 && args[0] == "playlist-remove":
+		index, err := strconv.Atoi(args[1])
+		if err != nil || index < 0 || index >= len(s.playlist) {
+			return nil, "error running command"
+		}
+		s.playlist = append(s.playlist[:index:index], s.playlist[index+1:]...)
+		if index < s.pos {
+			s.pos--
+		} else if index == s.pos {
+			s.timePos = 0
+		}
+		if s.pos >= len(s.playlist) {
+			s.pos = 0
+		}
+	case len(args) == 1 && (args[0] == "playlist-next" || args[0] == "playlist-prev") && len(s.playlist) > 0:
+		step := 1
+		if args[0] == "playlist-prev" {
+			step = len(s.playlist) - 1
+		}
+		s.pos = (s.pos + step) % len(s.playlist) // playlist loops
+		s.timePos = 0
+	case len(args) == 3 && args[0] == "set_property" && args[1] == "pause":
+		s.paused = args[2] == "true"
+	case len(args) == 3 && args[0] == "set_property" && args[1] == "playlist-pos":
+		pos, err := strconv.Atoi(args[2])
+		if err != nil || pos < 0 || pos >= len(s.playlist) {
+			return nil, "error running command"
+		}
+		s.pos = pos
+		s.timePos = 0
+	case len(args) == 3 && args[0] == "seek" && args[2] == "absolute" && len(s.playlist) > 0:
+		seconds, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return nil, "invalid parameter"
+		}
+		s.timePos = seconds
+	case len(args) == 2 && args[0] == "get_property" && args[1] == "playlist-count":
+		return len(s.playlist), "success"
+	case len(args) == 2 && args[0] == "get_property" && args[1] == "playlist-pos":
+		if len(s.playlist) == 0 {
+			return -1, "success"
+		}
+		return s.pos, "success"
+	case len(args) == 2 && args[0] == "get_property" && args[1] == "volume":
+		return 100.0, "success"
+	case len(args) == 2 && args[0] == "get_property" && args[1] == "pause":
+		return s.paused, "success"
+	case len(args) == 2 && args[0] == "get_property" && len(s.playlist) == 0:
+		return nil, "property unavailable" // idle mpv has no current file
+	case len(args) == 2 && args[0] == "get_property" && args[1] == "filename":
+		return filepath.Base(s.playlist[s.pos]), "success"
+	case len(args) == 2 && args[0] == "get_property" && args[1] == "time-pos":
+		return s.timePos, "success"
+	case len(args) == 2 && args[0] == "get_property" && args[1] == "duration":
+		return 60.0, "success"
+	default:
+		return nil, "invalid parameter"
+	}
+	return nil, "success"
 }
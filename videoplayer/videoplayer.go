@@ -0,0 +1,51 @@
+package videoplayer
+
+import (
+	"context"
+	"errors"
+)
+
+// errPlayerStopped is returned by commands sent after the player process has exited
+var errPlayerStopped = errors.New("video player is not running")
+
+// ErrInvalidIndex is returned by PlayIndex and RemoveIndex for an index outside the playlist
+var ErrInvalidIndex = errors.New("playlist index out of range")
+
+// VideoPlayer plays playlists of local media files
+// file paths are query escaped, backends that take plain paths unescape them
+type VideoPlayer interface {
+	InitPlayer(ctx context.Context) error
+	PlayFiles(filepaths []string) error
+	AppendFiles(filepaths []string) error
+	GetStatus() (*PlayerStatus, error)
+
+	// playback controls, Next and Previous wrap around the ends of the playlist
+	Next() error
+	Previous() error
+	Pause() error
+	Resume() error
+	Seek(seconds float64) error // seeks to an absolute position in the current file
+	PlayIndex(index int) error  // plays the file at index of the playlist, counted from 0
+
+	// RemoveIndex removes the file at index from the playlist, the player moves on to the next file if it was playing
+	RemoveIndex(index int) error
+}
+
+// PlayerState is whether a video player is playing, paused or stopped
+type PlayerState string
+
+const (
+	PlayerPlaying = PlayerState("playing")
+	PlayerPaused  = PlayerState("paused")
+	PlayerStopped = PlayerState("stopped")
+)
+
+// PlayerStatus describes what a video player is doing, independent of the backend
+type PlayerStatus struct {
+	File          string      `json:"file"`           // base name of the current file, empty if there is none
+	PlaylistIndex int         `json:"playlist_index"` // position of the current file in the playlist, -1 if unknown
+	Position      float64     `json:"position"`       // seconds played of the current file
+	Duration      float64     `json:"duration"`       // length of the current file in seconds, 0 for images and unknown lengths
+	State         PlayerState `json:"state"`
+	Volume        int         `json:"volume"` // percent of normal volume
+}
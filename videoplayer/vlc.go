@@ -1,47 +1,80 @@
 package videoplayer
 
 import (
+	"context"
 	"encoding/json"
-	"io"
+	"fmt"
+	"jkurtz678/moda-viewer/process"
 	"log"
+	"net"
 	"net/http"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
 	vlcctrl "github.com/CedArctic/go-vlc-ctrl"
 )
 
-type VideoPlayer interface {
-	InitPlayer()
-	PlayFiles(filepaths []string) error
-	GetStatus() (*VLCStatus, error)
-}
-
 type VLCPlayer struct {
-	VLC    vlcctrl.VLC
-	Client *http.Client
+	VLC        vlcctrl.VLC
+	Client     *http.Client
+	host       string              // host of the vlc http interface
+	port       int                 // port of the vlc http interface
+	password   string              // password of the vlc http interface
+	supervisor *process.Supervisor // restarts vlc if it exits
+	stopped    chan struct{}       // closed when InitPlayer returns
+	stopOnce   sync.Once
 }
 
-func NewVLCPlayer() *VLCPlayer {
-	vlc, err := vlcctrl.NewVLC("127.0.0.1", 9090, "m0da")
+func NewVLCPlayer(host string, port int, password string) *VLCPlayer {
+	vlc, err := vlcctrl.NewVLC(host, port, password)
 	// for some reason vlcctrl returns an error that will never fail here, so its safe to log.Fatal
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &VLCPlayer{VLC: vlc, Client: &http.Client{Timeout: 5 * time.Second}}
+	v := &VLCPlayer{
+		VLC:      vlc,
+		Client:   &http.Client{Timeout: 5 * time.Second},
+		host:     host,
+		port:     port,
+		password: password,
+		stopped:  make(chan struct{}),
+	}
+	v.supervisor = process.NewSupervisor("vlc", v.command)
+	return v
 }
 
-func (v *VLCPlayer) InitPlayer() {
+// InitPlayer runs vlc, restarting it whenever it exits, until ctx is done and vlc has been stopped
+func (v *VLCPlayer) InitPlayer(ctx context.Context) error {
+	defer v.stopOnce.Do(func() { close(v.stopped) })
 	log.Println("VLCPlayer.InitPlayer() - running player")
 	log.Printf("runtime.GOOS %s", runtime.GOOS)
-	var cmd *exec.Cmd
+	return v.supervisor.Run(ctx)
+}
+
+// ProcessStatus returns restart count and last exit reason of the vlc process
+func (v *VLCPlayer) ProcessStatus() process.Status {
+	return v.supervisor.Status()
+}
+
+// command returns the command which starts vlc with its http interface enabled
+// images are shown until the viewer moves on to the next file
+func (v *VLCPlayer) command() *exec.Cmd {
+	args := []string{
+		"--loop",
+		"--extraintf=http",
+		fmt.Sprintf("--http-host=%s", v.host),
+		fmt.Sprintf("--http-port=%v", v.port),
+		fmt.Sprintf("--http-password=%s", v.password),
+		"--no-video-title",
+		"--image-duration=-1",
+	}
 	if runtime.GOOS == "windows" {
-		cmd = exec.Command("vlc", "--loop", "--extraintf=http", "--http-port=9090", "--http-password=m0da", "--no-video-title", "--no-qt-fs-controller")
-	} else {
-		cmd = exec.Command("vlc", "--loop", "--extraintf=http", "--http-port=9090", "--http-password=m0da", "--no-video-title")
+		args = append(args, "--no-qt-fs-controller")
 	}
-	log.Fatalf("VLCPlayer.InitPlayer() - error %v", cmd.Run())
+	return exec.Command("vlc", args...)
 }
 
 func (v *VLCPlayer) PlayFiles(filepaths []string) error {
@@ -50,7 +83,11 @@ func (v *VLCPlayer) PlayFiles(filepaths []string) error {
 	if err != nil {
 		// empty playlist will typically fail here because the VLC instance has not yet started up, wait a moment and then try again
 		log.Printf("VLCPlayer.PlayFiles error: %v, waiting 1 second and then trying again...", err)
-		time.Sleep(time.Second)
+		select {
+		case <-time.After(time.Second):
+		case <-v.stopped:
+			return errPlayerStopped
+		}
 		return v.PlayFiles(filepaths)
 	}
 
@@ -63,48 +100,163 @@ func (v *VLCPlayer) PlayFiles(filepaths []string) error {
 	return v.VLC.Play(1)
 }
 
-type VLCStatus struct {
-	Information Information `json:"information"`
+// AppendFiles adds files to the end of the playlist without interrupting the file that is playing
+func (v *VLCPlayer) AppendFiles(filepaths []string) error {
+	log.Printf("VLCPlayer.AppendFiles() - appending %v file(s) to playlist", len(filepaths))
+	for _, filepath := range filepaths {
+		err := v.VLC.Add(filepath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type Information struct {
-	Category Category `json:"category"`
+func (v *VLCPlayer) Next() error {
+	return v.VLC.Next()
 }
-type Category struct {
-	Meta Meta `json:"meta"`
+
+func (v *VLCPlayer) Previous() error {
+	return v.VLC.Previous()
 }
 
-type Meta struct {
-	Filename string `json:"filename"`
+// Pause pauses playback, does nothing if already paused
+func (v *VLCPlayer) Pause() error {
+	return v.VLC.ForcePause()
 }
 
-// GetStatus returns status of vlc instance, such as actively playing file
-func (v *VLCPlayer) GetStatus() (*VLCStatus, error) {
-	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:9090/requests/status.json", http.NoBody)
+// Resume resumes playback, does nothing if already playing
+func (v *VLCPlayer) Resume() error {
+	return v.VLC.Resume()
+}
+
+// Seek jumps to seconds into the current file, vlc only seeks to whole seconds
+func (v *VLCPlayer) Seek(seconds float64) error {
+	return v.VLC.Seek(strconv.Itoa(int(seconds)))
+}
+
+// PlayIndex plays the file at index of the playlist
+func (v *VLCPlayer) PlayIndex(index int) error {
+	id, err := v.playlistItemID(index)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return v.VLC.Play(id)
+}
 
-	req.SetBasicAuth("", "m0da")
+// RemoveIndex removes the file at index from the playlist, if it is playing vlc moves on to the next file
+func (v *VLCPlayer) RemoveIndex(index int) error {
+	id, err := v.playlistItemID(index)
+	if err != nil {
+		return err
+	}
+	return v.VLC.Delete(id)
+}
 
-	client := http.Client{Timeout: 5 * time.Second}
-	res, err := client.Do(req)
+// playlistItemID returns the id of the playlist item at index, vlc addresses playlist items by id rather than position
+func (v *VLCPlayer) playlistItemID(index int) (int, error) {
+	var playlist vlcctrl.Node
+	err := v.request("/requests/playlist.json", &playlist)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer res.Body.Close()
+	if len(playlist.Children) == 0 || index < 0 || index >= len(playlist.Children[0].Children) {
+		return 0, ErrInvalidIndex
+	}
+	id, err := strconv.Atoi(playlist.Children[0].Children[index].ID)
+	if err != nil {
+		return 0, fmt.Errorf("VLCPlayer.playlistItemID - invalid playlist item id %s", err)
+	}
+	return id, nil
+}
+
+// vlcStatus is the part of the vlc status.json response mapped into PlayerStatus
+type vlcStatus struct {
+	State       string  `json:"state"`
+	Time        float64 `json:"time"`
+	Length      float64 `json:"length"`
+	Position    float64 `json:"position"` // fraction of length played
+	Volume      int     `json:"volume"`   // 256 is normal volume
+	CurrentPlID int     `json:"currentplid"`
+	Information struct {
+		Category struct {
+			Meta struct {
+				Filename string `json:"filename"`
+			} `json:"meta"`
+		} `json:"category"`
+	} `json:"information"`
+}
+
+// vlcNormalVolume is the vlc volume of 100%
+const vlcNormalVolume = 256
 
-	resBody, err := io.ReadAll(res.Body)
+// GetStatus returns status of vlc instance, such as actively playing file
+func (v *VLCPlayer) GetStatus() (*PlayerStatus, error) {
+	var status vlcStatus
+	err := v.request("/requests/status.json", &status)
 	if err != nil {
 		return nil, err
 	}
 
-	var vlcStatus VLCStatus
-	err = json.Unmarshal(resBody, &vlcStatus)
+	playerStatus := &PlayerStatus{
+		File:          status.Information.Category.Meta.Filename,
+		PlaylistIndex: -1,
+		Position:      status.Time,
+		Duration:      status.Length,
+		State:         PlayerStopped,
+		Volume:        status.Volume * 100 / vlcNormalVolume,
+	}
+	// position is more precise than time, which vlc rounds to seconds
+	if status.Length > 0 && status.Position > 0 {
+		playerStatus.Position = status.Position * status.Length
+	}
+	switch status.State {
+	case "playing":
+		playerStatus.State = PlayerPlaying
+	case "paused":
+		playerStatus.State = PlayerPaused
+	}
+
+	if status.CurrentPlID >= 0 && playerStatus.File != "" {
+		var playlist vlcctrl.Node
+		err = v.request("/requests/playlist.json", &playlist)
+		if err != nil {
+			return nil, err
+		}
+		playerStatus.PlaylistIndex = playlistIndex(playlist, strconv.Itoa(status.CurrentPlID))
+	}
+	return playerStatus, nil
+}
+
+// playlistIndex returns the position of the item with id among the items of the first playlist under root, -1 if not found
+func playlistIndex(root vlcctrl.Node, id string) int {
+	if len(root.Children) == 0 {
+		return -1
+	}
+	for i, item := range root.Children[0].Children {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// request gets a json document from the vlc http interface and decodes it into out
+func (v *VLCPlayer) request(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", net.JoinHostPort(v.host, strconv.Itoa(v.port)), path), http.NoBody)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	req.SetBasicAuth("", v.password)
 
-	return &vlcStatus, nil
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("VLCPlayer.request - unexpected status %s for %s", res.Status, path)
+	}
 
+	return json.NewDecoder(res.Body).Decode(out)
 }
@@ -0,0 +1,69 @@
+package videoplayer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVLCPlayer(t *testing.T) {
+	a := assert.New(t)
+	commands := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, password, _ := r.BasicAuth()
+		if password != "m0da" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/requests/status.json":
+			if r.URL.RawQuery != "" {
+				commands <- r.URL.RawQuery
+			}
+			w.Write([]byte(`{"state": "paused", "time": 12, "length": 60, "position": 0.21, "volume": 128, "currentplid": 5,
+				"information": {"category": {"meta": {"filename": "s2.mp4"}}}}`))
+		case "/requests/playlist.json":
+			w.Write([]byte(`{"type": "node", "id": "1", "children": [
+				{"type": "node", "name": "Playlist", "id": "2", "children": [
+					{"type": "leaf", "id": "4", "uri": "file:///media/s1.mp4"},
+					{"type": "leaf", "id": "5", "uri": "file:///media/s2.mp4", "current": "current"}
+				]},
+				{"type": "node", "name": "Media Library", "id": "3"}
+			]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	a.NoError(err)
+	portNum, err := strconv.Atoi(port)
+	a.NoError(err)
+
+	status, err := NewVLCPlayer(host, portNum, "m0da").GetStatus()
+	a.NoError(err)
+	a.Equal("s2.mp4", status.File)
+	a.Equal(1, status.PlaylistIndex)
+	a.InDelta(12.6, status.Position, 0.001)
+	a.Equal(60.0, status.Duration)
+	a.Equal(PlayerPaused, status.State)
+	a.Equal(50, status.Volume)
+
+	_, err = NewVLCPlayer(host, portNum, "wrong").GetStatus()
+	a.Error(err)
+
+	// vlc plays playlist items by id
+	a.NoError(NewVLCPlayer(host, portNum, "m0da").PlayIndex(0))
+	a.Equal("command=pl_play&id=4", <-commands)
+	a.Equal(ErrInvalidIndex, NewVLCPlayer(host, portNum, "m0da").PlayIndex(2))
+	a.NoError(NewVLCPlayer(host, portNum, "m0da").RemoveIndex(1))
+	a.Equal("command=pl_delete&id=5", <-commands)
+	a.Equal(ErrInvalidIndex, NewVLCPlayer(host, portNum, "m0da").RemoveIndex(-1))
+	a.NoError(NewVLCPlayer(host, portNum, "m0da").Seek(30.7))
+	a.Equal("command=seek&val=30", <-commands)
+}
@@ -0,0 +1,145 @@
+package viewer
+
+import (
+	"errors"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/storage"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoCache is returned by CacheUsage when the viewer has no media cache configured
+var ErrNoCache = errors.New("no media cache is configured")
+
+// CacheUsage returns the disk used by media files, and which are pinned by the plaque
+func (v *Viewer) CacheUsage() (*storage.CacheUsage, error) {
+	if v.Cache == nil {
+		return nil, ErrNoCache
+	}
+	return v.Cache.Usage()
+}
+
+// plaqueTokenMetaIDs returns every token meta id the plaque can display, in its token list and each schedule window
+func plaqueTokenMetaIDs(plaque *fstore.Plaque) []string {
+	ids := make([]string, 0, len(plaque.TokenMetaIDList))
+	seen := make(map[string]bool)
+	add := func(list []string) {
+		for _, id := range list {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	add(plaque.TokenMetaIDList)
+	if plaque.Schedule != nil {
+		for _, window := range plaque.Schedule.Windows {
+			add(window.TokenMetaIDList)
+		}
+	}
+	return ids
+}
+
+// updateCache pins the media of every token the plaque can display or has staged and removes token metas the plaque no longer references
+// media is only evicted once the new tokens are playing, the playing tokens are kept until then
+func (v *Viewer) updateCache(plaque *fstore.FirestorePlaque) {
+	if v.Cache == nil {
+		return
+	}
+	ids := v.pinMedia(plaque)
+	keep := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+
+	removed, err := v.removeOrphanedMetadata(keep)
+	if len(removed) > 0 {
+		logger.Printf("updateCache - removed %v token metas no longer on the plaque: %v", len(removed), removed)
+	}
+	if err != nil {
+		logger.Printf("updateCache - failed to remove orphaned token metas: %v", err)
+	}
+}
+
+// pinMedia pins the media of the playlist and of every token the plaque can display or has staged, returning the token meta ids of the plaque
+// media of tokens without a local token meta is not pinned, it has not been downloaded yet, so pins are refreshed once token metas are loaded
+// the playlist stays pinned while a reload downloads the new tokens, as the player keeps playing it until they replace it
+func (v *Viewer) pinMedia(plaque *fstore.FirestorePlaque) []string {
+	_, staged := v.stagedTokenMetaIDs(plaque)
+	ids := append(plaqueTokenMetaIDs(&plaque.Plaque), staged...)
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if meta, err := v.tokenMeta(id); err == nil {
+			names = append(names, v.mediaFileNames(meta)...)
+		}
+	}
+	for _, meta := range v.currentPlaylist() {
+		names = append(names, v.mediaFileNames(meta)...)
+	}
+	v.Cache.Pin(names)
+	return ids
+}
+
+// evictMedia removes least recently used media over the cache quota
+func (v *Viewer) evictMedia() {
+	if v.Cache == nil {
+		return
+	}
+	removed, err := v.Cache.Evict()
+	if len(removed) > 0 {
+		logger.Printf("evictMedia - evicted %v media files over the cache quota: %v", len(removed), removed)
+	}
+	if err != nil {
+		logger.Printf("evictMedia - failed to evict media: %v", err)
+	}
+}
+
+// touchMedia records that the media of metas was used, so it is evicted after media that has not been played for longer
+func (v *Viewer) touchMedia(metas []*fstore.FirestoreTokenMeta) {
+	if v.Cache == nil {
+		return
+	}
+	names := make([]string, 0, len(metas))
+	for _, meta := range metas {
+		names = append(names, v.mediaFileNames(meta)...)
+	}
+	err := v.Cache.Touch(names...)
+	if err != nil {
+		logger.Printf("touchMedia - failed to record media access: %v", err)
+	}
+}
+
+// removeOrphanedMetadata removes the token meta files and in-memory token metas whose document id is not in keep
+// only files holding a token meta with the document id of their name are removed, other json files in the dir are left alone
+func (v *Viewer) removeOrphanedMetadata(keep map[string]bool) ([]string, error) {
+	files, err := ioutil.ReadDir(v.MetadataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+	removed := make([]string, 0)
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ".json")
+		if f.IsDir() || id == f.Name() || keep[id] {
+			continue
+		}
+		meta, err := v.ReadMetadata(id)
+		if err != nil || meta.DocumentID != id {
+			continue
+		}
+		err = os.Remove(filepath.Join(v.MetadataDir, f.Name()))
+		if err != nil {
+			return removed, err
+		}
+		delete(v.tokenMetas, id)
+		removed = append(removed, id)
+	}
+	return removed, nil
+}
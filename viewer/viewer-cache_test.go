@@ -0,0 +1,164 @@
+package viewer
+
+import (
+	"context"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/storage"
+	"jkurtz678/moda-viewer/videoplayer"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	v.MediaDir = filepath.Join(tmpdir, "media")
+	v.MetadataDir = filepath.Join(tmpdir, "metadata")
+	a.NoError(os.Mkdir(v.MediaDir, 0755))
+	a.NoError(os.Mkdir(v.MetadataDir, 0755))
+	v.MediaClient = &storage.FirebaseStorageClientStub{MediaDir: v.MediaDir}
+	v.Cache = storage.NewCacheManager(v.MediaDir, 60)
+
+	// media of an earlier plaque, and a token only shown in a schedule window that is already downloaded
+	old := filepath.Join(v.MediaDir, "old.mp4")
+	a.NoError(ioutil.WriteFile(old, make([]byte, 50), 0644))
+	a.NoError(os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	a.NoError(ioutil.WriteFile(filepath.Join(v.MediaDir, "s2.mp4"), make([]byte, 20), 0644))
+	metas := testMetas("1", "2")
+	for _, meta := range append(metas, &fstore.FirestoreTokenMeta{DocumentID: "old", TokenMeta: fstore.TokenMeta{MediaID: "old", MediaType: ".mp4"}}) {
+		a.NoError(v.setTokenMeta(meta))
+	}
+	a.NoError(ioutil.WriteFile(filepath.Join(v.MetadataDir, "notes.json"), []byte(`{}`), 0644))
+
+	plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{
+		WalletAddress:   "test",
+		TokenMetaIDList: []string{"m1"},
+		Schedule:        &fstore.Schedule{Windows: []fstore.ScheduleWindow{{Start: "00:00", End: "00:00", Weekdays: []int{7}, TokenMetaIDList: []string{"m2"}}}},
+	}}
+	a.NoError(v.setPlaque(plaque))
+	a.Equal([]string{"m1", "m2"}, plaqueTokenMetaIDs(&plaque.Plaque))
+
+	v.VideoPlayer.(*videoplayer.VideoPlayerStub).PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(context.Background(), plaque))
+
+	// media and token metas of the earlier plaque are removed, the schedule window media is kept
+	a.NoFileExists(old)
+	a.NoFileExists(v.metadataPath("old"))
+	a.FileExists(v.metadataPath("m2"))
+	a.FileExists(filepath.Join(v.MetadataDir, "notes.json"))
+	_, err := v.tokenMeta("old")
+	a.Error(err)
+
+	usage, err := v.CacheUsage()
+	a.NoError(err)
+	a.Equal(int64(20), usage.Used)
+	a.Equal(int64(20), usage.Pinned)
+	// playing media counts as a use, so it is evicted after media that has not played
+	a.Equal([]string{"s1.mp4", "s2.mp4"}, []string{usage.Files[0].Name, usage.Files[1].Name})
+
+	v.Cache = nil
+	_, err = v.CacheUsage()
+	a.Equal(ErrNoCache, err)
+}
+
+// sizedMediaClient downloads media files of size bytes, calling downloading first if set
+type sizedMediaClient struct {
+	storage.FirebaseStorageClientStub
+	size        int
+	downloading func(fileURI string)
+}
+
+func (c *sizedMediaClient) DownloadFileFromArchive(ctx context.Context, fileURI string, checksum storage.Checksum) error {
+	if c.downloading != nil {
+		c.downloading(fileURI)
+	}
+	return ioutil.WriteFile(filepath.Join(c.MediaDir, fileURI), make([]byte, c.size), 0644)
+}
+
+func TestCacheNewMedia(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	v.MediaDir = filepath.Join(tmpdir, "media")
+	a.NoError(os.Mkdir(v.MediaDir, 0755))
+	client, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	v.DBClient = client
+	v.MediaClient = &sizedMediaClient{FirebaseStorageClientStub: storage.FirebaseStorageClientStub{MediaDir: v.MediaDir}, size: 20}
+	v.Cache = storage.NewCacheManager(v.MediaDir, 30)
+
+	old := filepath.Join(v.MediaDir, "old.mp4")
+	a.NoError(ioutil.WriteFile(old, make([]byte, 10), 0644))
+	ids := make([]string, 0)
+	for _, name := range []string{"1", "2"} {
+		meta, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "token " + name, MediaID: "s" + name, MediaType: ".mp4"})
+		a.NoError(err)
+		ids = append(ids, meta.DocumentID)
+	}
+
+	// the token metas are only local once loaded, the media they push over the quota is still pinned
+	plaque, err := client.CreatePlaque(ctx, &fstore.Plaque{WalletAddress: "test", TokenMetaIDList: ids})
+	a.NoError(err)
+	a.NoError(v.setPlaque(plaque))
+	v.VideoPlayer.(*videoplayer.VideoPlayerStub).PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(ctx, plaque))
+
+	a.NoFileExists(old)
+	a.FileExists(filepath.Join(v.MediaDir, "s1.mp4"))
+	a.FileExists(filepath.Join(v.MediaDir, "s2.mp4"))
+	usage, err := v.CacheUsage()
+	a.NoError(err)
+	a.Equal(int64(40), usage.Pinned)
+	a.True(usage.OverQuota)
+}
+
+func TestCacheReload(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	v.MediaDir = filepath.Join(tmpdir, "media")
+	a.NoError(os.Mkdir(v.MediaDir, 0755))
+	client, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	v.DBClient = client
+	media := &sizedMediaClient{FirebaseStorageClientStub: storage.FirebaseStorageClientStub{MediaDir: v.MediaDir}, size: 20}
+	v.MediaClient = media
+	v.Cache = storage.NewCacheManager(v.MediaDir, 10)
+
+	ids := make([]string, 0)
+	for _, name := range []string{"1", "2"} {
+		meta, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "token " + name, MediaID: "s" + name, MediaType: ".mp4"})
+		a.NoError(err)
+		ids = append(ids, meta.DocumentID)
+	}
+	plaque, err := client.CreatePlaque(ctx, &fstore.Plaque{WalletAddress: "test", TokenMetaIDList: ids[:1]})
+	a.NoError(err)
+	a.NoError(v.setPlaque(plaque))
+	v.VideoPlayer.(*videoplayer.VideoPlayerStub).PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(ctx, plaque))
+	played := filepath.Join(v.MediaDir, "s1.mp4")
+	a.FileExists(played)
+
+	// the plaque drops the playing token, its media is kept until the new token replaces it
+	kept := false
+	media.downloading = func(fileURI string) {
+		exists, err := storage.FileExists(played)
+		kept = err == nil && exists
+	}
+	changed := *plaque
+	changed.Plaque.TokenMetaIDList = ids[1:]
+	a.NoError(v.setPlaque(&changed))
+	v.VideoPlayer.(*videoplayer.VideoPlayerStub).PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(ctx, &changed))
+	a.True(kept, "playing media was evicted before the new token replaced it")
+	a.NoFileExists(played)
+	a.FileExists(filepath.Join(v.MediaDir, "s2.mp4"))
+}
@@ -0,0 +1,58 @@
+package viewer
+
+import (
+	"errors"
+)
+
+// ErrTokenNotInPlaylist is returned by PlayToken for tokens which are not assigned to the plaque or whose media is not ready
+var ErrTokenNotInPlaylist = errors.New("token is not in the playlist")
+
+// playback controls wrap the video player so subscribers see the new state without waiting for the next poll
+
+// Next plays the next token in the plaque play order
+func (v *Viewer) Next() error {
+	return v.jump(func() error {
+		return v.control(func() error {
+			status, err := v.VideoPlayer.GetStatus()
+			if err != nil {
+				return err
+			}
+			return v.playNext(v.currentPlaylist(), status.PlaylistIndex)
+		})
+	})
+}
+
+// Previous plays the token before the current one in the playlist, whatever the play order
+func (v *Viewer) Previous() error {
+	return v.jump(func() error { return v.control(v.VideoPlayer.Previous) })
+}
+
+func (v *Viewer) Pause() error {
+	return v.control(v.VideoPlayer.Pause)
+}
+
+func (v *Viewer) Resume() error {
+	return v.control(v.VideoPlayer.Resume)
+}
+
+func (v *Viewer) Seek(seconds float64) error {
+	return v.control(func() error { return v.VideoPlayer.Seek(seconds) })
+}
+
+// PlayToken jumps to the media of the token meta with the given document id
+func (v *Viewer) PlayToken(tokenMetaID string) error {
+	index := playlistIndex(v.currentPlaylist(), tokenMetaID)
+	if index < 0 {
+		return ErrTokenNotInPlaylist
+	}
+	return v.jump(func() error { return v.control(func() error { return v.VideoPlayer.PlayIndex(index) }) })
+}
+
+func (v *Viewer) control(command func() error) error {
+	err := command()
+	if err != nil {
+		return err
+	}
+	v.notifyStateChange()
+	return nil
+}
@@ -0,0 +1,56 @@
+package viewer
+
+import (
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/videoplayer"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlaybackControl(t *testing.T) {
+	a := assert.New(t)
+	v := NewTestViewer(t.TempDir())
+	player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+
+	a.NoError(v.setPlaque(&fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: []string{"m1", "m2", "m3"}}}))
+	metas := []*fstore.FirestoreTokenMeta{
+		{DocumentID: "m1", TokenMeta: fstore.TokenMeta{Name: "starry night", MediaID: "s1", MediaType: ".mp4"}},
+		{DocumentID: "m2", TokenMeta: fstore.TokenMeta{Name: "irises", MediaID: "s2", MediaType: ".mp4"}},
+		{DocumentID: "m3", TokenMeta: fstore.TokenMeta{Name: "wheatfield", MediaID: "s3", MediaType: ".mp4"}},
+	}
+	for _, meta := range metas {
+		a.NoError(v.setTokenMeta(meta))
+	}
+	player.PlayFilesWaitGroup.Add(1)
+	a.NoError(player.PlayFiles(v.mediaFilepaths(metas[:2])))
+	v.setPlaylist(metas[:2])
+
+	activeID := func() string {
+		state := v.GetViewerState()
+		a.Equal(ViewerStateDisplay, state.State)
+		return state.ActiveTokenMeta.DocumentID
+	}
+
+	a.NoError(v.Next())
+	a.Equal("m2", activeID())
+	a.NoError(v.Next())
+	a.Equal("m1", activeID())
+	a.NoError(v.Previous())
+	a.Equal("m2", activeID())
+
+	a.NoError(v.PlayToken("m1"))
+	a.Equal("m1", activeID())
+
+	// m3 is assigned to the plaque but its media is not in the playlist
+	a.Equal(ErrTokenNotInPlaylist, v.PlayToken("m3"))
+	a.Equal(ErrTokenNotInPlaylist, v.PlayToken("unknown"))
+	a.Equal("m1", activeID())
+
+	a.NoError(v.Seek(42))
+	a.NoError(v.Pause())
+	state := v.GetViewerState()
+	a.Equal(&PlaybackData{State: videoplayer.PlayerPaused, Position: 42}, state.Playback)
+	a.NoError(v.Resume())
+	a.Equal(videoplayer.PlayerPlaying, v.GetViewerState().Playback.State)
+}
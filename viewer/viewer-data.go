@@ -0,0 +1,115 @@
+package viewer
+
+import (
+	"encoding/json"
+	"fmt"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/storage"
+	"path/filepath"
+)
+
+// in-memory plaque, token metas and playlist are the authoritative viewer state, PlaqueFile and MetadataDir mirror them on disk
+// values held in memory are never modified in place, changes always replace the stored pointer
+
+// currentPlaque returns the in-memory plaque, loading it from the local plaque file on first use
+func (v *Viewer) currentPlaque() (*fstore.FirestorePlaque, error) {
+	v.dataLock.RLock()
+	plaque := v.plaque
+	v.dataLock.RUnlock()
+	if plaque != nil {
+		return plaque, nil
+	}
+
+	plaque, err := v.ReadLocalPlaqueFile()
+	if err != nil {
+		return nil, err
+	}
+
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+	if v.plaque == nil {
+		v.plaque = plaque
+	}
+	return v.plaque, nil
+}
+
+// setPlaque writes plaque to the local plaque file and replaces the in-memory plaque
+func (v *Viewer) setPlaque(plaque *fstore.FirestorePlaque) error {
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+
+	err := writeJSONAtomic(v.PlaqueFile, plaque)
+	if err != nil {
+		return err
+	}
+	v.plaque = plaque
+	return nil
+}
+
+// tokenMeta returns the in-memory token meta for the document id, loading it from the metadata dir on first use
+func (v *Viewer) tokenMeta(documentID string) (*fstore.FirestoreTokenMeta, error) {
+	v.dataLock.RLock()
+	meta, ok := v.tokenMetas[documentID]
+	v.dataLock.RUnlock()
+	if ok {
+		return meta, nil
+	}
+
+	meta, err := v.ReadMetadata(documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+	if v.tokenMetas == nil {
+		v.tokenMetas = make(map[string]*fstore.FirestoreTokenMeta)
+	}
+	if _, ok := v.tokenMetas[documentID]; !ok {
+		v.tokenMetas[documentID] = meta
+	}
+	return v.tokenMetas[documentID], nil
+}
+
+// setTokenMeta writes meta to the metadata dir and replaces the in-memory token meta
+func (v *Viewer) setTokenMeta(meta *fstore.FirestoreTokenMeta) error {
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+
+	err := writeJSONAtomic(v.metadataPath(meta.DocumentID), meta)
+	if err != nil {
+		return err
+	}
+	if v.tokenMetas == nil {
+		v.tokenMetas = make(map[string]*fstore.FirestoreTokenMeta)
+	}
+	v.tokenMetas[meta.DocumentID] = meta
+	return nil
+}
+
+// currentPlaylist returns the token metas the video player was last told to play, in playlist order
+func (v *Viewer) currentPlaylist() []*fstore.FirestoreTokenMeta {
+	v.dataLock.RLock()
+	defer v.dataLock.RUnlock()
+	return v.playlist
+}
+
+// setPlaylist replaces the list of token metas the video player is playing
+func (v *Viewer) setPlaylist(metas []*fstore.FirestoreTokenMeta) {
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+	v.playlist = metas
+}
+
+func (v *Viewer) metadataPath(documentID string) string {
+	return filepath.Join(v.MetadataDir, fmt.Sprintf("%s.json", documentID))
+}
+
+// writeJSONAtomic marshals data and writes it with storage.WriteFileAtomic, so a crash never leaves a partial file at path
+func writeJSONAtomic(path string, data interface{}) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(path, bytes, 0644)
+}
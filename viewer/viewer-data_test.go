@@ -0,0 +1,93 @@
+package viewer
+
+import (
+	"context"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/videoplayer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewerData(t *testing.T) {
+	a := assert.New(t)
+
+	t.Run("persists in-memory changes and reloads them after restart", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		v := NewTestViewer(tmpdir)
+
+		plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{Name: "test", WalletAddress: "test", TokenMetaIDList: []string{"m1"}}}
+		meta := &fstore.FirestoreTokenMeta{DocumentID: "m1", TokenMeta: fstore.TokenMeta{Name: "starry night", MediaID: "s1", MediaType: ".mp4"}}
+		a.NoError(v.setPlaque(plaque))
+		a.NoError(v.setTokenMeta(meta))
+
+		// memory and disk match
+		memPlaque, err := v.currentPlaque()
+		a.NoError(err)
+		diskPlaque, err := v.ReadLocalPlaqueFile()
+		a.NoError(err)
+		a.Equal(plaque, memPlaque)
+		a.Equal(memPlaque, diskPlaque)
+
+		diskMeta, err := v.ReadMetadata("m1")
+		a.NoError(err)
+		a.Equal(meta, diskMeta)
+
+		// a restarted viewer loads the same state from disk
+		restarted := NewTestViewer(tmpdir)
+		restartedPlaque, err := restarted.currentPlaque()
+		a.NoError(err)
+		a.Equal(plaque, restartedPlaque)
+		restartedMeta, err := restarted.tokenMeta("m1")
+		a.NoError(err)
+		a.Equal(meta, restartedMeta)
+
+		// no temp files are left behind
+		files, err := ioutil.ReadDir(tmpdir)
+		a.NoError(err)
+		for _, f := range files {
+			a.False(strings.HasSuffix(f.Name(), ".tmp"), f.Name())
+		}
+	})
+
+	t.Run("serves state from memory after startup", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		v := NewTestViewer(tmpdir)
+		v.TestMode = true
+		playerStub := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+
+		a.NoError(v.setPlaque(&fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: []string{"m1", "m2"}}}))
+		a.NoError(v.setTokenMeta(&fstore.FirestoreTokenMeta{DocumentID: "m1", TokenMeta: fstore.TokenMeta{Name: "starry night", MediaID: "s1", MediaType: ".mp4"}}))
+		a.NoError(v.setTokenMeta(&fstore.FirestoreTokenMeta{DocumentID: "m2", TokenMeta: fstore.TokenMeta{Name: "irises", MediaID: "s2", MediaType: ".mp4"}}))
+
+		// restart viewer offline so only local data is available
+		v = NewTestViewer(tmpdir)
+		v.VideoPlayer = playerStub
+		v.TestMode = true
+		playerStub.PlayFilesWaitGroup.Add(1)
+		a.NoError(v.Startup(context.Background()))
+
+		stateData := v.GetViewerState()
+		a.Equal(ViewerStateDisplay, stateData.State)
+		a.Equal("p1", stateData.Plaque.DocumentID)
+		a.Equal("m1", stateData.ActiveTokenMeta.DocumentID)
+		a.Equal(&PlaybackData{State: videoplayer.PlayerPlaying}, stateData.Playback)
+		a.Len(v.currentPlaylist(), 2)
+
+		// removing files on disk does not affect in-memory state
+		jsonFiles, err := filepath.Glob(filepath.Join(tmpdir, "*.json"))
+		a.NoError(err)
+		for _, f := range jsonFiles {
+			a.NoError(os.Remove(f))
+		}
+		stateData = v.GetViewerState()
+		a.Equal(ViewerStateDisplay, stateData.State)
+		meta, err := v.GetTokenMetaForFileName("s2.mp4")
+		a.NoError(err)
+		a.Equal("irises", meta.TokenMeta.Name)
+	})
+}
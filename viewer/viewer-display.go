@@ -0,0 +1,54 @@
+package viewer
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoDisplayController is returned by SetDisplayPower when the viewer has no display controller configured
+var ErrNoDisplayController = errors.New("no display controller is configured")
+
+// DisplayData is the power state of the display, as last set by the viewer
+type DisplayData struct {
+	Controlled bool `json:"controlled"` // false if no display controller is configured
+	On         bool `json:"on"`
+}
+
+// SetDisplayPower turns the display on or off, the setting holds until the plaque schedule next turns the display on or off
+func (v *Viewer) SetDisplayPower(ctx context.Context, on bool) error {
+	if v.Display == nil {
+		return ErrNoDisplayController
+	}
+	v.displayLock.Lock()
+	defer v.displayLock.Unlock()
+
+	var err error
+	if on {
+		err = v.Display.On(ctx)
+	} else {
+		err = v.Display.Off(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	v.displayOff = !on
+	return nil
+}
+
+// DisplayPower returns the power state of the display
+func (v *Viewer) DisplayPower() DisplayData {
+	v.displayLock.Lock()
+	defer v.displayLock.Unlock()
+	return DisplayData{Controlled: v.Display != nil, On: !v.displayOff}
+}
+
+// applyScheduledPower turns the display on or off when a schedule window turns the display off or back on
+func (v *Viewer) applyScheduledPower(ctx context.Context, previous *scheduleSelection, selection scheduleSelection) {
+	if v.Display == nil || (previous != nil && previous.DisplayOff == selection.DisplayOff) {
+		return
+	}
+	err := v.SetDisplayPower(ctx, !selection.DisplayOff)
+	if err != nil {
+		logger.Printf("applyScheduledPower - failed to turn display on=%v: %v", !selection.DisplayOff, err)
+	}
+}
@@ -0,0 +1,141 @@
+package viewer
+
+import (
+	"context"
+	"jkurtz678/moda-viewer/videoplayer"
+	"reflect"
+	"time"
+)
+
+// statePollInterval is how often the state watcher refreshes state that changes without notice, download progress while loading
+// and the active token while the player is still starting
+const statePollInterval = time.Second
+
+// playerPollInterval is the longest the state watcher goes without checking the player, catching changes made outside the viewer
+const playerPollInterval = 30 * time.Second
+
+// SubscribeState returns a channel which receives the current viewer state immediately, and again each time the state changes
+// the channel is closed once ctx is done
+// slow subscribers only receive the latest state, intermediate states are dropped
+func (v *Viewer) SubscribeState(ctx context.Context) <-chan *ViewerStateData {
+	state := v.GetViewerState()
+	ch := make(chan *ViewerStateData, 1)
+	ch <- state
+
+	v.subLock.Lock()
+	if v.subscribers == nil {
+		v.subscribers = make(map[chan *ViewerStateData]struct{})
+	}
+	v.subscribers[ch] = struct{}{}
+	if !v.watching {
+		v.watching = true
+		go v.watchState(state)
+	}
+	v.subLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		v.subLock.Lock()
+		delete(v.subscribers, ch)
+		close(ch)
+		v.subLock.Unlock()
+	}()
+
+	return ch
+}
+
+// notifyStateChange wakes the state watcher after loading or loadErr values change, does not block
+func (v *Viewer) notifyStateChange() {
+	select {
+	case v.stateChangeChan() <- struct{}{}:
+	default:
+	}
+}
+
+func (v *Viewer) stateChangeChan() chan struct{} {
+	v.subLock.Lock()
+	defer v.subLock.Unlock()
+	if v.stateChange == nil {
+		v.stateChange = make(chan struct{}, 1)
+	}
+	return v.stateChange
+}
+
+// watchState publishes viewer state to subscribers when it differs from last, running until there are no subscribers left
+// updates are driven by notifyStateChange, the player is only queried again when the playing media is due to end
+// a single watcher is shared by all subscribers so the player is queried once no matter how many plaques are listening
+func (v *Viewer) watchState(last *ViewerStateData) {
+	stateChange := v.stateChangeChan()
+	state := last
+
+	for {
+		v.subLock.Lock()
+		if len(v.subscribers) == 0 {
+			v.watching = false
+			v.subLock.Unlock()
+			return
+		}
+		v.subLock.Unlock()
+
+		wait := time.NewTimer(nextStatePoll(state))
+		select {
+		case <-wait.C:
+		case <-stateChange:
+		}
+		wait.Stop()
+
+		state = v.GetViewerState()
+		if stateChanged(last, state) {
+			last = state
+			v.publishState(state)
+		}
+	}
+}
+
+// nextStatePoll returns how long the state watcher can wait before state changes nobody is notified of
+// the player moves on to the next file by itself once the playing media ends, so it is checked just after
+func nextStatePoll(state *ViewerStateData) time.Duration {
+	if state.State == ViewerStateLoading {
+		return statePollInterval
+	}
+	if state.Playback == nil || state.Playback.State != videoplayer.PlayerPlaying || state.Playback.Duration <= 0 {
+		return playerPollInterval
+	}
+	remaining := time.Duration((state.Playback.Duration-state.Playback.Position)*float64(time.Second)) + statePollInterval
+	if remaining < statePollInterval {
+		return statePollInterval
+	}
+	if remaining > playerPollInterval {
+		return playerPollInterval
+	}
+	return remaining
+}
+
+// publishState sends state to every subscriber, replacing any state they have not yet received
+func (v *Viewer) publishState(state *ViewerStateData) {
+	v.subLock.Lock()
+	defer v.subLock.Unlock()
+	for ch := range v.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- state
+	}
+}
+
+// stateChanged compares viewer states ignoring playback position, which changes on every poll and is extrapolated by the plaque
+func stateChanged(last, state *ViewerStateData) bool {
+	return !reflect.DeepEqual(withoutPosition(last), withoutPosition(state))
+}
+
+func withoutPosition(state *ViewerStateData) *ViewerStateData {
+	if state == nil || state.Playback == nil {
+		return state
+	}
+	copied := *state
+	playback := *state.Playback
+	playback.Position = 0
+	copied.Playback = &playback
+	return &copied
+}
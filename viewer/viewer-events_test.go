@@ -0,0 +1,96 @@
+package viewer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/videoplayer"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeState(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	v := NewTestViewer(t.TempDir())
+	plaqueBytes, err := json.Marshal(&fstore.FirestorePlaque{DocumentID: "p1"})
+	a.NoError(err)
+	a.NoError(ioutil.WriteFile(v.PlaqueFile, plaqueBytes, 0644))
+
+	updates := v.SubscribeState(ctx)
+
+	// current state is sent immediately
+	state := <-updates
+	a.Equal(ViewerStateQrScan, state.State)
+	a.Equal("p1", state.Plaque.DocumentID)
+
+	// loading change is pushed
+	v.stateLock.Lock()
+	v.loading = true
+	v.stateLock.Unlock()
+	v.notifyStateChange()
+
+	select {
+	case state = <-updates:
+		a.Equal(ViewerStateLoading, state.State)
+	case <-time.After(time.Second):
+		t.Fatal("expected loading state to be pushed")
+	}
+
+	// nothing is pushed if state is unchanged
+	v.notifyStateChange()
+	select {
+	case state = <-updates:
+		t.Fatalf("unexpected state pushed %+v", state)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// channel closes once context is done
+	cancel()
+	for range updates {
+	}
+}
+
+func TestStateChanged(t *testing.T) {
+	a := assert.New(t)
+	state := &ViewerStateData{State: ViewerStateDisplay, Playback: &PlaybackData{State: videoplayer.PlayerPlaying, Position: 1, Duration: 60}}
+
+	moved := *state
+	moved.Playback = &PlaybackData{State: videoplayer.PlayerPlaying, Position: 2, Duration: 60}
+	a.False(stateChanged(state, &moved))
+	a.Equal(1.0, state.Playback.Position) // compared states are not modified
+
+	paused := *state
+	paused.Playback = &PlaybackData{State: videoplayer.PlayerPaused, Position: 2, Duration: 60}
+	a.True(stateChanged(state, &paused))
+
+	a.True(stateChanged(state, &ViewerStateData{State: ViewerStateLoading}))
+	a.False(stateChanged(nil, nil))
+}
+
+func TestNextStatePoll(t *testing.T) {
+	tests := []struct {
+		name  string
+		state *ViewerStateData
+		want  time.Duration
+	}{
+		{"loading", &ViewerStateData{State: ViewerStateLoading, Loading: &LoadingData{}}, statePollInterval},
+		{"player starting", &ViewerStateData{State: ViewerStateLoading}, statePollInterval},
+		{"no art", &ViewerStateData{State: ViewerStateNoValidTokens}, playerPollInterval},
+		{"image", &ViewerStateData{State: ViewerStateDisplay, Playback: &PlaybackData{State: videoplayer.PlayerPlaying}}, playerPollInterval},
+		{"paused", &ViewerStateData{State: ViewerStateDisplay, Playback: &PlaybackData{State: videoplayer.PlayerPaused, Position: 10, Duration: 12}}, playerPollInterval},
+		{"video ending", &ViewerStateData{State: ViewerStateDisplay, Playback: &PlaybackData{State: videoplayer.PlayerPlaying, Position: 10, Duration: 12}}, 3 * time.Second},
+		{"video ended", &ViewerStateData{State: ViewerStateDisplay, Playback: &PlaybackData{State: videoplayer.PlayerPlaying, Position: 13, Duration: 12}}, statePollInterval},
+		{"long video", &ViewerStateData{State: ViewerStateDisplay, Playback: &PlaybackData{State: videoplayer.PlayerPlaying, Position: 10, Duration: 600}}, playerPollInterval},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, nextStatePoll(test.state))
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package viewer
+
+import (
+	"context"
+	"errors"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/mediaformat"
+	"jkurtz678/moda-viewer/storage"
+	"sort"
+	"time"
+)
+
+// TokenFailureReason is why a token of the plaque could not be played
+type TokenFailureReason string
+
+const (
+	FailureMissingMetadata  = TokenFailureReason("missing_metadata")  // token meta was not found on the remote, or could not be loaded from the remote or a local copy
+	FailureNoMediaLink      = TokenFailureReason("no_media_link")     // token meta has neither archive media nor an external media url
+	FailureDownloadError    = TokenFailureReason("download_error")    // media download failed
+	FailureChecksumMismatch = TokenFailureReason("checksum_mismatch") // downloaded media did not match the token checksum or size
+)
+
+const (
+	retryInterval   = 5 * time.Second  // how often failed tokens are checked for a retry
+	retryBackoffMin = 30 * time.Second // wait before the first retry of a failed token, doubled after each failed retry
+	retryBackoffMax = 30 * time.Minute
+)
+
+// TokenFailure is a token of the current load that could not be played, it is retried in the background until it loads or tokens are reloaded
+type TokenFailure struct {
+	TokenMetaID string             `json:"token_meta_id"`
+	Name        string             `json:"name"`
+	Reason      TokenFailureReason `json:"reason"`
+	Error       string             `json:"error"`
+	Attempts    int                `json:"attempts"`   // times the token has failed to load
+	NextRetry   time.Time          `json:"next_retry"` // time the token will next be retried
+}
+
+// TokenState is the load state of a token of the plaque
+type TokenState string
+
+const (
+	TokenStatePending = TokenState("pending") // token is still loading
+	TokenStateReady   = TokenState("ready")   // token is in the playlist
+	TokenStateFailed  = TokenState("failed")  // token could not be loaded and will be retried
+)
+
+// TokenStatus is the load state of a token of the plaque, with its failure if it failed
+type TokenStatus struct {
+	TokenMetaID string              `json:"token_meta_id"`
+	Name        string              `json:"name"`
+	State       TokenState          `json:"state"`
+	Failure     *TokenFailure       `json:"failure,omitempty"`
+	Media       *mediaformat.Report `json:"media,omitempty"` // probe report of the token media, once it has been downloaded
+}
+
+// TokenStatuses returns the load state of each token selected by the last load, in plaque order
+func (v *Viewer) TokenStatuses() []TokenStatus {
+	v.stateLock.Lock()
+	ids := make([]string, 0)
+	if v.schedule != nil {
+		ids = append(ids, v.schedule.TokenMetaIDList...)
+	}
+	v.stateLock.Unlock()
+
+	failures := make(map[string]TokenFailure)
+	for _, failure := range v.tokenFailures() {
+		failures[failure.TokenMetaID] = failure
+	}
+	playing := make(map[string]bool)
+	for _, meta := range v.currentPlaylist() {
+		playing[meta.DocumentID] = true
+	}
+
+	statuses := make([]TokenStatus, 0, len(ids))
+	for _, id := range ids {
+		status := TokenStatus{TokenMetaID: id, State: TokenStatePending}
+		if meta, err := v.tokenMeta(id); err == nil {
+			status.Name = meta.TokenMeta.Name
+			status.Media = v.mediaReport(meta.MediaFileName())
+		}
+		if failure, ok := failures[id]; ok {
+			status.State = TokenStateFailed
+			status.Failure = &failure
+			if status.Name == "" {
+				status.Name = failure.Name
+			}
+		} else if playing[id] {
+			status.State = TokenStateReady
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// selectionOrder returns metas sorted in the order their tokens were selected by the last load, the plaque order
+func (v *Viewer) selectionOrder(metas []*fstore.FirestoreTokenMeta) []*fstore.FirestoreTokenMeta {
+	v.stateLock.Lock()
+	index := make(map[string]int)
+	if v.schedule != nil {
+		for i, id := range v.schedule.TokenMetaIDList {
+			index[id] = i
+		}
+	}
+	v.stateLock.Unlock()
+
+	sorted := append(make([]*fstore.FirestoreTokenMeta, 0, len(metas)), metas...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return index[sorted[i].DocumentID] < index[sorted[j].DocumentID]
+	})
+	return sorted
+}
+
+// tokenFailures returns the failed tokens of the current load, in the order they first failed
+func (v *Viewer) tokenFailures() []TokenFailure {
+	v.stateLock.Lock()
+	defer v.stateLock.Unlock()
+	return append(make([]TokenFailure, 0, len(v.failures)), v.failures...)
+}
+
+// resetFailures forgets the failed tokens of the previous load and returns the generation of the new load
+func (v *Viewer) resetFailures() int {
+	v.stateLock.Lock()
+	defer v.stateLock.Unlock()
+	v.failures = nil
+	v.loadGeneration++
+	return v.loadGeneration
+}
+
+// recordFailure records that a token failed to load, failures of an earlier load than the current generation are ignored
+func (v *Viewer) recordFailure(generation int, failure TokenFailure) {
+	v.stateLock.Lock()
+	if generation == v.loadGeneration {
+		v.recordFailureLocked(failure)
+	}
+	v.stateLock.Unlock()
+	v.notifyStateChange()
+}
+
+// recordFailureLocked records a failure of the current load, v.stateLock must be held
+func (v *Viewer) recordFailureLocked(failure TokenFailure) {
+	// copy so states already handed out are never modified
+	failures := append(make([]TokenFailure, 0, len(v.failures)+1), v.failures...)
+	index := len(failures)
+	for i, f := range failures {
+		if f.TokenMetaID == failure.TokenMetaID {
+			index = i
+			failure.Attempts = f.Attempts
+		}
+	}
+	failure.Attempts++
+	failure.NextRetry = v.clock().Add(retryBackoff(failure.Attempts))
+	if index == len(failures) {
+		failures = append(failures, failure)
+	} else {
+		failures[index] = failure
+	}
+	v.failures = failures
+}
+
+// clearFailure removes a token which has loaded from the failures of load generation
+func (v *Viewer) clearFailure(generation int, documentID string) {
+	v.stateLock.Lock()
+	if generation == v.loadGeneration {
+		failures := make([]TokenFailure, 0, len(v.failures))
+		for _, f := range v.failures {
+			if f.TokenMetaID != documentID {
+				failures = append(failures, f)
+			}
+		}
+		v.failures = failures
+	}
+	v.stateLock.Unlock()
+	v.notifyStateChange()
+}
+
+// retryBackoff returns the wait before retrying a token that has failed attempts times
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryBackoffMin
+	for i := 1; i < attempts && backoff < retryBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > retryBackoffMax {
+		backoff = retryBackoffMax
+	}
+	return backoff
+}
+
+// mediaFailure returns a failure for a token whose media could not be loaded
+func mediaFailure(meta *fstore.FirestoreTokenMeta, err error) TokenFailure {
+	reason := FailureDownloadError
+	var verr *storage.VerificationError
+	if errors.Is(err, errNoMediaLink) {
+		reason = FailureNoMediaLink
+	} else if errors.As(err, &verr) {
+		reason = FailureChecksumMismatch
+	}
+	return TokenFailure{TokenMetaID: meta.DocumentID, Name: meta.TokenMeta.Name, Reason: reason, Error: err.Error()}
+}
+
+// retryFailures retries failed tokens once their backoff has passed, until ctx is done
+func (v *Viewer) retryFailures(ctx context.Context) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			v.retryDue(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryDue retries each failed token whose next retry is due, tokens are not retried while loading
+func (v *Viewer) retryDue(ctx context.Context) {
+	v.stateLock.Lock()
+	loading := v.loading
+	generation := v.loadGeneration
+	v.stateLock.Unlock()
+	if loading {
+		return
+	}
+
+	now := v.clock()
+	for _, failure := range v.tokenFailures() {
+		if ctx.Err() != nil {
+			return
+		}
+		if now.Before(failure.NextRetry) {
+			continue
+		}
+		v.retryToken(ctx, generation, failure)
+	}
+}
+
+// retryToken loads the metadata and media of a failed token and puts it back in the playlist in plaque order, as a reload would
+// the result is discarded if tokens were reloaded since load generation
+func (v *Viewer) retryToken(ctx context.Context, generation int, failure TokenFailure) {
+	documentID := failure.TokenMetaID
+	logger.Printf("retryToken - retrying token %s", documentID)
+	metas, failures, err := v.loadTokenMetas(ctx, []string{documentID})
+	if err != nil {
+		logger.Printf("retryToken - failed to load token meta %s: %v", documentID, err)
+		return
+	}
+	for _, f := range failures {
+		v.recordFailure(generation, f)
+	}
+	if len(metas) == 0 {
+		return
+	}
+
+	meta := metas[0]
+	err = v.downloadMedia(ctx, meta)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logger.Printf("retryToken - failed to load media for token %s: %v", documentID, err)
+		v.recordFailure(generation, mediaFailure(meta, err))
+		return
+	}
+
+	// a reload replaces the playlist, so the token is only added if no reload started since the retry
+	v.loadLock.Lock()
+	defer v.loadLock.Unlock()
+	v.stateLock.Lock()
+	current := generation == v.loadGeneration
+	v.stateLock.Unlock()
+	if !current {
+		return
+	}
+
+	metas = v.selectionOrder(append(v.currentPlaylist(), meta))
+	err = v.swapPlaylist(v.orderPlaylist(metas))
+	if err != nil {
+		logger.Printf("retryToken - failed to add token %s to playlist: %v", documentID, err)
+		failure.Error = err.Error()
+		v.recordFailure(generation, failure)
+		return
+	}
+	logger.Printf("retryToken - token %s loaded and added to playlist", documentID)
+
+	// a load where every token failed is an error until a token loads
+	v.stateLock.Lock()
+	if errors.Is(v.loadErr, errNoValidTokens) {
+		v.loadErr = nil
+	}
+	v.stateLock.Unlock()
+	v.clearFailure(generation, documentID)
+}
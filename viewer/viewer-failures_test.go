@@ -0,0 +1,132 @@
+package viewer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/storage"
+	"jkurtz678/moda-viewer/videoplayer"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenFailures(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	client, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	v.DBClient = client
+	media := &gatedMediaClient{}
+	v.MediaClient = media
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	v.now = func() time.Time { return now }
+	player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+
+	m1, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "starry night", MediaID: "s1", MediaType: ".mp4"})
+	a.NoError(err)
+	m2, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "irises", MediaID: "s2", MediaType: ".mp4"})
+	a.NoError(err)
+	m3, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "sunflowers"})
+	a.NoError(err)
+	plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{
+		WalletAddress:   "test",
+		TokenMetaIDList: []string{m1.DocumentID, m2.DocumentID, m3.DocumentID, "missing"},
+	}}
+	a.NoError(v.setPlaque(plaque))
+
+	// each token fails for a different reason, the rest of the plaque still plays
+	media.release("s1.mp4", nil)
+	media.release("s2.mp4", errors.New("download failed"))
+	player.PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(ctx, plaque))
+	a.Equal([]*fstore.FirestoreTokenMeta{m1}, v.currentPlaylist())
+
+	state := v.GetViewerState()
+	a.Equal(ViewerStatePartiallyLoaded, state.State)
+	a.Len(state.Failures, 3)
+
+	failure := func(meta *fstore.FirestoreTokenMeta, reason TokenFailureReason, err string, attempts int) *TokenFailure {
+		return &TokenFailure{
+			TokenMetaID: meta.DocumentID,
+			Name:        meta.TokenMeta.Name,
+			Reason:      reason,
+			Error:       err,
+			Attempts:    attempts,
+			NextRetry:   now.Add(retryBackoff(attempts)),
+		}
+	}
+	missing := &fstore.FirestoreTokenMeta{DocumentID: "missing"}
+	a.Equal([]TokenStatus{
+		{TokenMetaID: m1.DocumentID, Name: "starry night", State: TokenStateReady},
+		{TokenMetaID: m2.DocumentID, Name: "irises", State: TokenStateFailed, Failure: failure(m2, FailureDownloadError, "download failed", 1)},
+		{TokenMetaID: m3.DocumentID, Name: "sunflowers", State: TokenStateFailed, Failure: failure(m3, FailureNoMediaLink, errNoMediaLink.Error(), 1)},
+		{TokenMetaID: "missing", State: TokenStateFailed, Failure: failure(missing, FailureMissingMetadata, "token meta not found", 1)},
+	}, v.TokenStatuses())
+
+	// nothing is retried before its backoff has passed, the media client would block if it were
+	v.retryDue(ctx)
+	a.Len(v.tokenFailures(), 3)
+
+	// once due, tokens that load are added to the playlist and the rest back off further
+	now = now.Add(retryBackoffMin)
+	media.release("s2.mp4", nil)
+	v.retryDue(ctx)
+	a.Equal([]*fstore.FirestoreTokenMeta{m1, m2}, v.currentPlaylist())
+	a.Equal(v.mediaFilepaths([]*fstore.FirestoreTokenMeta{m1, m2}), player.ActivePlaylistFilepaths)
+	statuses := v.TokenStatuses()
+	a.Equal(TokenStateReady, statuses[1].State)
+	a.Equal(failure(m3, FailureNoMediaLink, errNoMediaLink.Error(), 2), statuses[2].Failure)
+	a.Equal(failure(missing, FailureMissingMetadata, "token meta not found", 2), statuses[3].Failure)
+
+	// retried tokens keep to plaque order, a token loading after one below it on the plaque is played before it
+	a.NoError(ioutil.WriteFile(filepath.Join(tmpdir, "db", "token-meta", "missing.json"), []byte(`{"name": "wheat field", "media_id": "s4", "media_type": ".mp4"}`), 0644))
+	now = now.Add(retryBackoff(2))
+	media.release("s4.mp4", nil)
+	v.retryDue(ctx)
+	a.Len(v.currentPlaylist(), 3)
+
+	// when every failed token has loaded the viewer is back to display
+	a.NoError(client.UpdateTokenMeta(ctx, m3.DocumentID, &fstore.TokenMetaPatch{MediaID: fstore.String("s3"), MediaType: fstore.String(".mp4")}))
+	now = now.Add(retryBackoff(3))
+	media.release("s3.mp4", nil)
+	player.PlayFilesWaitGroup.Add(1)
+	v.retryDue(ctx)
+	playlist := v.currentPlaylist()
+	ids := make([]string, 0, len(playlist))
+	for _, meta := range playlist {
+		ids = append(ids, meta.DocumentID)
+	}
+	a.Equal(plaque.Plaque.TokenMetaIDList, ids)
+	a.Equal(v.mediaFilepaths(playlist), player.ActivePlaylistFilepaths)
+	a.Empty(v.tokenFailures())
+	a.Equal(ViewerStateDisplay, v.GetViewerState().State)
+
+	// results of an earlier load are discarded once tokens are reloaded
+	generation := v.loadGeneration
+	v.resetFailures()
+	v.recordFailure(generation, TokenFailure{TokenMetaID: m1.DocumentID, Reason: FailureDownloadError})
+	a.Empty(v.tokenFailures())
+	media.release("s1.mp4", nil)
+	v.retryToken(ctx, generation, TokenFailure{TokenMetaID: m1.DocumentID})
+	a.Len(v.currentPlaylist(), 4)
+}
+
+func TestMediaFailure(t *testing.T) {
+	a := assert.New(t)
+	meta := testMetas("1")[0]
+	a.Equal(FailureNoMediaLink, mediaFailure(meta, errNoMediaLink).Reason)
+	a.Equal(FailureChecksumMismatch, mediaFailure(meta, fmt.Errorf("wrapped %w", &storage.VerificationError{Check: "sha256"})).Reason)
+	a.Equal(FailureDownloadError, mediaFailure(meta, errors.New("connection reset")).Reason)
+
+	a.Equal(30*time.Second, retryBackoff(1))
+	a.Equal(time.Minute, retryBackoff(2))
+	a.Equal(2*time.Minute, retryBackoff(3))
+	a.Equal(30*time.Minute, retryBackoff(100))
+}
@@ -0,0 +1,240 @@
+package viewer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"jkurtz678/moda-viewer/config"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/mediaformat"
+	"os"
+	"path/filepath"
+)
+
+// mediaReportsDir is the dir in MetadataDir holding the probe report of each media file, named after the media file
+const mediaReportsDir = "media-reports"
+
+// mediaProcessors is how many media files are probed and transcoded at once, ffmpeg already uses every core for one file
+const mediaProcessors = 1
+
+// newMediaProcessor returns the media probe and transcode pipeline for the config, nil if probing is disabled
+func newMediaProcessor(cfg *config.Config) mediaformat.Processor {
+	if cfg.Media.FFprobe == "" {
+		return nil
+	}
+	return mediaformat.NewPipeline(cfg.Media.FFprobe, cfg.Media.FFmpeg, mediaformat.Profile{
+		MaxWidth:    cfg.Media.MaxWidth,
+		MaxHeight:   cfg.Media.MaxHeight,
+		VideoCodecs: cfg.Media.VideoCodecList(),
+	})
+}
+
+// queueMediaProcessing processes the downloaded media of meta in the background, at most mediaProcessors files at once
+// the original media plays meanwhile, media already queued is not queued again
+// processing carries on after the load that downloaded the media, until stopMediaProcessing
+func (v *Viewer) queueMediaProcessing(meta *fstore.FirestoreTokenMeta) {
+	if v.Media == nil {
+		return
+	}
+	name := meta.MediaFileName()
+	v.processLock.Lock()
+	if v.processing[name] {
+		v.processLock.Unlock()
+		return
+	}
+	if v.processing == nil {
+		v.processing = make(map[string]bool)
+		v.processSlots = make(chan struct{}, mediaProcessors)
+		v.processCtx, v.processStop = context.WithCancel(context.Background())
+	}
+	v.processing[name] = true
+	ctx, slots := v.processCtx, v.processSlots
+	v.processWait.Add(1)
+	v.processLock.Unlock()
+
+	go func() {
+		defer v.processWait.Done()
+		defer func() {
+			v.processLock.Lock()
+			delete(v.processing, name)
+			v.processLock.Unlock()
+		}()
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		report := v.processMedia(ctx, meta)
+		<-slots
+		if report != nil {
+			v.setProcessedMedia(meta, report)
+		}
+	}()
+}
+
+// stopMediaProcessing cancels media processing and waits for it to stop, ffmpeg is killed rather than left writing a rendition
+func (v *Viewer) stopMediaProcessing() {
+	v.processLock.Lock()
+	if v.processStop != nil {
+		v.processStop()
+	}
+	v.processLock.Unlock()
+	v.processWait.Wait()
+}
+
+// processMedia probes the downloaded media of meta and transcodes it if the device cannot play it smoothly, returning the report
+// failures are only logged and kept in the report, the original media is played if there is no rendition, nil if ctx is done
+func (v *Viewer) processMedia(ctx context.Context, meta *fstore.FirestoreTokenMeta) *mediaformat.Report {
+	name := meta.MediaFileName()
+	report := v.Media.Process(ctx, filepath.Join(v.MediaDir, name), v.mediaReport(name))
+	if ctx.Err() != nil {
+		return nil
+	}
+	if report.Error != "" {
+		logger.Printf("processMedia - media %s of token %s could not be processed: %s", name, meta.DocumentID, report.Error)
+	}
+	return report
+}
+
+// setProcessedMedia saves the report of the media of meta, swapping its rendition into the playlist in place of the original
+func (v *Viewer) setProcessedMedia(meta *fstore.FirestoreTokenMeta, report *mediaformat.Report) {
+	v.playlistLock.Lock()
+	defer v.playlistLock.Unlock()
+	before := v.playbackFileName(meta)
+	err := v.setMediaReport(report)
+	if err != nil {
+		logger.Printf("setProcessedMedia - failed to save report of media %s: %v", report.File, err)
+		return
+	}
+	if v.playbackFileName(meta) == before {
+		return
+	}
+
+	// the rendition is pinned with the original, so eviction does not remove it before the next load
+	if plaque, err := v.currentPlaque(); err == nil && v.Cache != nil {
+		v.pinMedia(plaque)
+	}
+	err = v.swapRendition(meta)
+	if err != nil {
+		logger.Printf("setProcessedMedia - failed to play rendition of media %s: %v", report.File, err)
+	}
+}
+
+// swapRendition replaces the playlist entry of meta, playing its original media, with its rendition, v.playlistLock must be held
+// players cannot insert into a playlist, so the rendition is appended and the token moves to the end, a playing original restarts as the rendition
+func (v *Viewer) swapRendition(meta *fstore.FirestoreTokenMeta) error {
+	playlist := v.currentPlaylist()
+	index := -1
+	for i, m := range playlist {
+		if playlistKey(m) == playlistKey(meta) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	entry := playlist[index]
+	v.touchMedia([]*fstore.FirestoreTokenMeta{entry})
+
+	// the rotation is locked so a tick does not time the playing token against a half changed playlist
+	v.rotation.lock.Lock()
+	defer v.rotation.lock.Unlock()
+	logger.Printf("swapRendition - playing %s in place of %s for token %s", v.playbackFileName(entry), entry.MediaFileName(), entry.DocumentID)
+	err := v.VideoPlayer.AppendFiles(v.mediaFilepaths([]*fstore.FirestoreTokenMeta{entry}))
+	if err != nil {
+		return err
+	}
+	status, err := v.VideoPlayer.GetStatus()
+	if err != nil {
+		return err
+	}
+	if status.PlaylistIndex == index {
+		v.rotation.meta = nil
+		err = v.VideoPlayer.PlayIndex(len(playlist))
+		if err != nil {
+			return err
+		}
+	}
+	err = v.VideoPlayer.RemoveIndex(index)
+	if err != nil {
+		return err
+	}
+	swapped := make([]*fstore.FirestoreTokenMeta, 0, len(playlist))
+	swapped = append(append(append(swapped, playlist[:index]...), playlist[index+1:]...), entry)
+	v.setPlaylist(swapped)
+	v.notifyStateChange()
+	return nil
+}
+
+// mediaReport returns the in-memory report of the media file name, loading it from the metadata dir on first use, nil if there is none
+func (v *Viewer) mediaReport(name string) *mediaformat.Report {
+	v.dataLock.RLock()
+	report, ok := v.mediaReports[name]
+	v.dataLock.RUnlock()
+	if ok {
+		return report
+	}
+
+	// a missing report is remembered as nil, so playing media without one does not read the dir on every rotation tick
+	data, err := ioutil.ReadFile(v.mediaReportPath(name))
+	if err == nil {
+		report = new(mediaformat.Report)
+		err = json.Unmarshal(data, report)
+		if err != nil {
+			logger.Printf("mediaReport - invalid report for media %s: %v", name, err)
+			report = nil
+		}
+	}
+
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+	if v.mediaReports == nil {
+		v.mediaReports = make(map[string]*mediaformat.Report)
+	}
+	if _, ok := v.mediaReports[name]; !ok {
+		v.mediaReports[name] = report
+	}
+	return v.mediaReports[name]
+}
+
+// setMediaReport writes report to the metadata dir and replaces the in-memory report of its media file
+func (v *Viewer) setMediaReport(report *mediaformat.Report) error {
+	v.dataLock.Lock()
+	defer v.dataLock.Unlock()
+
+	err := os.MkdirAll(filepath.Join(v.MetadataDir, mediaReportsDir), 0755)
+	if err != nil {
+		return err
+	}
+	err = writeJSONAtomic(v.mediaReportPath(report.File), report)
+	if err != nil {
+		return err
+	}
+	if v.mediaReports == nil {
+		v.mediaReports = make(map[string]*mediaformat.Report)
+	}
+	v.mediaReports[report.File] = report
+	return nil
+}
+
+func (v *Viewer) mediaReportPath(name string) string {
+	return filepath.Join(v.MetadataDir, mediaReportsDir, name+".json")
+}
+
+// playbackFileName returns the media file the player is given for meta, its rendition if the original was transcoded
+func (v *Viewer) playbackFileName(meta *fstore.FirestoreTokenMeta) string {
+	name := meta.MediaFileName()
+	if report := v.mediaReport(name); report != nil && report.Rendition != "" {
+		return report.Rendition
+	}
+	return name
+}
+
+// mediaFileNames returns the media files of meta kept in the media dir, the original and any rendition
+func (v *Viewer) mediaFileNames(meta *fstore.FirestoreTokenMeta) []string {
+	name := meta.MediaFileName()
+	if playback := v.playbackFileName(meta); playback != name {
+		return []string{name, playback}
+	}
+	return []string{name}
+}
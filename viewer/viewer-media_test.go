@@ -0,0 +1,102 @@
+package viewer
+
+import (
+	"context"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/mediaformat"
+	"jkurtz678/moda-viewer/videoplayer"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMedia(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+	transcoded := &mediaformat.Report{
+		File:      "s2.mp4",
+		Info:      &mediaformat.Info{Container: "mov,mp4,m4a,3gp,3g2,mj2", VideoCodec: "hevc", Width: 3840, Height: 2160, Duration: 30},
+		Exceeds:   []string{"resolution 3840x2160 is above 1920x1080"},
+		Rendition: "s2.playback.mp4",
+	}
+	processor := &mediaformat.ProcessorStub{Reports: map[string]*mediaformat.Report{"s2.mp4": transcoded}, Gate: make(chan struct{})}
+	v.Media = processor
+	playing := func() []string {
+		files := make([]string, 0)
+		for _, path := range player.ActivePlaylistFilepaths {
+			unescaped, err := url.QueryUnescape(path)
+			a.NoError(err)
+			files = append(files, filepath.Base(unescaped))
+		}
+		return files
+	}
+
+	metas := testMetas("1", "2")
+	for _, meta := range metas {
+		a.NoError(v.setTokenMeta(meta))
+	}
+	plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: []string{"m1", "m2"}}}
+	a.NoError(v.setPlaque(plaque))
+	player.PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(context.Background(), plaque))
+
+	// the originals play while the media is processed in the background, one file at a time
+	a.Equal([]string{"s1.mp4", "s2.mp4"}, playing())
+	a.Eventually(func() bool { return len(processor.Calls()) == 1 }, time.Second, 10*time.Millisecond)
+	a.Never(func() bool { return len(processor.Calls()) > 1 }, 100*time.Millisecond, 10*time.Millisecond)
+	processor.Gate <- struct{}{}
+	processor.Gate <- struct{}{}
+	v.processWait.Wait()
+	a.ElementsMatch([]string{"s1.mp4", "s2.mp4"}, processor.Calls())
+	a.Equal(1, processor.MostActive())
+
+	// the rendition is swapped in place of the original once transcoded
+	a.Equal([]string{"s1.mp4", "s2.playback.mp4"}, playing())
+	a.Equal([]string{"m1", "m2"}, []string{v.currentPlaylist()[0].DocumentID, v.currentPlaylist()[1].DocumentID})
+	a.FileExists(filepath.Join(tmpdir, "s2.playback.mp4"))
+	a.Equal([]string{"s2.mp4", "s2.playback.mp4"}, v.mediaFileNames(metas[1]))
+
+	// a playing original restarts as its rendition
+	single := NewTestViewer(t.TempDir())
+	singlePlayer := single.VideoPlayer.(*videoplayer.VideoPlayerStub)
+	single.Media = &mediaformat.ProcessorStub{Reports: map[string]*mediaformat.Report{"s2.mp4": transcoded}}
+	a.NoError(single.setTokenMeta(metas[1]))
+	singlePlaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: []string{"m2"}}}
+	a.NoError(single.setPlaque(singlePlaque))
+	singlePlayer.PlayFilesWaitGroup.Add(1)
+	a.NoError(single.LoadAndPlayTokens(context.Background(), singlePlaque))
+	single.processWait.Wait()
+	a.Len(singlePlayer.ActivePlaylistFilepaths, 1)
+	a.Equal(0, singlePlayer.ActiveIndex)
+	a.Contains(singlePlayer.ActivePlaylistFilepaths[0], "s2.playback.mp4")
+	a.Len(single.currentPlaylist(), 1)
+
+	// reports are shown on the status api
+	a.NoError(v.Next())
+	state := v.GetViewerState()
+	a.Equal("m2", state.ActiveTokenMeta.DocumentID)
+	a.Equal(transcoded, state.Media)
+	statuses := v.TokenStatuses()
+	a.Equal(&mediaformat.Report{File: "s1.mp4"}, statuses[0].Media)
+	a.Equal(transcoded, statuses[1].Media)
+
+	// the rotation times the rendition as the token
+	timed := *plaque
+	timed.Plaque.DefaultDisplayDuration = 60
+	a.NoError(v.setPlaque(&timed))
+	v.advance(time.Now())
+	a.Equal("m2", v.rotation.meta.DocumentID)
+
+	// reports are kept with the local metadata
+	a.FileExists(filepath.Join(tmpdir, mediaReportsDir, "s2.mp4.json"))
+	restarted := NewTestViewer(tmpdir)
+	a.Equal(transcoded, restarted.mediaReport("s2.mp4"))
+	a.Equal("s2.playback.mp4", restarted.playbackFileName(metas[1]))
+	a.Nil(restarted.mediaReport("s3.mp4"))
+	a.Equal("s3.mp4", restarted.playbackFileName(testMetas("3")[0]))
+}
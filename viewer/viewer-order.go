@@ -0,0 +1,134 @@
+package viewer
+
+import (
+	"jkurtz678/moda-viewer/fstore"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// shuffler picks tokens for the shuffled play orders
+type shuffler struct {
+	lock  sync.Mutex
+	rand  *rand.Rand
+	queue []string // token meta ids not yet played in the current round of shuffle_no_repeat
+}
+
+func (s *shuffler) init() {
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
+// playOrder returns the play order of the current plaque, sequential if there is no plaque or the order is unknown
+func (v *Viewer) playOrder() (fstore.PlayOrder, map[string]int) {
+	plaque, err := v.currentPlaque()
+	if err != nil {
+		return fstore.PlayOrderSequential, nil
+	}
+	switch plaque.Plaque.PlayOrder {
+	case fstore.PlayOrderShuffle, fstore.PlayOrderShuffleNoRepeat, fstore.PlayOrderWeighted:
+		return plaque.Plaque.PlayOrder, plaque.Plaque.TokenWeights
+	}
+	return fstore.PlayOrderSequential, nil
+}
+
+// orderPlaylist returns metas in the order they are loaded and added to the player playlist
+// shuffled orders are randomized so the first tokens shown are not always those at the top of the list, weighted orders favour heavier tokens
+func (v *Viewer) orderPlaylist(metas []*fstore.FirestoreTokenMeta) []*fstore.FirestoreTokenMeta {
+	order, weights := v.playOrder()
+	s := &v.shuffler
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.init()
+	s.queue = nil
+
+	if order == fstore.PlayOrderSequential {
+		return metas
+	}
+	remaining := append([]*fstore.FirestoreTokenMeta(nil), metas...)
+	ordered := make([]*fstore.FirestoreTokenMeta, 0, len(metas))
+	for len(remaining) > 0 {
+		i := s.rand.Intn(len(remaining))
+		if order == fstore.PlayOrderWeighted {
+			i = s.pickWeighted(remaining, weights, "")
+		}
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ordered
+}
+
+// nextIndex returns the playlist index of the token to play after the token at current, following the plaque play order
+func (v *Viewer) nextIndex(playlist []*fstore.FirestoreTokenMeta, current int) int {
+	order, weights := v.playOrder()
+	if len(playlist) < 2 || current < 0 || current >= len(playlist) {
+		return 0
+	}
+	currentID := playlist[current].DocumentID
+
+	s := &v.shuffler
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.init()
+
+	switch order {
+	case fstore.PlayOrderShuffle:
+		// any token but the current one
+		i := s.rand.Intn(len(playlist) - 1)
+		if i >= current {
+			i++
+		}
+		return i
+	case fstore.PlayOrderWeighted:
+		return s.pickWeighted(playlist, weights, currentID)
+	case fstore.PlayOrderShuffleNoRepeat:
+		for {
+			if len(s.queue) == 0 {
+				// start a new round, the current token counts as played so it never repeats back to back
+				for _, i := range s.rand.Perm(len(playlist)) {
+					if i != current {
+						s.queue = append(s.queue, playlist[i].DocumentID)
+					}
+				}
+			}
+			id := s.queue[0]
+			s.queue = s.queue[1:]
+			// tokens removed from the playlist since the round started are skipped
+			if i := playlistIndex(playlist, id); i >= 0 && i != current {
+				return i
+			}
+		}
+	}
+	return (current + 1) % len(playlist)
+}
+
+// pickWeighted returns the index of a random meta other than skipID, chosen in proportion to its weight
+// tokens without a positive weight have weight 1
+func (s *shuffler) pickWeighted(metas []*fstore.FirestoreTokenMeta, weights map[string]int, skipID string) int {
+	weight := func(meta *fstore.FirestoreTokenMeta) int {
+		if meta.DocumentID == skipID {
+			return 0
+		}
+		if w := weights[meta.DocumentID]; w > 0 {
+			return w
+		}
+		return 1
+	}
+
+	total := 0
+	for _, meta := range metas {
+		total += weight(meta)
+	}
+	if total == 0 {
+		return 0
+	}
+	n := s.rand.Intn(total)
+	for i, meta := range metas {
+		n -= weight(meta)
+		if n < 0 {
+			return i
+		}
+	}
+	return len(metas) - 1
+}
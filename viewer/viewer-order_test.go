@@ -0,0 +1,108 @@
+package viewer
+
+import (
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/videoplayer"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlayOrder(t *testing.T) {
+	metas := []*fstore.FirestoreTokenMeta{
+		{DocumentID: "a", TokenMeta: fstore.TokenMeta{MediaID: "a", MediaType: ".mp4"}},
+		{DocumentID: "b", TokenMeta: fstore.TokenMeta{MediaID: "b", MediaType: ".mp4"}},
+		{DocumentID: "c", TokenMeta: fstore.TokenMeta{MediaID: "c", MediaType: ".mp4"}},
+		{DocumentID: "d", TokenMeta: fstore.TokenMeta{MediaID: "d", MediaType: ".mp4"}},
+	}
+	newOrderViewer := func(t *testing.T, order fstore.PlayOrder, weights map[string]int) *Viewer {
+		v := NewTestViewer(t.TempDir())
+		v.shuffler.rand = rand.New(rand.NewSource(1))
+		err := v.setPlaque(&fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{
+			WalletAddress:   "test",
+			TokenMetaIDList: []string{"a", "b", "c", "d"},
+			PlayOrder:       order,
+			TokenWeights:    weights,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	t.Run("sequential plays in list order", func(t *testing.T) {
+		a := assert.New(t)
+		v := newOrderViewer(t, "", nil)
+		a.Equal(metas, v.orderPlaylist(metas))
+		a.Equal(1, v.nextIndex(metas, 0))
+		a.Equal(0, v.nextIndex(metas, 3))
+	})
+
+	t.Run("shuffle never repeats the current token", func(t *testing.T) {
+		a := assert.New(t)
+		v := newOrderViewer(t, fstore.PlayOrderShuffle, nil)
+		a.ElementsMatch(metas, v.orderPlaylist(metas))
+
+		seen := make(map[int]int)
+		current := 0
+		for i := 0; i < 100; i++ {
+			next := v.nextIndex(metas, current)
+			a.NotEqual(current, next)
+			seen[next]++
+			current = next
+		}
+		a.Len(seen, 4)
+	})
+
+	t.Run("shuffle without repeat plays every token once per round", func(t *testing.T) {
+		a := assert.New(t)
+		v := newOrderViewer(t, fstore.PlayOrderShuffleNoRepeat, nil)
+		ordered := v.orderPlaylist(metas)
+		a.ElementsMatch(metas, ordered)
+
+		current := 0
+		for round := 0; round < 5; round++ {
+			played := []int{current}
+			for i := 0; i < len(metas)-1; i++ {
+				current = v.nextIndex(metas, current)
+				played = append(played, current)
+			}
+			a.ElementsMatch([]int{0, 1, 2, 3}, played)
+		}
+	})
+
+	t.Run("weighted favours heavier tokens", func(t *testing.T) {
+		a := assert.New(t)
+		v := newOrderViewer(t, fstore.PlayOrderWeighted, map[string]int{"a": 1, "c": 10})
+		a.Equal("c", v.orderPlaylist(metas)[0].DocumentID)
+
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			next := v.nextIndex(metas, 0)
+			a.NotEqual(0, next)
+			counts[metas[next].DocumentID]++
+		}
+		a.Greater(counts["c"], 4*counts["b"])
+		a.Greater(counts["c"], 4*counts["d"])
+	})
+
+	t.Run("rotation follows the play order", func(t *testing.T) {
+		a := assert.New(t)
+		v := newOrderViewer(t, fstore.PlayOrderWeighted, map[string]int{"a": 1, "d": 1000000})
+		player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+		player.PlayFilesWaitGroup.Add(1)
+		a.NoError(player.PlayFiles(v.mediaFilepaths(metas)))
+		v.setPlaylist(metas)
+
+		// images advance after the default image duration, to d rather than b
+		start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		v.advance(start)
+		v.advance(start.Add(defaultImageDuration))
+		a.Equal(3, player.ActiveIndex)
+
+		a.NoError(v.Next())
+		a.NotEqual(3, player.ActiveIndex)
+	})
+}
@@ -0,0 +1,195 @@
+package viewer
+
+import (
+	"context"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/videoplayer"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotationInterval is how often the viewer checks whether the displayed token has been shown for its display duration
+const rotationInterval = time.Second
+
+// defaultImageDuration is how long still images are shown when neither the token nor the plaque set a display duration
+// players are told to show images forever, so images would never advance without it
+const defaultImageDuration = 10 * time.Second
+
+// imageMediaTypes are the media types shown as still images, used for tokens whose media has not been probed
+var imageMediaTypes = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".bmp": true}
+
+// rotation tracks how long the displayed token has been playing
+type rotation struct {
+	lock     sync.Mutex
+	meta     *fstore.FirestoreTokenMeta // token being displayed, nil until the next tick adopts whatever the player is playing
+	elapsed  time.Duration              // time meta has been playing, excluding pauses
+	lastTick time.Time
+}
+
+// rotate advances the playlist whenever the displayed token has been shown for its display duration, until ctx is done
+// the player still advances at the natural end of a video, if that is before the display duration the video is played again
+func (v *Viewer) rotate(ctx context.Context) {
+	ticker := time.NewTicker(rotationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			v.advance(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// advance updates the time the displayed token has been playing and moves on to the next token if its time is up
+func (v *Viewer) advance(now time.Time) {
+	r := &v.rotation
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	lastTick := r.lastTick
+	r.lastTick = now
+
+	playlist := v.currentPlaylist()
+	if !v.timesPlaylist(playlist) {
+		// the player plays through the videos by itself, asking for its status every tick would only cost requests
+		r.meta = nil
+		return
+	}
+	status, err := v.VideoPlayer.GetStatus()
+	if err != nil {
+		logger.Printf("advance - failed to get player status %v", err)
+		return
+	}
+	index := status.PlaylistIndex
+	if index < 0 || index >= len(playlist) || filepath.Base(v.playbackFileName(playlist[index])) != status.File {
+		// player is showing the logo or has not caught up with a new playlist
+		r.meta = nil
+		return
+	}
+	playing := playlist[index]
+
+	if r.meta == nil {
+		r.meta = playing
+		r.elapsed = 0
+		return
+	}
+
+	if status.State == videoplayer.PlayerPlaying {
+		r.elapsed += now.Sub(lastTick)
+	}
+
+	if r.meta.DocumentID != playing.DocumentID {
+		// the player moved on by itself at the end of a video, play it again if it has not been shown long enough
+		previous := playlistIndex(playlist, r.meta.DocumentID)
+		duration := v.displayDuration(r.meta, nil)
+		if previous >= 0 && duration > 0 && r.elapsed < duration {
+			err = v.VideoPlayer.PlayIndex(previous)
+			if err != nil {
+				logger.Printf("advance - failed to replay token %s %v", r.meta.DocumentID, err)
+			}
+			return
+		}
+		// the player always moves on to the following file, shuffled orders pick the next token themselves
+		if order, _ := v.playOrder(); order != fstore.PlayOrderSequential && previous >= 0 {
+			err = v.VideoPlayer.PlayIndex(v.nextIndex(playlist, previous))
+			if err != nil {
+				logger.Printf("advance - failed to play next token %v", err)
+			}
+			r.meta = nil
+			return
+		}
+		r.meta = playing
+		r.elapsed = 0
+		return
+	}
+
+	duration := v.displayDuration(playing, status)
+	due := duration > 0 && r.elapsed >= duration
+	if order, _ := v.playOrder(); duration == 0 && order != fstore.PlayOrderSequential && status.Duration > 0 {
+		// move on just before the player reaches the end of the video by itself
+		due = status.Duration-status.Position <= rotationInterval.Seconds()
+	}
+	if !due || len(playlist) == 1 {
+		return
+	}
+
+	logger.Printf("advance - token %s shown for %v, playing next token", playing.DocumentID, r.elapsed)
+	err = v.playNext(playlist, index)
+	if err != nil {
+		logger.Printf("advance - failed to play next token %v", err)
+		return
+	}
+	r.meta = nil
+	v.notifyStateChange()
+}
+
+// playNext moves on from the token at index of playlist to the next token in the plaque play order
+func (v *Viewer) playNext(playlist []*fstore.FirestoreTokenMeta, index int) error {
+	if order, _ := v.playOrder(); order == fstore.PlayOrderSequential {
+		return v.VideoPlayer.Next()
+	}
+	return v.VideoPlayer.PlayIndex(v.nextIndex(playlist, index))
+}
+
+// jump runs a command which changes the playlist position, the next tick starts timing whatever the player is then playing
+// the rotation is locked while the command runs so a tick in between does not mistake the jump for the end of a video
+func (v *Viewer) jump(command func() error) error {
+	v.rotation.lock.Lock()
+	defer v.rotation.lock.Unlock()
+	v.rotation.meta = nil
+	return command()
+}
+
+// timesPlaylist reports whether advance has to follow the player for playlist
+// it does for display durations, images and shuffled orders, videos played in order at their natural length need nothing from it
+func (v *Viewer) timesPlaylist(playlist []*fstore.FirestoreTokenMeta) bool {
+	if order, _ := v.playOrder(); order != fstore.PlayOrderSequential {
+		return true
+	}
+	plaque, err := v.currentPlaque()
+	if err == nil && plaque.Plaque.DefaultDisplayDuration > 0 {
+		return true
+	}
+	for _, meta := range playlist {
+		if meta.TokenMeta.DisplayDuration > 0 || v.isImage(meta) {
+			return true
+		}
+	}
+	return false
+}
+
+// isImage reports whether the media of meta is a still image, from its probe report if there is one or else its media type
+func (v *Viewer) isImage(meta *fstore.FirestoreTokenMeta) bool {
+	if report := v.mediaReport(meta.MediaFileName()); report != nil && report.Info != nil {
+		return report.Info.Still
+	}
+	return imageMediaTypes[strings.ToLower(meta.TokenMeta.MediaType)]
+}
+
+// displayDuration returns how long meta is shown before the next token, 0 if it plays at its natural length
+// the token duration overrides the plaque default, images fall back to defaultImageDuration if status shows the file has no length
+func (v *Viewer) displayDuration(meta *fstore.FirestoreTokenMeta, status *videoplayer.PlayerStatus) time.Duration {
+	if meta.TokenMeta.DisplayDuration > 0 {
+		return time.Duration(meta.TokenMeta.DisplayDuration) * time.Second
+	}
+	plaque, err := v.currentPlaque()
+	if err == nil && plaque.Plaque.DefaultDisplayDuration > 0 {
+		return time.Duration(plaque.Plaque.DefaultDisplayDuration) * time.Second
+	}
+	if status != nil && status.Duration <= 0 {
+		return defaultImageDuration
+	}
+	return 0
+}
+
+// playlistIndex returns the position of the token meta with documentID in playlist, -1 if not found
+func playlistIndex(playlist []*fstore.FirestoreTokenMeta, documentID string) int {
+	for i, meta := range playlist {
+		if meta.DocumentID == documentID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,167 @@
+package viewer
+
+import (
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/videoplayer"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotation(t *testing.T) {
+	// newRotationViewer returns a viewer playing a playlist of metas, each displayed for the given seconds
+	newRotationViewer := func(t *testing.T, defaultDuration int, durations ...int) (*Viewer, *videoplayer.VideoPlayerStub) {
+		v := NewTestViewer(t.TempDir())
+		player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+		metas := make([]*fstore.FirestoreTokenMeta, 0, len(durations))
+		ids := make([]string, 0, len(durations))
+		for i, duration := range durations {
+			id := string(rune('a' + i))
+			metas = append(metas, &fstore.FirestoreTokenMeta{DocumentID: id, TokenMeta: fstore.TokenMeta{MediaID: id, MediaType: ".mp4", DisplayDuration: duration}})
+			ids = append(ids, id)
+		}
+		if err := v.setPlaque(&fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: ids, DefaultDisplayDuration: defaultDuration}}); err != nil {
+			t.Fatal(err)
+		}
+		player.PlayFilesWaitGroup.Add(1)
+		if err := player.PlayFiles(v.mediaFilepaths(metas)); err != nil {
+			t.Fatal(err)
+		}
+		v.setPlaylist(metas)
+		return v, player
+	}
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	t.Run("advances after the token display duration", func(t *testing.T) {
+		a := assert.New(t)
+		v, player := newRotationViewer(t, 0, 30, 0)
+		player.Duration = 120
+
+		v.advance(at(0))
+		v.advance(at(29))
+		a.Equal(0, player.ActiveIndex)
+		v.advance(at(30))
+		a.Equal(1, player.ActiveIndex)
+
+		// tokens without a duration play videos at their natural length
+		v.advance(at(31))
+		v.advance(at(500))
+		a.Equal(1, player.ActiveIndex)
+	})
+
+	t.Run("uses the plaque default when the token has no duration", func(t *testing.T) {
+		a := assert.New(t)
+		v, player := newRotationViewer(t, 20, 0, 5)
+		player.Duration = 120
+
+		v.advance(at(0))
+		v.advance(at(20))
+		a.Equal(1, player.ActiveIndex)
+		v.advance(at(21))
+		v.advance(at(26))
+		a.Equal(0, player.ActiveIndex)
+	})
+
+	t.Run("shows images for the default image duration", func(t *testing.T) {
+		a := assert.New(t)
+		v, player := newRotationViewer(t, 0, 0, 0)
+		images := make([]*fstore.FirestoreTokenMeta, 0)
+		for _, meta := range v.currentPlaylist() {
+			image := *meta
+			image.TokenMeta.MediaType = ".png"
+			images = append(images, &image)
+		}
+		player.PlayFilesWaitGroup.Add(1)
+		a.NoError(player.PlayFiles(v.mediaFilepaths(images)))
+		v.setPlaylist(images)
+
+		v.advance(at(0))
+		v.advance(at(9))
+		a.Equal(0, player.ActiveIndex)
+		v.advance(at(10))
+		a.Equal(1, player.ActiveIndex)
+	})
+
+	t.Run("does not count time paused", func(t *testing.T) {
+		a := assert.New(t)
+		v, player := newRotationViewer(t, 0, 30, 0)
+		player.Duration = 120
+
+		v.advance(at(0))
+		v.advance(at(10))
+		a.NoError(v.Pause())
+		v.advance(at(100))
+		a.Equal(0, player.ActiveIndex)
+		a.NoError(v.Resume())
+		v.advance(at(119))
+		a.Equal(0, player.ActiveIndex)
+		v.advance(at(120))
+		a.Equal(1, player.ActiveIndex)
+	})
+
+	t.Run("plays a short video again until its duration is up", func(t *testing.T) {
+		a := assert.New(t)
+		v, player := newRotationViewer(t, 0, 30, 0)
+		player.Duration = 12
+
+		v.advance(at(0))
+		v.advance(at(12))
+		// player reaches the end of the video and moves on by itself
+		player.ActiveIndex = 1
+		v.advance(at(13))
+		a.Equal(0, player.ActiveIndex)
+		v.advance(at(30))
+		a.Equal(1, player.ActiveIndex)
+	})
+
+	t.Run("only asks the player for its status when timing is needed", func(t *testing.T) {
+		a := assert.New(t)
+		v, player := newRotationViewer(t, 0, 0, 0)
+		player.Duration = 120
+		counter := &statusCountingPlayer{VideoPlayerStub: player}
+		v.VideoPlayer = counter
+
+		// videos played in order at their natural length are left to the player
+		v.advance(at(0))
+		v.advance(at(500))
+		a.Zero(counter.statusCalls)
+
+		plaque, err := v.currentPlaque()
+		a.NoError(err)
+		shuffled := *plaque
+		shuffled.Plaque.PlayOrder = fstore.PlayOrderShuffle
+		a.NoError(v.setPlaque(&shuffled))
+		v.advance(at(501))
+		a.Equal(1, counter.statusCalls)
+	})
+
+	t.Run("restarts timing after a manual jump", func(t *testing.T) {
+		a := assert.New(t)
+		v, player := newRotationViewer(t, 0, 30, 30)
+		player.Duration = 120
+
+		v.advance(at(0))
+		v.advance(at(20))
+		a.NoError(v.Next())
+		v.advance(at(21))
+		v.advance(at(50))
+		a.Equal(1, player.ActiveIndex)
+		v.advance(at(51))
+		a.Equal(0, player.ActiveIndex)
+	})
+}
+
+// statusCountingPlayer counts the status requests made to the player
+type statusCountingPlayer struct {
+	*videoplayer.VideoPlayerStub
+	statusCalls int
+}
+
+func (p *statusCountingPlayer) GetStatus() (*videoplayer.PlayerStatus, error) {
+	p.statusCalls++
+	return p.VideoPlayerStub.GetStatus()
+}
@@ -0,0 +1,169 @@
+package viewer
+
+import (
+	"context"
+	"fmt"
+	"jkurtz678/moda-viewer/fstore"
+	"reflect"
+	"time"
+)
+
+// scheduleInterval is how often the viewer checks whether the plaque schedule selects different tokens, windows are set to the minute
+const scheduleInterval = 15 * time.Second
+
+// scheduleSelection is what the plaque schedule displays at a point in time
+type scheduleSelection struct {
+	Window          int      // index of the schedule window in effect, -1 outside every window
+	TokenMetaIDList []string // token meta document ids to display
+	DisplayOff      bool     // nothing should be displayed
+}
+
+// clock returns the current time, from v.now if set so tests can control the schedule
+func (v *Viewer) clock() time.Time {
+	if v.now != nil {
+		return v.now()
+	}
+	return time.Now()
+}
+
+// runSchedule reloads the plaque tokens whenever a schedule window starts or ends, until ctx is done
+func (v *Viewer) runSchedule(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			v.checkSchedule(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkSchedule reloads the plaque tokens if the schedule now selects something other than what was last loaded
+func (v *Viewer) checkSchedule(ctx context.Context) {
+	plaque, err := v.currentPlaque()
+	if err != nil {
+		return
+	}
+	selection := v.plaqueSchedule(plaque)
+
+	v.stateLock.Lock()
+	applied := v.schedule
+	v.stateLock.Unlock()
+	// nothing has loaded yet, startup or a plaque change will load the current selection
+	if applied == nil || reflect.DeepEqual(*applied, selection) {
+		return
+	}
+
+	logger.Printf("checkSchedule - schedule window changed from %v to %v, reloading tokens", applied.Window, selection.Window)
+	v.reload(ctx, plaque)
+}
+
+// scheduledOff returns true if the last loaded schedule selection turned the display off
+func (v *Viewer) scheduledOff() bool {
+	v.stateLock.Lock()
+	defer v.stateLock.Unlock()
+	return v.schedule != nil && v.schedule.DisplayOff
+}
+
+// plaqueSchedule returns what plaque displays now, problems with its schedule are logged once when found rather than on every check
+func (v *Viewer) plaqueSchedule(plaque *fstore.FirestorePlaque) scheduleSelection {
+	selection, problems := selectSchedule(&plaque.Plaque, v.clock())
+
+	v.stateLock.Lock()
+	logged := make(map[string]bool, len(v.loggedProblems))
+	for _, problem := range v.loggedProblems {
+		logged[problem] = true
+	}
+	v.loggedProblems = problems
+	v.stateLock.Unlock()
+
+	for _, problem := range problems {
+		if !logged[problem] {
+			logger.Printf("plaqueSchedule - %s", problem)
+		}
+	}
+	return selection
+}
+
+// selectSchedule returns what plaque displays at now and the problems found with its schedule, windows with an invalid time are ignored
+func selectSchedule(plaque *fstore.Plaque, now time.Time) (scheduleSelection, []string) {
+	selection := scheduleSelection{Window: -1, TokenMetaIDList: plaque.TokenMetaIDList}
+	problems := make([]string, 0)
+	if plaque.Schedule == nil {
+		return selection, problems
+	}
+
+	// an empty name would load UTC rather than local time
+	loc := time.Local
+	if plaque.Schedule.Timezone != "" {
+		scheduleLoc, err := time.LoadLocation(plaque.Schedule.Timezone)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid timezone %q, using local time: %v", plaque.Schedule.Timezone, err))
+		} else {
+			loc = scheduleLoc
+		}
+	}
+	now = now.In(loc)
+
+	// every window is checked so the problems found do not depend on which window is in effect
+	for i, window := range plaque.Schedule.Windows {
+		active, err := windowActive(window, now)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("ignoring schedule window %v %q: %v", i, window.Name, err))
+			continue
+		}
+		if !active || selection.Window >= 0 {
+			continue
+		}
+		selection.Window = i
+		selection.DisplayOff = window.DisplayOff
+		selection.TokenMetaIDList = window.TokenMetaIDList
+		if window.DisplayOff {
+			selection.TokenMetaIDList = nil
+		}
+	}
+	return selection, problems
+}
+
+// windowActive returns true if now, in the schedule timezone, is within window
+func windowActive(window fstore.ScheduleWindow, now time.Time) (bool, error) {
+	start, err := parseClock(window.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseClock(window.End)
+	if err != nil {
+		return false, err
+	}
+	minute := now.Hour()*60 + now.Minute()
+
+	if start < end {
+		return onWeekday(window, now.Weekday()) && minute >= start && minute < end, nil
+	}
+	// the window continues past midnight, into the day after a day it starts on
+	yesterday := now.AddDate(0, 0, -1).Weekday()
+	return (onWeekday(window, now.Weekday()) && minute >= start) || (onWeekday(window, yesterday) && minute < end), nil
+}
+
+func onWeekday(window fstore.ScheduleWindow, day time.Weekday) bool {
+	if len(window.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range window.Weekdays {
+		if time.Weekday(d) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock returns the minutes since midnight of a 'HH:MM' time
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,160 @@
+package viewer
+
+import (
+	"bytes"
+	"context"
+	"jkurtz678/moda-viewer/display"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/videoplayer"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata" // schedule timezones do not depend on the zoneinfo of the test machine
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectSchedule(t *testing.T) {
+	a := assert.New(t)
+	ny, err := time.LoadLocation("America/New_York")
+	a.NoError(err)
+
+	plaque := &fstore.Plaque{
+		TokenMetaIDList: []string{"day"},
+		Schedule: &fstore.Schedule{
+			Timezone: "America/New_York",
+			Windows: []fstore.ScheduleWindow{
+				{Name: "broken", Start: "25:00", End: "26:00", TokenMetaIDList: []string{"broken"}},
+				{Name: "friday event", Weekdays: []int{int(time.Friday)}, Start: "18:00", End: "02:00", TokenMetaIDList: []string{"event"}},
+				{Name: "night", Start: "22:00", End: "08:00", DisplayOff: true},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want scheduleSelection
+	}{
+		{"outside every window", time.Date(2022, 6, 10, 12, 0, 0, 0, ny), scheduleSelection{Window: -1, TokenMetaIDList: []string{"day"}}},
+		{"friday evening", time.Date(2022, 6, 10, 18, 0, 0, 0, ny), scheduleSelection{Window: 1, TokenMetaIDList: []string{"event"}}},
+		{"earlier windows win", time.Date(2022, 6, 10, 23, 0, 0, 0, ny), scheduleSelection{Window: 1, TokenMetaIDList: []string{"event"}}},
+		{"friday window continues past midnight", time.Date(2022, 6, 11, 1, 59, 0, 0, ny), scheduleSelection{Window: 1, TokenMetaIDList: []string{"event"}}},
+		{"saturday night", time.Date(2022, 6, 11, 2, 0, 0, 0, ny), scheduleSelection{Window: 2, DisplayOff: true}},
+		{"thursday night", time.Date(2022, 6, 9, 23, 0, 0, 0, ny), scheduleSelection{Window: 2, DisplayOff: true}},
+		{"end is exclusive", time.Date(2022, 6, 9, 8, 0, 0, 0, ny), scheduleSelection{Window: -1, TokenMetaIDList: []string{"day"}}},
+		{"times are converted to the schedule timezone", time.Date(2022, 6, 10, 22, 30, 0, 0, time.UTC), scheduleSelection{Window: 1, TokenMetaIDList: []string{"event"}}},
+	}
+	for _, tt := range tests {
+		selection, problems := selectSchedule(plaque, tt.now)
+		a.Equal(tt.want, selection, tt.name)
+		a.Equal([]string{`ignoring schedule window 0 "broken": invalid time "25:00", expected HH:MM`}, problems, tt.name)
+	}
+
+	selection, problems := selectSchedule(&fstore.Plaque{TokenMetaIDList: []string{"day"}}, time.Now())
+	a.Equal(scheduleSelection{Window: -1, TokenMetaIDList: []string{"day"}}, selection)
+	a.Empty(problems)
+}
+
+func TestScheduleProblems(t *testing.T) {
+	a := assert.New(t)
+	var logged bytes.Buffer
+	logger.SetOutput(&logged)
+	defer logger.SetOutput(os.Stdout)
+
+	v := NewTestViewer(t.TempDir())
+	plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{
+		TokenMetaIDList: []string{"day"},
+		Schedule:        &fstore.Schedule{Timezone: "Mars/Olympus_Mons"},
+	}}
+
+	// an invalid timezone is logged when first found, not on every check
+	for i := 0; i < 3; i++ {
+		a.Equal(scheduleSelection{Window: -1, TokenMetaIDList: []string{"day"}}, v.plaqueSchedule(plaque))
+	}
+	a.Equal(1, strings.Count(logged.String(), `invalid timezone "Mars/Olympus_Mons"`))
+
+	// it is logged again if the plaque is fixed and then broken again
+	plaque.Plaque.Schedule.Timezone = "America/New_York"
+	v.plaqueSchedule(plaque)
+	plaque.Plaque.Schedule.Timezone = "Mars/Olympus_Mons"
+	v.plaqueSchedule(plaque)
+	a.Equal(2, strings.Count(logged.String(), `invalid timezone "Mars/Olympus_Mons"`))
+}
+
+func TestSchedule(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	v := NewTestViewer(t.TempDir())
+	player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+	screen := &display.DisplayControllerStub{}
+	v.Display = screen
+	now := time.Date(2022, 6, 10, 12, 0, 0, 0, time.UTC)
+	v.now = func() time.Time { return now }
+
+	plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{
+		WalletAddress:   "test",
+		TokenMetaIDList: []string{"m1", "m2"},
+		Schedule: &fstore.Schedule{
+			Timezone: "UTC",
+			Windows: []fstore.ScheduleWindow{
+				{Name: "evening", Start: "18:00", End: "22:00", TokenMetaIDList: []string{"m3"}},
+				{Name: "night", Start: "22:00", End: "08:00", DisplayOff: true},
+			},
+		},
+	}}
+	a.NoError(v.setPlaque(plaque))
+	for _, id := range []string{"m1", "m2", "m3"} {
+		a.NoError(v.setTokenMeta(&fstore.FirestoreTokenMeta{DocumentID: id, TokenMeta: fstore.TokenMeta{Name: id, MediaID: id, MediaType: ".mp4"}}))
+	}
+	playlistIDs := func() []string {
+		ids := make([]string, 0)
+		for _, meta := range v.currentPlaylist() {
+			ids = append(ids, meta.DocumentID)
+		}
+		return ids
+	}
+
+	player.PlayFilesWaitGroup.Add(1)
+	v.reload(ctx, plaque)
+	a.Equal(ViewerStateDisplay, v.GetViewerState().State)
+	a.Equal([]string{"m1", "m2"}, playlistIDs())
+	a.True(screen.Powered)
+
+	// nothing changes until a window starts
+	now = time.Date(2022, 6, 10, 17, 59, 0, 0, time.UTC)
+	v.checkSchedule(ctx)
+	a.Equal([]string{"m1", "m2"}, playlistIDs())
+
+	now = time.Date(2022, 6, 10, 18, 0, 0, 0, time.UTC)
+	v.checkSchedule(ctx)
+	a.Equal([]string{"m3"}, playlistIDs())
+	a.Equal("m3", v.GetViewerState().ActiveTokenMeta.DocumentID)
+
+	// the display off window shows the logo
+	now = time.Date(2022, 6, 10, 23, 0, 0, 0, time.UTC)
+	v.checkSchedule(ctx)
+	state := v.GetViewerState()
+	a.Equal(ViewerStateScheduledOff, state.State)
+	a.Equal("p1", state.Plaque.DocumentID)
+	a.Empty(playlistIDs())
+	a.Equal([]string{"moda-logo.png"}, player.ActivePlaylistFilepaths)
+	a.False(screen.Powered)
+	a.Equal(DisplayData{Controlled: true, On: false}, v.DisplayPower())
+
+	// staff can turn the display on, it stays on until the schedule next changes power
+	a.NoError(v.SetDisplayPower(ctx, true))
+	now = time.Date(2022, 6, 11, 1, 0, 0, 0, time.UTC)
+	v.checkSchedule(ctx)
+	a.True(screen.Powered)
+	a.Equal(3, screen.Calls)
+
+	// tokens come back in the morning
+	now = time.Date(2022, 6, 11, 8, 0, 0, 0, time.UTC)
+	player.PlayFilesWaitGroup.Add(1)
+	v.checkSchedule(ctx)
+	a.Equal(ViewerStateDisplay, v.GetViewerState().State)
+	a.Equal([]string{"m1", "m2"}, playlistIDs())
+	a.True(screen.Powered)
+}
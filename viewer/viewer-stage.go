@@ -0,0 +1,289 @@
+package viewer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"jkurtz678/moda-viewer/fstore"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// stageRetryInterval is how long prefetching waits after a token failed before trying again
+const stageRetryInterval = time.Minute
+
+// ErrEmptyStage is returned by StagePlaylist for an empty token list
+var ErrEmptyStage = errors.New("staged token list is empty")
+
+// StageSource is where a staged token list came from
+type StageSource string
+
+const (
+	StageSourcePlaque = StageSource("plaque") // staged_token_meta_id_list of the plaque
+	StageSourceAPI    = StageSource("api")    // StagePlaylist, takes precedence over the plaque
+)
+
+// StageData is the prefetch progress of a staged token list, which replaces the plaque token list once all its media is local
+type StageData struct {
+	Source          StageSource    `json:"source"`
+	TokenMetaIDList []string       `json:"token_meta_id_list"`
+	TokensTotal     int            `json:"tokens_total"`
+	TokensReady     int            `json:"tokens_ready"`       // tokens whose metadata and media are local
+	Failures        []TokenFailure `json:"failures,omitempty"` // tokens that failed in the last attempt, retried after stageRetryInterval
+}
+
+// StagePlaylist downloads the tokens of tokenMetaIDList in the background without interrupting playback
+// once every token is local the list replaces the plaque token list, a list staged with the api replaces any staged before it
+func (v *Viewer) StagePlaylist(tokenMetaIDList []string) error {
+	if len(tokenMetaIDList) == 0 {
+		return ErrEmptyStage
+	}
+	v.stageLock.Lock()
+	v.apiStage = append(make([]string, 0, len(tokenMetaIDList)), tokenMetaIDList...)
+	v.stageLock.Unlock()
+	v.restartStaging()
+	return nil
+}
+
+// CancelStage forgets the token list staged with the api, a list staged by the plaque is prefetched instead
+func (v *Viewer) CancelStage() {
+	v.stageLock.Lock()
+	v.apiStage = nil
+	v.stageLock.Unlock()
+	v.restartStaging()
+}
+
+// Stage returns the prefetch progress of the staged token list, nil if nothing is staged
+func (v *Viewer) Stage() *StageData {
+	v.stageLock.Lock()
+	defer v.stageLock.Unlock()
+	return v.stage
+}
+
+// runStaging prefetches staged and scheduled tokens whenever the plaque or staged list changes, until ctx is done
+// prefetching is retried after stageRetryInterval while any token fails
+func (v *Viewer) runStaging(ctx context.Context) {
+	wake := v.stagingWake()
+	for {
+		var retry <-chan time.Time
+		if !v.prefetch(ctx) {
+			retry = time.After(stageRetryInterval)
+		}
+		select {
+		case <-wake:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stagingWake returns the channel which wakes runStaging, buffered so waking never blocks
+func (v *Viewer) stagingWake() chan struct{} {
+	v.stageLock.Lock()
+	defer v.stageLock.Unlock()
+	if v.stageWake == nil {
+		v.stageWake = make(chan struct{}, 1)
+	}
+	return v.stageWake
+}
+
+// wakeStaging signals runStaging to prefetch again once it finishes any prefetch in progress
+func (v *Viewer) wakeStaging() {
+	select {
+	case v.stagingWake() <- struct{}{}:
+	default:
+	}
+}
+
+// restartStaging cancels any prefetch in progress and signals runStaging to prefetch again
+func (v *Viewer) restartStaging() {
+	v.stageLock.Lock()
+	if v.stageCancel != nil {
+		v.stageCancel()
+	}
+	v.stageLock.Unlock()
+	v.wakeStaging()
+}
+
+// stagedTokenMetaIDs returns the staged token list and where it came from, the api list takes precedence over the plaque
+func (v *Viewer) stagedTokenMetaIDs(plaque *fstore.FirestorePlaque) (StageSource, []string) {
+	v.stageLock.Lock()
+	defer v.stageLock.Unlock()
+	if len(v.apiStage) > 0 {
+		return StageSourceAPI, v.apiStage
+	}
+	return StageSourcePlaque, plaque.Plaque.StagedTokenMetaIDList
+}
+
+// setStage replaces the staged list progress, the stored value is never modified in place
+func (v *Viewer) setStage(stage *StageData) {
+	v.stageLock.Lock()
+	v.stage = stage
+	v.stageLock.Unlock()
+	v.notifyStateChange()
+}
+
+// prefetch downloads the tokens of schedule windows not showing now and of the staged list, then swaps in the staged list
+// returns false if any token failed, or the swap failed, so prefetching is retried
+func (v *Viewer) prefetch(ctx context.Context) bool {
+	plaque, err := v.currentPlaque()
+	if err != nil {
+		return false
+	}
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	v.stageLock.Lock()
+	v.stageCancel = cancel
+	v.stageLock.Unlock()
+
+	// tokens of the other schedule windows are downloaded so a window starts without loading
+	v.stateLock.Lock()
+	showing := make(map[string]bool)
+	if v.schedule != nil {
+		for _, id := range v.schedule.TokenMetaIDList {
+			showing[id] = true
+		}
+	}
+	v.stateLock.Unlock()
+	scheduled := make([]string, 0)
+	for _, id := range plaqueTokenMetaIDs(&plaque.Plaque) {
+		if !showing[id] {
+			scheduled = append(scheduled, id)
+		}
+	}
+	complete := v.saveSwap(ctx, plaque.DocumentID)
+	if len(scheduled) > 0 {
+		_, failures := v.fetchTokens(fetchCtx, scheduled, nil)
+		complete = complete && len(failures) == 0
+	}
+
+	source, ids := v.stagedTokenMetaIDs(plaque)
+	if len(ids) == 0 {
+		v.setStage(nil)
+		return complete
+	}
+	logger.Printf("prefetch - prefetching %v staged tokens from %s", len(ids), source)
+	stage := &StageData{Source: source, TokenMetaIDList: ids, TokensTotal: len(ids)}
+	v.setStage(stage)
+	ready, failures := v.fetchTokens(fetchCtx, ids, func(ready int) {
+		progress := *stage
+		progress.TokensReady = ready
+		v.setStage(&progress)
+	})
+	if fetchCtx.Err() != nil {
+		return false
+	}
+	if len(failures) > 0 {
+		logger.Printf("prefetch - %v of %v staged tokens failed, retrying in %v", len(failures), len(ids), stageRetryInterval)
+		progress := *stage
+		progress.TokensReady = ready
+		progress.Failures = failures
+		v.setStage(&progress)
+		return false
+	}
+
+	// the swap uses ctx rather than fetchCtx, so it is not cancelled by the plaque change it makes
+	err = v.swapStage(ctx, plaque, source, ids)
+	if err != nil {
+		logger.Printf("prefetch - staged tokens are local but the swap did not complete, retrying in %v: %v", stageRetryInterval, err)
+		return false
+	}
+	return complete
+}
+
+// fetchTokens loads the metadata and media of tokenMetaIDList, returning how many tokens are local and the failures of the rest
+// progress is called with the count of local tokens each time a token finishes, if set
+func (v *Viewer) fetchTokens(ctx context.Context, tokenMetaIDList []string, progress func(ready int)) (int, []TokenFailure) {
+	metas, failures, err := v.loadTokenMetas(ctx, tokenMetaIDList)
+	if err != nil {
+		for _, id := range tokenMetaIDList {
+			failures = append(failures, TokenFailure{TokenMetaID: id, Reason: FailureMissingMetadata, Error: err.Error()})
+		}
+		return 0, failures
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	ready := 0
+	for _, meta := range metas {
+		wg.Add(1)
+		go func(meta *fstore.FirestoreTokenMeta) {
+			defer wg.Done()
+			err := v.downloadMedia(ctx, meta)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				failures = append(failures, mediaFailure(meta, err))
+				return
+			}
+			ready++
+			if progress != nil {
+				progress(ready)
+			}
+		}(meta)
+	}
+	wg.Wait()
+	return ready, failures
+}
+
+// swapStage makes the staged list the plaque token list, then saves it to the database so the plaque listener does not revert it
+// the swap is played before it is saved, so it also swaps in offline and the listener echo of the saved plaque matches the local plaque
+// only the token list of the local plaque is swapped, other changes made while the staged list was prefetched are kept
+// a list staged by the plaque is cleared from the plaque, a list staged with the api is forgotten unless it was replaced meanwhile
+func (v *Viewer) swapStage(ctx context.Context, plaque *fstore.FirestorePlaque, source StageSource, ids []string) error {
+	patch := &fstore.PlaquePatch{TokenMetaIDList: &ids}
+	if source == StageSourcePlaque {
+		patch.Clear = []fstore.PlaqueField{fstore.PlaqueStagedTokenMetaIDList}
+	}
+	logger.Printf("swapStage - swapping in %v staged tokens from %s", len(ids), source)
+
+	v.stageLock.Lock()
+	if source == StageSourceAPI && reflect.DeepEqual(v.apiStage, ids) {
+		v.apiStage = nil
+	}
+	v.stage = nil
+	// a plaque staged list cleared by an earlier unsaved swap stays cleared
+	if v.unsavedSwap != nil && len(patch.Clear) == 0 {
+		patch.Clear = v.unsavedSwap.Clear
+	}
+	v.unsavedSwap = patch
+	v.stageLock.Unlock()
+	err := v.changePlaque(ctx, func(localPlaque *fstore.FirestorePlaque) *fstore.FirestorePlaque {
+		swapped := *localPlaque
+		swapped.Plaque.TokenMetaIDList = ids
+		if source == StageSourcePlaque {
+			swapped.Plaque.StagedTokenMetaIDList = nil
+		}
+		return &swapped
+	})
+	if err != nil {
+		return err
+	}
+	if !v.saveSwap(ctx, plaque.DocumentID) {
+		return fmt.Errorf("Viewer.swapStage - swapped tokens are playing but could not be saved to the plaque")
+	}
+	return nil
+}
+
+// saveSwap saves the last swap to the database if it has not been saved, returning false if it could not be
+func (v *Viewer) saveSwap(ctx context.Context, documentID string) bool {
+	v.stageLock.Lock()
+	patch := v.unsavedSwap
+	v.stageLock.Unlock()
+	if patch == nil {
+		return true
+	}
+	err := v.DBClient.UpdatePlaque(ctx, documentID, patch)
+	if err != nil {
+		logger.Printf("saveSwap - failed to save swapped tokens to plaque, retrying in %v: %v", stageRetryInterval, err)
+		return false
+	}
+	v.stageLock.Lock()
+	if v.unsavedSwap == patch {
+		v.unsavedSwap = nil
+	}
+	v.stageLock.Unlock()
+	return true
+}
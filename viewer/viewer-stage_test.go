@@ -0,0 +1,266 @@
+package viewer
+
+import (
+	"context"
+	"errors"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/storage"
+	"jkurtz678/moda-viewer/videoplayer"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyMediaClient creates empty media files like the storage stub, failing downloads of the files in fail
+type flakyMediaClient struct {
+	storage.FirebaseStorageClientStub
+	lock      sync.Mutex
+	fail      map[string]bool
+	downloads []string
+}
+
+func (c *flakyMediaClient) DownloadFileFromArchive(ctx context.Context, fileURI string, checksum storage.Checksum) error {
+	c.lock.Lock()
+	failed := c.fail[fileURI]
+	c.downloads = append(c.downloads, fileURI)
+	c.lock.Unlock()
+	if failed {
+		return errors.New("download failed")
+	}
+	return c.FirebaseStorageClientStub.DownloadFileFromArchive(ctx, fileURI, checksum)
+}
+
+func (c *flakyMediaClient) downloaded(fileURI string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return containsString(c.downloads, fileURI)
+}
+
+func TestStage(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	client, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	v.DBClient = client
+	media := &flakyMediaClient{FirebaseStorageClientStub: storage.FirebaseStorageClientStub{MediaDir: tmpdir}, fail: map[string]bool{"s3.mp4": true}}
+	v.MediaClient = media
+	player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+
+	ids := make([]string, 0)
+	for _, name := range []string{"1", "2", "3", "4"} {
+		meta, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "token " + name, MediaID: "s" + name, MediaType: ".mp4"})
+		a.NoError(err)
+		ids = append(ids, meta.DocumentID)
+	}
+	// the schedule window never starts, its token is prefetched so it would start without loading
+	plaque, err := client.CreatePlaque(ctx, &fstore.Plaque{
+		WalletAddress:   "test",
+		TokenMetaIDList: ids[:1],
+		Schedule:        &fstore.Schedule{Windows: []fstore.ScheduleWindow{{Start: "10:00", End: "11:00", Weekdays: []int{7}, TokenMetaIDList: ids[3:]}}},
+	})
+	a.NoError(err)
+	a.NoError(v.setPlaque(plaque))
+	player.PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(ctx, plaque))
+	playlistIDs := func() []string {
+		ids := make([]string, 0)
+		for _, meta := range v.currentPlaylist() {
+			ids = append(ids, meta.DocumentID)
+		}
+		return ids
+	}
+
+	a.Equal(ErrEmptyStage, v.StagePlaylist(nil))
+
+	// a staged list with a failed token is not swapped in, playback carries on
+	a.NoError(v.StagePlaylist(ids[1:3]))
+	a.False(v.prefetch(ctx))
+	a.True(media.downloaded("s4.mp4"))
+	stage := v.Stage()
+	a.Equal(StageSourceAPI, stage.Source)
+	a.Equal(2, stage.TokensTotal)
+	a.Equal(1, stage.TokensReady)
+	a.Len(stage.Failures, 1)
+	a.Equal(FailureDownloadError, stage.Failures[0].Reason)
+	a.Equal(ids[:1], playlistIDs())
+	a.Equal(stage, v.GetViewerState().Staged)
+	remote, err := client.GetPlaque(ctx, plaque.DocumentID)
+	a.NoError(err)
+	a.Equal(ids[:1], remote.Plaque.TokenMetaIDList)
+
+	// once everything staged is local it replaces the plaque token list
+	media.lock.Lock()
+	media.fail = nil
+	media.lock.Unlock()
+	a.True(v.prefetch(ctx))
+	a.Nil(v.Stage())
+	a.Equal(ids[1:3], playlistIDs())
+	remote, err = client.GetPlaque(ctx, plaque.DocumentID)
+	a.NoError(err)
+	a.Equal(ids[1:3], remote.Plaque.TokenMetaIDList)
+	local, err := v.currentPlaque()
+	a.NoError(err)
+	a.Equal(remote, local)
+
+	// a list staged by the plaque is cleared from the plaque once swapped in
+	a.NoError(client.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{StagedTokenMetaIDList: &[]string{ids[0]}}))
+	remote, err = client.GetPlaque(ctx, plaque.DocumentID)
+	a.NoError(err)
+	a.NoError(v.applyPlaqueChange(ctx, remote))
+	a.Equal(ids[1:3], playlistIDs())
+	a.True(v.prefetch(ctx))
+	a.Equal(ids[:1], playlistIDs())
+	remote, err = client.GetPlaque(ctx, plaque.DocumentID)
+	a.NoError(err)
+	a.Equal(ids[:1], remote.Plaque.TokenMetaIDList)
+	a.Nil(remote.Plaque.StagedTokenMetaIDList)
+
+	// a list staged with the api swaps in while offline, and is saved to the plaque once the database is reachable
+	v.DBClient = &fstore.FstoreClientStub{}
+	a.NoError(v.StagePlaylist(ids[1:2]))
+	a.False(v.prefetch(ctx))
+	a.Nil(v.Stage())
+	a.Equal(ids[1:2], playlistIDs())
+	remote, err = client.GetPlaque(ctx, plaque.DocumentID)
+	a.NoError(err)
+	a.Equal(ids[:1], remote.Plaque.TokenMetaIDList)
+	v.DBClient = client
+	a.True(v.prefetch(ctx))
+	remote, err = client.GetPlaque(ctx, plaque.DocumentID)
+	a.NoError(err)
+	a.Equal(ids[1:2], remote.Plaque.TokenMetaIDList)
+	a.Equal(ids[1:2], playlistIDs())
+}
+
+// countingDBClient counts the token meta list requests made by each load of the plaque tokens
+type countingDBClient struct {
+	fstore.DBClient
+	lock  sync.Mutex
+	loads int
+}
+
+func (c *countingDBClient) GetTokenMetaList(ctx context.Context, documentIDList []string) (*fstore.TokenMetaListResult, error) {
+	c.lock.Lock()
+	c.loads++
+	c.lock.Unlock()
+	return c.DBClient.GetTokenMetaList(ctx, documentIDList)
+}
+
+func (c *countingDBClient) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.loads
+}
+
+func TestStageSwapReloadsOnce(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	local, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	local.PollInterval = 10 * time.Millisecond
+	client := &countingDBClient{DBClient: local}
+	v.DBClient = client
+	player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+
+	ids := make([]string, 0)
+	for _, name := range []string{"1", "2"} {
+		meta, err := local.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "token " + name, MediaID: "s" + name, MediaType: ".mp4"})
+		a.NoError(err)
+		ids = append(ids, meta.DocumentID)
+	}
+	plaque, err := local.CreatePlaque(ctx, &fstore.Plaque{WalletAddress: "test", TokenMetaIDList: ids[:1]})
+	a.NoError(err)
+	a.NoError(v.setPlaque(plaque))
+	player.PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(ctx, plaque))
+	listening := make(chan struct{})
+	go v.DBClient.ListenPlaque(ctx, plaque.DocumentID, func(remote *fstore.FirestorePlaque) error {
+		select {
+		case <-listening:
+		default:
+			close(listening)
+		}
+		return v.applyPlaqueChange(ctx, remote)
+	})
+	<-listening
+
+	// the prefetch loads the staged tokens, the swap loads them once more, and the listener sees the saved plaque without loading again
+	a.NoError(v.StagePlaylist(ids[1:]))
+	before := client.count()
+	a.True(v.prefetch(ctx))
+	a.Equal(before+2, client.count())
+	a.Never(func() bool { return client.count() != before+2 }, 200*time.Millisecond, 10*time.Millisecond)
+	playing := v.currentPlaylist()
+	a.Len(playing, 1)
+	a.Equal(ids[1], playing[0].DocumentID)
+}
+
+// heldMediaClient creates empty media files like the storage stub, holding the first download of hold until release is closed
+type heldMediaClient struct {
+	storage.FirebaseStorageClientStub
+	hold    string
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *heldMediaClient) DownloadFileFromArchive(ctx context.Context, fileURI string, checksum storage.Checksum) error {
+	if fileURI == c.hold {
+		c.once.Do(func() {
+			close(c.started)
+			<-c.release
+		})
+	}
+	return c.FirebaseStorageClientStub.DownloadFileFromArchive(ctx, fileURI, checksum)
+}
+
+func TestStageKeepsPlaqueChanges(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	client, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	v.DBClient = client
+	media := &heldMediaClient{FirebaseStorageClientStub: storage.FirebaseStorageClientStub{MediaDir: tmpdir}, hold: "s2.mp4", started: make(chan struct{}), release: make(chan struct{})}
+	v.MediaClient = media
+
+	ids := make([]string, 0)
+	for _, name := range []string{"1", "2"} {
+		meta, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "token " + name, MediaID: "s" + name, MediaType: ".mp4"})
+		a.NoError(err)
+		ids = append(ids, meta.DocumentID)
+	}
+	plaque, err := client.CreatePlaque(ctx, &fstore.Plaque{WalletAddress: "test", TokenMetaIDList: ids[:1]})
+	a.NoError(err)
+	a.NoError(v.setPlaque(plaque))
+	v.VideoPlayer.(*videoplayer.VideoPlayerStub).PlayFilesWaitGroup.Add(1)
+	a.NoError(v.LoadAndPlayTokens(ctx, plaque))
+
+	// the plaque changes while the staged media downloads
+	a.NoError(v.StagePlaylist(ids[1:]))
+	done := make(chan bool)
+	go func() { done <- v.prefetch(ctx) }()
+	<-media.started
+	changed := *plaque
+	changed.Plaque.Name = "lobby"
+	changed.Plaque.DefaultDisplayDuration = 30
+	a.NoError(v.applyPlaqueChange(ctx, &changed))
+	close(media.release)
+	a.True(<-done)
+
+	// the swap only replaces the token list
+	local, err := v.currentPlaque()
+	a.NoError(err)
+	a.Equal(ids[1:], local.Plaque.TokenMetaIDList)
+	a.Equal("lobby", local.Plaque.Name)
+	a.Equal(30, local.Plaque.DefaultDisplayDuration)
+}
@@ -3,23 +3,51 @@ package viewer
 import (
 	"fmt"
 	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/mediaformat"
+	"jkurtz678/moda-viewer/process"
+	"jkurtz678/moda-viewer/storage"
+	"jkurtz678/moda-viewer/videoplayer"
 )
 
 // ViewerState is the current state of the viewer, corresponds to a different UI shown on the plaque
 type ViewerState string
 
 const (
-	ViewerStateLoading       = ViewerState("loading")         // plaque is actively trying to display media, most time here is downloading media or metadata files
-	ViewerStateQrScan        = ViewerState("qr_scan")         // plaque has no connected wallet address and is displaying a qr code allowing users to scan and gain control
-	ViewerStateNoValidTokens = ViewerState("no_valid_tokens") // plaque is connected to a user but has no assigned tokens
-	ViewerStateDisplay       = ViewerState("display")         // plaque is showing art and running as normal
-	ViewerStateError         = ViewerState("error")           // plaque has encountered an error, will pause breifly and retry
+	ViewerStateLoading         = ViewerState("loading")          // plaque is actively trying to display media, most time here is downloading media or metadata files
+	ViewerStateQrScan          = ViewerState("qr_scan")          // plaque has no connected wallet address and is displaying a qr code allowing users to scan and gain control
+	ViewerStateNoValidTokens   = ViewerState("no_valid_tokens")  // plaque is connected to a user but has no assigned tokens
+	ViewerStateDisplay         = ViewerState("display")          // plaque is showing art and running as normal
+	ViewerStatePartiallyLoaded = ViewerState("partially_loaded") // plaque is showing art, but some of its tokens failed to load and are being retried
+	ViewerStateError           = ViewerState("error")            // plaque has encountered an error, will pause breifly and retry
+	ViewerStateScheduledOff    = ViewerState("scheduled_off")    // plaque schedule has the display off, nothing is shown until the window ends
 )
 
 type ViewerStateData struct {
 	State           ViewerState                `json:"state"`
 	Plaque          *fstore.FirestorePlaque    `json:"plaque"`
 	ActiveTokenMeta *fstore.FirestoreTokenMeta `json:"active_token_meta"`
+	Loading         *LoadingData               `json:"loading,omitempty"`  // only set in ViewerStateLoading
+	Playback        *PlaybackData              `json:"playback,omitempty"` // only set in ViewerStateDisplay and ViewerStatePartiallyLoaded
+	Failures        []TokenFailure             `json:"failures,omitempty"` // only set in ViewerStatePartiallyLoaded
+	Staged          *StageData                 `json:"staged,omitempty"`   // prefetch progress of a staged token list, only set while art is showing
+	Media           *mediaformat.Report        `json:"media,omitempty"`    // format of the active token media and any rendition played instead, only set while art is showing
+}
+
+// PlaybackData is the playback progress of the active token
+type PlaybackData struct {
+	State    videoplayer.PlayerState `json:"state"`
+	Position float64                 `json:"position"` // seconds played of the active token media
+	Duration float64                 `json:"duration"` // length of the active token media in seconds, 0 for images
+}
+
+// LoadingData is the progress of loading media for the plaque tokens, shown on the plaque while art is prepared
+type LoadingData struct {
+	TokensTotal    int            `json:"tokens_total"`    // tokens with metadata whose media is being loaded
+	TokensResolved int            `json:"tokens_resolved"` // tokens whose media is ready or failed to load
+	CurrentFile    string         `json:"current_file"`    // media file being downloaded, empty if none
+	BytesDone      int64          `json:"bytes_done"`      // bytes downloaded by the current batch of downloads
+	BytesTotal     int64          `json:"bytes_total"`     // total bytes of the current batch of downloads, where known
+	Failures       []TokenFailure `json:"failures"`        // tokens that failed to load
 }
 
 // GetViewerState
@@ -38,15 +66,16 @@ func (v *Viewer) GetViewerState() *ViewerStateData {
 	loading := v.loading
 	v.stateLock.Unlock()
 	if loading {
-		return &ViewerStateData{State: ViewerStateLoading}
+		return &ViewerStateData{State: ViewerStateLoading, Loading: v.loadingData()}
 	}
 
-	localPlaque, err := v.ReadLocalPlaqueFile()
+	localPlaque, err := v.currentPlaque()
 	if err != nil {
 		logger.Printf("GetViewerState - failed to get plaque data %v", err)
 		v.stateLock.Lock()
 		v.loadErr = err
 		v.stateLock.Unlock()
+		v.notifyStateChange()
 		return &ViewerStateData{State: ViewerStateError}
 	}
 	// no wallet address means that plaque is not attached to a user, show qr scan
@@ -55,42 +84,124 @@ func (v *Viewer) GetViewerState() *ViewerStateData {
 		return &ViewerStateData{State: ViewerStateQrScan, Plaque: localPlaque}
 	}
 
-	// check if tokens are valid, if none exist show no valid tokens
-	validTokens := v.getValidTokens(localPlaque.Plaque.TokenMetaIDList)
-	if len(validTokens) == 0 {
+	if v.scheduledOff() {
+		return &ViewerStateData{State: ViewerStateScheduledOff, Plaque: localPlaque}
+	}
+
+	// tokens in the playlist have local media, if none exist show no valid tokens
+	if len(v.currentPlaylist()) == 0 {
 		return &ViewerStateData{State: ViewerStateNoValidTokens, Plaque: localPlaque}
 	}
 
-	activeToken, err := v.getActivelyPlayingToken()
+	activeToken, playerStatus, err := v.getActivelyPlayingToken()
 	if err != nil {
 		logger.Printf("GetViewerState - failed to get actively playing token with error: %v", err)
 		return &ViewerStateData{State: ViewerStateLoading, Plaque: localPlaque}
 	}
 
 	// if no states were found above plaque is properly displaying art
-	return &ViewerStateData{State: ViewerStateDisplay, Plaque: localPlaque, ActiveTokenMeta: activeToken}
+	stateData := &ViewerStateData{
+		State:           ViewerStateDisplay,
+		Plaque:          localPlaque,
+		ActiveTokenMeta: activeToken,
+		Playback: &PlaybackData{
+			State:    playerStatus.State,
+			Position: playerStatus.Position,
+			Duration: playerStatus.Duration,
+		},
+		Staged: v.Stage(),
+		Media:  v.mediaReport(activeToken.MediaFileName()),
+	}
+	// art is showing but staff should know some tokens are missing
+	if failures := v.tokenFailures(); len(failures) > 0 {
+		stateData.State = ViewerStatePartiallyLoaded
+		stateData.Failures = failures
+	}
+	return stateData
 }
 
-// getActivelyPlayingToken will return actively playing token meta
-func (v *Viewer) getActivelyPlayingToken() (*fstore.FirestoreTokenMeta, error) {
+// getActivelyPlayingToken will return actively playing token meta and the player status it was found from
+func (v *Viewer) getActivelyPlayingToken() (*fstore.FirestoreTokenMeta, *videoplayer.PlayerStatus, error) {
 	playerStatus, err := v.VideoPlayer.GetStatus()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	filename := playerStatus.Information.Category.Meta.Filename
+	filename := playerStatus.File
 
 	if filename == "" {
-		return nil, fmt.Errorf("PlaqueAPIHandler.getActivelyPlayingToken - empty media id")
+		return nil, nil, fmt.Errorf("PlaqueAPIHandler.getActivelyPlayingToken - empty media id")
 	}
 
 	if filename == "moda-logo.png" {
-		return nil, fmt.Errorf("PlaqueAPIHandler.getActivelyPlayingToken - active token is moda logo, expected on loading")
+		return nil, nil, fmt.Errorf("PlaqueAPIHandler.getActivelyPlayingToken - active token is moda logo, expected on loading")
 	}
 
 	meta, err := v.GetTokenMetaForFileName(filename)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return meta, playerStatus, nil
+}
+
+// loadingData combines token progress recorded by loadMedia with download progress from the media client
+func (v *Viewer) loadingData() *LoadingData {
+	v.stateLock.Lock()
+	loading := LoadingData{}
+	if v.loadProgress != nil {
+		loading = *v.loadProgress
+	}
+	loading.Failures = append(make([]TokenFailure, 0, len(v.failures)), v.failures...)
+	v.stateLock.Unlock()
+
+	progress := v.MediaClient.Progress()
+	loading.BytesDone = progress.BytesDone
+	loading.BytesTotal = progress.BytesTotal
+	for _, file := range progress.Files {
+		if file.State == storage.DownloadActive {
+			loading.CurrentFile = file.File
+			break
+		}
+	}
+	return &loading
+}
+
+// setLoadProgress replaces the recorded token progress and wakes the state watcher
+func (v *Viewer) setLoadProgress(progress *LoadingData) {
+	v.stateLock.Lock()
+	v.loadProgress = progress
+	v.stateLock.Unlock()
+	v.notifyStateChange()
+}
+
+// resolveLoadProgress records that loading media for meta finished, err is nil if the media is ready
+func (v *Viewer) resolveLoadProgress(meta *fstore.FirestoreTokenMeta, err error) {
+	v.stateLock.Lock()
+	progress := LoadingData{}
+	if v.loadProgress != nil {
+		progress = *v.loadProgress
+	}
+	progress.TokensResolved++
+	if err != nil {
+		v.recordFailureLocked(mediaFailure(meta, err))
+	}
+	v.loadProgress = &progress
+	v.stateLock.Unlock()
+	v.notifyStateChange()
+}
+
+// processStatuser is implemented by video players and plaque managers that run a supervised child process
+type processStatuser interface {
+	ProcessStatus() process.Status
+}
+
+// ProcessStatuses returns restart counts and exit reasons of the player and plaque processes, skipping any that do not run a process
+func (v *Viewer) ProcessStatuses() []process.Status {
+	statuses := make([]process.Status, 0, 2)
+	for _, component := range []interface{}{v.VideoPlayer, v.PlaqueManager} {
+		if p, ok := component.(processStatuser); ok {
+			statuses = append(statuses, p.ProcessStatus())
+		}
 	}
-	return meta, nil
+	return statuses
 }
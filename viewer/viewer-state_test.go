@@ -2,6 +2,7 @@ package viewer
 
 import (
 	"context"
+	"errors"
 	"jkurtz678/moda-viewer/fstore"
 	"jkurtz678/moda-viewer/storage"
 	"jkurtz678/moda-viewer/videoplayer"
@@ -9,8 +10,8 @@ import (
 	"net/url"
 	"path/filepath"
 	"testing"
+	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -88,7 +89,7 @@ func TestViewerState(t *testing.T) {
 					t.Fatal(err)
 				}
 
-				err = v.DBClient.UpdatePlaque(ctx, p.DocumentID, []firestore.Update{{Path: "token_meta_id_list", Value: []string{meta1.DocumentID, meta2.DocumentID}}})
+				err = v.DBClient.UpdatePlaque(ctx, p.DocumentID, &fstore.PlaquePatch{TokenMetaIDList: &[]string{meta1.DocumentID, meta2.DocumentID}})
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -103,7 +104,7 @@ func TestViewerState(t *testing.T) {
 				p, err := v.loadPlaqueData(ctx)
 				a.NoError(err)
 
-				metas, err := v.loadTokenMetas(ctx, p)
+				metas, _, err := v.loadTokenMetas(ctx, p.Plaque.TokenMetaIDList)
 				a.NoError(err)
 				a.Len(metas, 2)
 
@@ -139,7 +140,7 @@ func TestViewerState(t *testing.T) {
 			playerStub.PlayFilesWaitGroup.Add(1)
 			/* if test.blocking {
 				go func() {
-					a.NoError(viewer.Startup())
+					a.NoError(viewer.Startup(context.Background()))
 				}()
 
 				// wait for viewer to get to play vlc function and then run asserts
@@ -148,7 +149,7 @@ func TestViewerState(t *testing.T) {
 				return
 			} */
 			// otherwise viewer is expected to exit automatically
-			err := viewer.Startup()
+			err := viewer.Startup(context.Background())
 			test.asserts(viewer, err)
 
 		})
@@ -182,8 +183,8 @@ func SetupTestPlaqueData(t *testing.T, v *Viewer, metas bool) *fstore.FirestoreP
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = v.DBClient.UpdatePlaque(ctx, p.DocumentID, []firestore.Update{
-		{Path: "wallet_address", Value: "test_account"},
+	err = v.DBClient.UpdatePlaque(ctx, p.DocumentID, &fstore.PlaquePatch{
+		WalletAddress: fstore.String("test_account"),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -198,7 +199,7 @@ func SetupTestPlaqueData(t *testing.T, v *Viewer, metas bool) *fstore.FirestoreP
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = v.DBClient.UpdatePlaque(ctx, p.DocumentID, []firestore.Update{{Path: "token_meta_id_list", Value: []string{meta1.DocumentID, meta2.DocumentID}}})
+		err = v.DBClient.UpdatePlaque(ctx, p.DocumentID, &fstore.PlaquePatch{TokenMetaIDList: &[]string{meta1.DocumentID, meta2.DocumentID}})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -206,3 +207,54 @@ func SetupTestPlaqueData(t *testing.T, v *Viewer, metas bool) *fstore.FirestoreP
 	return p
 
 }
+
+func TestLoadingState(t *testing.T) {
+	a := assert.New(t)
+	v := NewTestViewer(t.TempDir())
+	client := &gatedMediaClient{progress: storage.Progress{
+		Files: []storage.FileProgress{
+			{File: "s1.mp4", State: storage.DownloadDone, BytesDone: 10, BytesTotal: 10},
+			{File: "s2.mp4", State: storage.DownloadActive, BytesDone: 5, BytesTotal: 20},
+		},
+		BytesDone:  15,
+		BytesTotal: 30,
+	}}
+	v.MediaClient = client
+	v.loading = true
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	v.now = func() time.Time { return now }
+
+	metas := testMetas("1", "2", "3")
+	metas[0].TokenMeta.Name = "starry night"
+	done := make(chan struct{})
+	go func() {
+		v.loadMedia(context.Background(), metas, func([]*fstore.FirestoreTokenMeta) error { return nil })
+		close(done)
+	}()
+
+	client.release("s1.mp4", errors.New("download failed"))
+	a.Eventually(func() bool { return v.GetViewerState().Loading.TokensResolved == 1 }, time.Second, 10*time.Millisecond)
+
+	state := v.GetViewerState()
+	a.Equal(ViewerStateLoading, state.State)
+	a.Equal(&LoadingData{
+		TokensTotal:    3,
+		TokensResolved: 1,
+		CurrentFile:    "s2.mp4",
+		BytesDone:      15,
+		BytesTotal:     30,
+		Failures: []TokenFailure{{
+			TokenMetaID: "m1",
+			Name:        "starry night",
+			Reason:      FailureDownloadError,
+			Error:       "download failed",
+			Attempts:    1,
+			NextRetry:   now.Add(retryBackoffMin),
+		}},
+	}, state.Loading)
+
+	client.release("s2.mp4", nil)
+	client.release("s3.mp4", nil)
+	<-done
+	a.Equal(3, v.GetViewerState().Loading.TokensResolved)
+}
@@ -3,6 +3,7 @@ package viewer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"jkurtz678/moda-viewer/fstore"
@@ -13,20 +14,11 @@ import (
 	"strings"
 )
 
+// GetTokenMetaForFileName returns the token meta in the playlist that matches a media file name, or the name of its rendition
 func (v *Viewer) GetTokenMetaForFileName(fileName string) (*fstore.FirestoreTokenMeta, error) {
-
-	plaque, err := v.ReadLocalPlaqueFile()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, metaID := range plaque.Plaque.TokenMetaIDList {
-		meta, err := v.ReadMetadata(metaID)
-		if err != nil {
-			return nil, err
-		}
+	for _, meta := range v.currentPlaylist() {
 		// filename could be from media id or external url
-		if meta.TokenMeta.MediaID == strings.TrimSuffix(fileName, filepath.Ext(fileName)) || filepath.Base(meta.TokenMeta.ExternalMediaURL) == fileName {
+		if meta.TokenMeta.MediaID == strings.TrimSuffix(fileName, filepath.Ext(fileName)) || filepath.Base(meta.TokenMeta.ExternalMediaURL) == fileName || v.playbackFileName(meta) == fileName {
 			return meta, nil
 		}
 	}
@@ -42,8 +34,8 @@ func (v *Viewer) GetTokenMetaForFileName(fileName string) (*fstore.FirestoreToke
 // - if not matching local plaque, overwrite and return remote
 func (v *Viewer) loadPlaqueData(ctx context.Context) (*fstore.FirestorePlaque, error) {
 
-	// read local file to get document id
-	localPlaque, err := v.ReadLocalPlaqueFile()
+	// read local plaque to get document id
+	localPlaque, err := v.currentPlaque()
 
 	// if we cannot find a local plaque file, create one on the remote server
 	if err != nil {
@@ -54,12 +46,7 @@ func (v *Viewer) loadPlaqueData(ctx context.Context) (*fstore.FirestorePlaque, e
 			return nil, err
 		}
 
-		plaqueBytes, err := json.Marshal(remotePlaque)
-		if err != nil {
-			return nil, err
-		}
-
-		err = ioutil.WriteFile(v.PlaqueFile, plaqueBytes, 0644)
+		err = v.setPlaque(remotePlaque)
 		if err != nil {
 			return nil, err
 		}
@@ -80,13 +67,8 @@ func (v *Viewer) loadPlaqueData(ctx context.Context) (*fstore.FirestorePlaque, e
 		return localPlaque, nil
 	}
 
-	// if not equal we overwrite local file with remote data
-	plaqueBytes, err := json.Marshal(remotePlaque)
-	if err != nil {
-		return nil, err
-	}
-
-	err = ioutil.WriteFile(v.PlaqueFile, plaqueBytes, 0644)
+	// if not equal we overwrite local plaque with remote data
+	err = v.setPlaque(remotePlaque)
 	if err != nil {
 		return nil, err
 	}
@@ -116,61 +98,82 @@ func (v *Viewer) ReadLocalPlaqueFile() (*fstore.FirestorePlaque, error) {
 	return &plaque, err
 }
 
-// loadTokenMetas returns a list of token metas, loading from remote if online, returning local files if offline
-// will not return tokens if offline and the token is not found on local OR token is not found on remote
-// can only error if there are problems marshalling/writing json file which is unlikely
-func (v *Viewer) loadTokenMetas(ctx context.Context, plaque *fstore.FirestorePlaque) ([]*fstore.FirestoreTokenMeta, error) {
-	localMetas := make([]*fstore.FirestoreTokenMeta, 0)
-	for _, docID := range plaque.Plaque.TokenMetaIDList {
-		fToken, err := v.ReadMetadata(docID)
-		if err != nil {
-			// if err, assume the metadata file has not been loaded locally yet
-			continue
-		}
-		localMetas = append(localMetas, fToken)
-	}
+// errTokenMetaNotFound is recorded for tokens whose metadata no longer exists on the remote, such as deleted tokens
+var errTokenMetaNotFound = errors.New("token meta not found")
 
-	remoteMetas, err := v.DBClient.GetTokenMetaList(ctx, plaque.Plaque.TokenMetaIDList)
+// loadTokenMetas returns the token metas of tokenMetaIDList in list order, saving local copies of those found on the remote
+// tokens the remote cannot return, such as when offline, use their local copy if there is one
+// tokens that are not found on the remote, or cannot be loaded at all, are left out and returned as failures
+// can only error if there are problems marshalling/writing json file which is unlikely
+func (v *Viewer) loadTokenMetas(ctx context.Context, tokenMetaIDList []string) ([]*fstore.FirestoreTokenMeta, []TokenFailure, error) {
+	result, err := v.DBClient.GetTokenMetaList(ctx, tokenMetaIDList)
 	if err != nil {
-		// if offline, return local tokens
+		// if offline, every token uses its local copy
 		logger.Printf("loadTokenMetas GetTokenMetaList error: %+v", err)
-		return localMetas, nil
+		result = &fstore.TokenMetaListResult{Errors: make(map[string]error, len(tokenMetaIDList))}
+		for _, id := range tokenMetaIDList {
+			result.Errors[id] = err
+		}
 	}
 
-	// put local tokens in a map so we can ignore order
-	localMetaMap := make(map[string]*fstore.FirestoreTokenMeta, len(localMetas))
-	for _, meta := range localMetas {
-		localMetaMap[meta.DocumentID] = meta
+	found := make(map[string]*fstore.FirestoreTokenMeta, len(result.Found))
+	for _, meta := range result.Found {
+		found[meta.DocumentID] = meta
+	}
+	notFound := make(map[string]bool, len(result.NotFound))
+	for _, id := range result.NotFound {
+		notFound[id] = true
 	}
 
-	// if local token does not exist or match remote token, overwrite local file
-	for _, meta := range remoteMetas {
-		if reflect.DeepEqual(localMetaMap[meta.DocumentID], meta) {
+	metas := make([]*fstore.FirestoreTokenMeta, 0, len(tokenMetaIDList))
+	failures := make([]TokenFailure, 0)
+	for _, id := range tokenMetaIDList {
+		// if err, assume the metadata file has not been loaded locally yet
+		localMeta, localErr := v.tokenMeta(id)
+
+		if meta, ok := found[id]; ok {
+			// if local token does not exist or match remote token, overwrite local file
+			if !reflect.DeepEqual(localMeta, meta) {
+				logger.Printf("updating local meta for token %s", meta.TokenMeta.Name)
+				err = v.setTokenMeta(meta)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			metas = append(metas, meta)
 			continue
 		}
-		logger.Printf("updating local meta for token %s", meta.TokenMeta.Name)
 
-		metaBytes, err := json.Marshal(meta)
-		if err != nil {
-			return nil, err
+		failure := TokenFailure{TokenMetaID: id, Reason: FailureMissingMetadata}
+		if localErr == nil {
+			failure.Name = localMeta.TokenMeta.Name
+		}
+		if notFound[id] {
+			logger.Printf("loadTokenMetas token meta %s not found on remote, skipping", id)
+			failure.Error = errTokenMetaNotFound.Error()
+			failures = append(failures, failure)
+			continue
 		}
 
-		fileName := fmt.Sprintf("%s.json", meta.DocumentID)
-		filePath := filepath.Join(v.MetadataDir, fileName)
-		err = ioutil.WriteFile(filePath, metaBytes, 0644)
-		if err != nil {
-			return nil, err
+		remoteErr := result.Errors[id]
+		if localErr != nil {
+			logger.Printf("loadTokenMetas token meta %s could not be loaded from remote (%v) or local file (%v), skipping", id, remoteErr, localErr)
+			failure.Error = fmt.Sprintf("token meta could not be loaded: %v", remoteErr)
+			failures = append(failures, failure)
+			continue
 		}
+		if remoteErr != nil {
+			logger.Printf("loadTokenMetas using local meta for token %s, remote error: %v", id, remoteErr)
+		}
+		metas = append(metas, localMeta)
 	}
 
-	return remoteMetas, nil
-
+	return metas, failures, nil
 }
 
 // ReadMetadata reads and returns the metadata file for the given document id
 func (v *Viewer) ReadMetadata(documentID string) (*fstore.FirestoreTokenMeta, error) {
-	fileName := fmt.Sprintf("%s.json", documentID)
-	jsonFile, err := os.Open(filepath.Join(v.MetadataDir, fileName))
+	jsonFile, err := os.Open(v.metadataPath(documentID))
 	if err != nil {
 		return nil, err
 	}
@@ -190,56 +193,121 @@ func (v *Viewer) ReadMetadata(documentID string) (*fstore.FirestoreTokenMeta, er
 	return &meta, err
 }
 
-// loadMedia will download all media for metas, ensuring that all media files are ready for playback
+// errNoMediaLink is returned for token metas with neither archive media nor an external media url
+var errNoMediaLink = errors.New("token has no valid media links")
+
+// errNoValidTokens is returned by LoadAndPlayTokens when no token could be loaded, it is cleared once a retried token loads
+var errNoValidTokens = errors.New("Viewer.loadMedia error - no valid tokens in list")
+
+// loadMedia downloads media for all metas at once, ensuring that media files are ready for playback, and returns the metas with valid media
 // first will try to load from archive, then from external sources
-func (v *Viewer) loadMedia(ctx context.Context, metas []*fstore.FirestoreTokenMeta) []*fstore.FirestoreTokenMeta {
-	validMetas := make([]*fstore.FirestoreTokenMeta, 0, len(metas))
-	for _, meta := range metas {
-		if meta.TokenMeta.MediaID != "" {
-			err := v.MediaClient.DownloadFileFromArchive(meta.MediaFileName())
-			if err != nil {
-				logger.Printf("loadMedia error - failed to load archive media for token %s with file name %s", meta.DocumentID, meta.MediaFileName())
-				continue
-			}
-		} else if meta.TokenMeta.ExternalMediaURL != "" {
-			err := v.MediaClient.DownloadFileFromURL(meta.TokenMeta.ExternalMediaURL)
-			if err != nil {
-				logger.Printf("loadMedia error - failed to load external media for token %s with url path %s", meta.DocumentID, meta.TokenMeta.ExternalMediaURL)
-				continue
-			}
+// ready is called with metas whose media is ready, in list order. The first call waits until PlaybackStartCount metas at the start of the
+// list are ready, or every meta has resolved if PlaybackStartCount is 0, later calls pass the metas resolved since the previous call
+// if ready returns an error remaining downloads are cancelled and the error is returned
+func (v *Viewer) loadMedia(ctx context.Context, metas []*fstore.FirestoreTokenMeta, ready func([]*fstore.FirestoreTokenMeta) error) ([]*fstore.FirestoreTokenMeta, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		index int
+		err   error
+	}
+	v.setLoadProgress(&LoadingData{TokensTotal: len(metas)})
+
+	// buffered so downloads finishing after an early return do not block
+	results := make(chan result, len(metas))
+	for i, meta := range metas {
+		go func(i int, meta *fstore.FirestoreTokenMeta) {
+			results <- result{index: i, err: v.downloadMedia(ctx, meta)}
+		}(i, meta)
+	}
+
+	resolved := make([]bool, len(metas))
+	valid := make([]bool, len(metas))
+	validMetas := make([]*fstore.FirestoreTokenMeta, 0, len(metas)) // metas passed to ready
+	pending := make([]*fstore.FirestoreTokenMeta, 0, len(metas))    // valid metas not yet passed to ready
+	next := 0                                                       // first meta in list order that has not resolved
+	for range metas {
+		r := <-results
+		meta := metas[r.index]
+		resolved[r.index] = true
+		v.resolveLoadProgress(meta, r.err)
+		var verr *storage.VerificationError
+		if errors.As(r.err, &verr) {
+			logger.Printf("loadMedia error - media for token %s with file name %s failed verification: %v", meta.DocumentID, meta.MediaFileName(), r.err)
+		} else if r.err != nil {
+			logger.Printf("loadMedia error - failed to load media for token %s with file name %s: %v", meta.DocumentID, meta.MediaFileName(), r.err)
 		} else {
-			logger.Printf("loadMedia error - token has no valid media links %s", meta.DocumentID)
+			// meta is valid if above media was found without error
+			valid[r.index] = true
+		}
+
+		for ; next < len(metas) && resolved[next]; next++ {
+			if valid[next] {
+				pending = append(pending, metas[next])
+			}
+		}
+
+		waiting := len(validMetas) == 0 && next < len(metas) && (v.PlaybackStartCount == 0 || len(pending) < v.PlaybackStartCount)
+		if waiting || len(pending) == 0 {
 			continue
 		}
+		err := ready(pending)
+		if err != nil {
+			return validMetas, err
+		}
+		validMetas = append(validMetas, pending...)
+		pending = make([]*fstore.FirestoreTokenMeta, 0, len(metas)-next)
+	}
+	return validMetas, nil
+}
 
-		// meta is valid if above media was found without error
-		validMetas = append(validMetas, meta)
+// downloadMedia downloads media for meta from the archive, or from its external url if it has no archive media
+// the media is ready to play once downloaded, it is probed and transcoded in the background
+func (v *Viewer) downloadMedia(ctx context.Context, meta *fstore.FirestoreTokenMeta) error {
+	checksum := storage.Checksum{SHA256: meta.TokenMeta.MediaSHA256, Size: meta.TokenMeta.MediaSize}
+	var err error
+	switch {
+	case meta.TokenMeta.MediaID != "":
+		err = v.MediaClient.DownloadFileFromArchive(ctx, meta.MediaFileName(), checksum)
+	case meta.TokenMeta.ExternalMediaURL != "":
+		err = v.MediaClient.DownloadFileFromURL(ctx, meta.TokenMeta.ExternalMediaURL, checksum)
+	default:
+		return errNoMediaLink
+	}
+	if err != nil {
+		return err
 	}
-	return validMetas
+	v.queueMediaProcessing(meta)
+	return nil
 }
 
-// getValidTokens returns list of token metas that both exist locally and have a local media file
-func (v *Viewer) getValidTokens(tokenMetaIDList []string) []string {
-	validTokenList := make([]string, 0, len(tokenMetaIDList))
-	for _, tokenMetaID := range tokenMetaIDList {
-		tokenMeta, err := v.ReadMetadata(tokenMetaID)
-		if err != nil {
-			logger.Printf("getValidTokens invalid token metadata for token %s", tokenMetaID)
-			continue
+// recoverIncompleteFiles removes temp files left in the plaque, metadata and media dirs by an interrupted write
+// partial media downloads are left in place for storage to resume
+func (v *Viewer) recoverIncompleteFiles() {
+	dirs := make([]string, 0, 3)
+	for _, dir := range []string{filepath.Dir(v.PlaqueFile), v.MetadataDir, v.MediaDir} {
+		if !containsString(dirs, dir) {
+			dirs = append(dirs, dir)
 		}
+	}
 
-		localPath := filepath.Join(v.MediaDir, tokenMeta.MediaFileName())
-		exists, err := storage.FileExists(localPath)
+	for _, dir := range dirs {
+		removed, err := storage.RemoveIncompleteFiles(dir)
+		for _, path := range removed {
+			logger.Printf("recoverIncompleteFiles removed incomplete file %s", path)
+		}
 		if err != nil {
-			logger.Printf("getValidTokens failed to check local file %s for metadata %s with error %v", localPath, tokenMetaID, err)
-			continue
+			logger.Printf("recoverIncompleteFiles failed to clean dir %s with error %v", dir, err)
 		}
+	}
+}
 
-		if !exists {
-			logger.Printf("getValidTokens failed to find local file %s for metadata %s", localPath, tokenMetaID)
-			continue
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
 		}
-		validTokenList = append(validTokenList, tokenMeta.DocumentID)
 	}
-	return validTokenList
+	return false
 }
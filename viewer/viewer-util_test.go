@@ -0,0 +1,197 @@
+package viewer
+
+import (
+	"context"
+	"errors"
+	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/storage"
+	"jkurtz678/moda-viewer/videoplayer"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedMediaClient holds each download until the test releases its file
+type gatedMediaClient struct {
+	lock     sync.Mutex
+	gates    map[string]chan error
+	progress storage.Progress // returned by Progress
+}
+
+func (c *gatedMediaClient) gate(file string) chan error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.gates == nil {
+		c.gates = make(map[string]chan error)
+	}
+	if _, ok := c.gates[file]; !ok {
+		c.gates[file] = make(chan error, 1)
+	}
+	return c.gates[file]
+}
+
+func (c *gatedMediaClient) release(file string, err error) {
+	c.gate(file) <- err
+}
+
+func (c *gatedMediaClient) DownloadFileFromArchive(ctx context.Context, fileURI string, checksum storage.Checksum) error {
+	select {
+	case err := <-c.gate(fileURI):
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *gatedMediaClient) DownloadFileFromURL(ctx context.Context, fileURL string, checksum storage.Checksum) error {
+	return c.DownloadFileFromArchive(ctx, filepath.Base(fileURL), checksum)
+}
+
+func (c *gatedMediaClient) Progress() storage.Progress {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.progress
+}
+
+func testMetas(ids ...string) []*fstore.FirestoreTokenMeta {
+	metas := make([]*fstore.FirestoreTokenMeta, 0, len(ids))
+	for _, id := range ids {
+		metas = append(metas, &fstore.FirestoreTokenMeta{DocumentID: "m" + id, TokenMeta: fstore.TokenMeta{MediaID: "s" + id, MediaType: ".mp4"}})
+	}
+	return metas
+}
+
+func TestLoadMedia(t *testing.T) {
+	a := assert.New(t)
+
+	t.Run("passes ready metas in list order once the first are ready", func(t *testing.T) {
+		v := NewTestViewer(t.TempDir())
+		client := &gatedMediaClient{}
+		v.MediaClient = client
+		v.PlaybackStartCount = 2
+		metas := testMetas("1", "2", "3", "4")
+
+		batches := make(chan []*fstore.FirestoreTokenMeta, len(metas))
+		done := make(chan []*fstore.FirestoreTokenMeta)
+		go func() {
+			valid, err := v.loadMedia(context.Background(), metas, func(ready []*fstore.FirestoreTokenMeta) error {
+				batches <- ready
+				return nil
+			})
+			a.NoError(err)
+			done <- valid
+		}()
+
+		// s2 is ready but s1 is not, so nothing can play yet
+		client.release("s2.mp4", nil)
+		client.release("s1.mp4", nil)
+		a.Equal(metas[:2], <-batches)
+
+		// failed media is skipped, s4 waits for s3 to keep playlist order
+		client.release("s4.mp4", errors.New("download failed"))
+		client.release("s3.mp4", nil)
+		a.Equal(metas[2:3], <-batches)
+
+		a.Equal(metas[:3], <-done)
+		a.Empty(batches)
+	})
+
+	t.Run("waits for every meta when start count is 0", func(t *testing.T) {
+		v := NewTestViewer(t.TempDir())
+		client := &gatedMediaClient{}
+		v.MediaClient = client
+		metas := testMetas("1", "2")
+
+		client.release("s1.mp4", nil)
+		client.release("s2.mp4", &storage.VerificationError{Check: "size"})
+		calls := 0
+		valid, err := v.loadMedia(context.Background(), metas, func(ready []*fstore.FirestoreTokenMeta) error {
+			calls++
+			a.Equal(metas[:1], ready)
+			return nil
+		})
+		a.NoError(err)
+		a.Equal(1, calls)
+		a.Equal(metas[:1], valid)
+	})
+
+	t.Run("starts playback early and appends the rest", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		v := NewTestViewer(tmpdir)
+		client := &gatedMediaClient{}
+		v.MediaClient = client
+		v.PlaybackStartCount = 1
+		playerStub := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+
+		metas := testMetas("1", "2", "3")
+		plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: []string{"m1", "m2", "m3"}}}
+		a.NoError(v.setPlaque(plaque))
+		for _, meta := range metas {
+			a.NoError(v.setTokenMeta(meta))
+		}
+
+		playerStub.PlayFilesWaitGroup.Add(1)
+		loaded := make(chan error)
+		go func() {
+			loaded <- v.LoadAndPlayTokens(context.Background(), plaque)
+		}()
+
+		// the first file plays while the others are still downloading
+		client.release("s1.mp4", nil)
+		playerStub.PlayFilesWaitGroup.Wait()
+		a.Equal(v.mediaFilepaths(metas[:1]), playerStub.ActivePlaylistFilepaths)
+		a.Equal(metas[:1], v.currentPlaylist())
+
+		client.release("s3.mp4", nil)
+		client.release("s2.mp4", nil)
+		select {
+		case err := <-loaded:
+			a.NoError(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("LoadAndPlayTokens did not return")
+		}
+		a.Equal(v.mediaFilepaths(metas), playerStub.ActivePlaylistFilepaths)
+		a.Equal(metas, v.currentPlaylist())
+	})
+}
+
+func TestLoadTokenMetas(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	client, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	v.DBClient = client
+
+	m1, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "starry night", MediaID: "s1", MediaType: ".mp4"})
+	a.NoError(err)
+	m2, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "irises", MediaID: "s2", MediaType: ".mp4"})
+	a.NoError(err)
+	// a token deleted from the remote after it was saved locally
+	a.NoError(v.setTokenMeta(&fstore.FirestoreTokenMeta{DocumentID: "deleted", TokenMeta: fstore.TokenMeta{Name: "sunflowers"}}))
+	// a stale local copy is replaced by the remote token
+	a.NoError(v.setTokenMeta(&fstore.FirestoreTokenMeta{DocumentID: m2.DocumentID, TokenMeta: fstore.TokenMeta{Name: "old"}}))
+
+	ids := []string{m1.DocumentID, "deleted", m2.DocumentID, "unknown"}
+	metas, failures, err := v.loadTokenMetas(ctx, ids)
+	a.NoError(err)
+	a.Equal([]*fstore.FirestoreTokenMeta{m1, m2}, metas)
+	local, err := v.ReadMetadata(m2.DocumentID)
+	a.NoError(err)
+	a.Equal(m2, local)
+	a.Equal([]TokenFailure{
+		{TokenMetaID: "deleted", Name: "sunflowers", Reason: FailureMissingMetadata, Error: "token meta not found"},
+		{TokenMetaID: "unknown", Reason: FailureMissingMetadata, Error: "token meta not found"},
+	}, failures)
+
+	// offline, tokens with a local copy are still played and the rest are flagged
+	v.DBClient = &fstore.FstoreClientStub{}
+	metas, failures, err = v.loadTokenMetas(ctx, ids)
+	a.NoError(err)
+	a.Equal([]string{m1.DocumentID, "deleted", m2.DocumentID}, []string{metas[0].DocumentID, metas[1].DocumentID, metas[2].DocumentID})
+	a.Equal([]TokenFailure{{TokenMetaID: "unknown", Reason: FailureMissingMetadata, Error: "token meta could not be loaded: error offline"}}, failures)
+}
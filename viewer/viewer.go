@@ -2,10 +2,10 @@ package viewer
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"jkurtz678/moda-viewer/config"
+	"jkurtz678/moda-viewer/display"
 	"jkurtz678/moda-viewer/fstore"
+	"jkurtz678/moda-viewer/mediaformat"
 	"jkurtz678/moda-viewer/storage"
 	"jkurtz678/moda-viewer/videoplayer"
 	"jkurtz678/moda-viewer/webview"
@@ -29,45 +29,147 @@ type Viewer struct {
 	storage.MediaClient
 	videoplayer.VideoPlayer
 	webview.PlaqueManager
-	TestMode bool // plaque will not block and listen for changes, instead will close after playing media
+	Display  display.DisplayController // turns the screen off while the schedule has the display off, nil if not configured
+	Cache    *storage.CacheManager     // evicts media over the quota and cleans token metas no longer on the plaque, nil keeps every file
+	Media    mediaformat.Processor     // probes downloaded media and transcodes what the device cannot play smoothly, nil skips probing
+	TestMode bool                      // plaque will not block and listen for changes, instead will close after playing media
 	State    ViewerState
 
-	stateLock sync.Mutex // lock for loading and loadErr values
-	loading   bool       // boolean set to true when viewer is actively loading data
-	loadErr   error      // error which viewer ran into while loading data, if any value is found here the viewer is considered in ViewerStateError
+	PlaybackStartCount int // playback starts once this many media files at the start of the playlist are ready, 0 waits for every file
+
+	stateLock      sync.Mutex         // lock for loading, loadErr, loadProgress, schedule, loggedProblems, failures and loadGeneration values
+	loading        bool               // boolean set to true when viewer is actively loading data
+	loadErr        error              // error which viewer ran into while loading data, if any value is found here the viewer is considered in ViewerStateError
+	loadProgress   *LoadingData       // tokens resolved by the current load, replaced rather than modified
+	schedule       *scheduleSelection // schedule selection of the last load, nil before the first load
+	loggedProblems []string           // problems with the plaque schedule found by the last selection, already logged
+	loadLock       sync.Mutex         // plaque changes and the schedule both reload tokens, one reload runs at a time
+	plaqueLock     sync.Mutex         // plaque changes from the listener and staged swaps are saved one at a time
+	failures       []TokenFailure     // tokens of the current load that failed, replaced rather than modified
+	loadGeneration int                // incremented by each load, so retries of tokens from an earlier load are discarded
+	now            func() time.Time   // clock for schedules, time.Now if nil
+
+	dataLock     sync.RWMutex                          // lock for in-memory plaque, token metas, media reports and playlist
+	plaque       *fstore.FirestorePlaque               // current plaque, persisted to PlaqueFile
+	tokenMetas   map[string]*fstore.FirestoreTokenMeta // token metas by document id, persisted to MetadataDir
+	mediaReports map[string]*mediaformat.Report        // probe reports by media file name, persisted to the media reports dir of MetadataDir
+	playlist     []*fstore.FirestoreTokenMeta          // token metas with local media that the video player is playing
+
+	playlistLock sync.Mutex // serializes changes to the player playlist, so a rendition swapped in is not lost to a concurrent add
+
+	processLock  sync.Mutex         // lock for media processing values
+	processing   map[string]bool    // media file names queued or being processed
+	processSlots chan struct{}      // holds a value for each media file being processed, at most mediaProcessors
+	processCtx   context.Context    // outlives the load that downloaded the media, done once media processing is stopped
+	processStop  context.CancelFunc // stops media processing
+	processWait  sync.WaitGroup     // media processing routines, waited for when media processing is stopped
+
+	rotation rotation // display time of the playing token, for advancing the playlist
+	shuffler shuffler // random choices of the shuffled play orders
+
+	stageLock   sync.Mutex          // lock for staged token list values
+	apiStage    []string            // token list staged with StagePlaylist, nil if none
+	stage       *StageData          // prefetch progress of the staged token list, replaced rather than modified
+	stageCancel context.CancelFunc  // cancels the prefetch in progress
+	stageWake   chan struct{}       // wakes runStaging when the staged list changes
+	unsavedSwap *fstore.PlaquePatch // swap applied while the database could not be updated, saved by the next prefetch
+
+	displayLock sync.Mutex // serializes display power commands
+	displayOff  bool       // true if the display was last turned off
+
+	subLock     sync.Mutex                         // lock for state subscription values
+	subscribers map[chan *ViewerStateData]struct{} // channels receiving viewer state changes
+	stateChange chan struct{}                      // signals the state watcher that loading or loadErr changed
+	watching    bool                               // true while the state watcher routine is running
 }
 
-// NewViewer returns a new initialized viewer
-func NewViewer(dbClient fstore.DBClient, storageClient *storage.FirebaseStorageClient) *Viewer {
+// NewViewer returns a new viewer initialized from the given config
+func NewViewer(cfg *config.Config, dbClient fstore.DBClient, storageClient *storage.FirebaseStorageClient) *Viewer {
+	// media being downloaded is never evicted
+	cache := storage.NewCacheManager(cfg.MediaDir, int64(cfg.Cache.QuotaMB)*1000*1000)
+	if storageClient != nil {
+		cache.Active = storageClient.Downloading
+	}
 	return &Viewer{
-		PlaqueFile:    "plaque.json",
-		MediaDir:      "media",
-		MetadataDir:   "metadata",
+		PlaqueFile:    cfg.PlaqueFile,
+		MediaDir:      cfg.MediaDir,
+		MetadataDir:   cfg.MetadataDir,
 		DBClient:      dbClient,
 		MediaClient:   storageClient,
-		VideoPlayer:   videoplayer.NewVLCPlayer(),
-		PlaqueManager: &webview.PythonWebview{},
+		VideoPlayer:   newVideoPlayer(cfg),
+		PlaqueManager: webview.NewPythonWebview(cfg.PlaqueURL),
+		Display:       newDisplayController(cfg),
+		Cache:         cache,
+		Media:         newMediaProcessor(cfg),
+
+		PlaybackStartCount: cfg.Downloads.PlaybackStart,
+	}
+}
+
+// newVideoPlayer returns the video player backend selected by the config
+func newVideoPlayer(cfg *config.Config) videoplayer.VideoPlayer {
+	if cfg.Player == config.PlayerMPV {
+		return videoplayer.NewMPVPlayer(cfg.MPV.Socket)
+	}
+	return videoplayer.NewVLCPlayer(cfg.VLC.Host, cfg.VLC.Port, cfg.VLC.Password)
+}
+
+// newDisplayController returns the display power controller selected by the config, nil if display power is not controlled
+func newDisplayController(cfg *config.Config) display.DisplayController {
+	switch cfg.Display.Controller {
+	case config.DisplayDPMS:
+		return display.NewDPMSDisplay(cfg.Display.XDisplay)
+	case config.DisplayCEC:
+		return display.NewCECDisplay(cfg.Display.CECAddress)
 	}
+	return nil
 }
 
 // Start will play media and show the plaque as specified by the config file
-func (v *Viewer) Startup() error {
+// Startup blocks until ctx is done, then stops the plaque and player and returns nil once they have exited
+func (v *Viewer) Startup(ctx context.Context) error {
 	logger.Printf("Startup()")
 
 	// start loading indicator
 	v.stateLock.Lock()
 	v.loading = true
 	v.stateLock.Unlock()
+	v.notifyStateChange()
 
-	// init plaque and player processes on their own threads
-	go v.PlaqueManager.InitPlaque()
-	go v.VideoPlayer.InitPlayer()
+	// clean up any files left half written by a crash or power loss before trusting local data
+	v.recoverIncompleteFiles()
+
+	// init plaque and player processes on their own threads, stopping them when startup returns
+	childCtx, stopChildren := context.WithCancel(ctx)
+	var children sync.WaitGroup
+	defer func() {
+		stopChildren()
+		children.Wait()
+		v.stopMediaProcessing()
+	}()
+	children.Add(2)
+	go func() {
+		defer children.Done()
+		err := v.PlaqueManager.InitPlaque(childCtx)
+		if err != nil {
+			logger.Printf("Startup - plaque exited with error %v", err)
+		}
+	}()
+	go func() {
+		defer children.Done()
+		err := v.VideoPlayer.InitPlayer(childCtx)
+		if err != nil {
+			logger.Printf("Startup - player exited with error %v", err)
+		}
+	}()
 
 	// pause to let plaque and player start up
-	time.Sleep(time.Second)
+	if !sleep(ctx, time.Second) {
+		return nil
+	}
 
 	logger.Printf("loading plaque data...")
-	plaque, err := v.loadPlaqueData(context.Background())
+	plaque, err := v.loadPlaqueData(ctx)
 	// loadPlaqueData should only error if no local plaque is found (first start) and cannot connect to remote (no wifi)
 	if err != nil {
 		logger.Printf("Startup loadPlaqueData error - %+v", err)
@@ -76,13 +178,19 @@ func (v *Viewer) Startup() error {
 
 	// try to start plaque, if failure, wait 5 seconds and try again
 	for {
-		err = v.LoadAndPlayTokens(plaque)
+		err = v.LoadAndPlayTokens(ctx, plaque)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
 			logger.Printf("LoadAndPlayTokens error %v - retrying in 5 seconds....", err)
 			v.stateLock.Lock()
 			v.loadErr = err
 			v.stateLock.Unlock()
-			time.Sleep(time.Second * 5)
+			v.notifyStateChange()
+			if !sleep(ctx, time.Second*5) {
+				return nil
+			}
 			continue
 		}
 		break
@@ -92,133 +200,434 @@ func (v *Viewer) Startup() error {
 	v.stateLock.Lock()
 	v.loading = false
 	v.stateLock.Unlock()
+	v.notifyStateChange()
 
 	// if in test mode, exit after starting playback instead of listening
 	if v.TestMode {
 		return nil
 	}
 
-	// now listen for plaque changes on remote, should block perpetually
-	v.ListenForPlaqueChanges(plaque)
+	// advance the playlist by display duration and switch tokens at schedule windows while art is showing
+	// failed tokens are retried, and staged and scheduled tokens prefetched, in the background
+	children.Add(4)
+	go func() {
+		defer children.Done()
+		v.rotate(childCtx)
+	}()
+	go func() {
+		defer children.Done()
+		v.runSchedule(childCtx)
+	}()
+	go func() {
+		defer children.Done()
+		v.retryFailures(childCtx)
+	}()
+	go func() {
+		defer children.Done()
+		v.runStaging(childCtx)
+	}()
 
-	// if we get here plaque will exit, but there should be no way to move past ListenForPlaqueChanges
+	// now listen for plaque changes on remote, blocks until ctx is done
+	v.ListenForPlaqueChanges(ctx, plaque)
+	logger.Printf("Startup - shutting down")
 	return nil
 }
 
-// ListenForPlaqueChanges will trigger
-func (v *Viewer) ListenForPlaqueChanges(plaque *fstore.FirestorePlaque) {
-	logger.Printf("ListenForPlaqueChanges - listening to changes for plaque: %s", plaque.DocumentID)
-	err := v.DBClient.ListenPlaque(context.Background(), plaque.DocumentID, func(remotePlaque *fstore.FirestorePlaque) error {
-
-		// skip if no changes to wallet address
-		localPlaque, err := v.ReadLocalPlaqueFile()
-		if err != nil {
-			return err
-		}
-		metasEqual := reflect.DeepEqual(localPlaque.Plaque.TokenMetaIDList, remotePlaque.Plaque.TokenMetaIDList)
-		walletAddressEqual := localPlaque.Plaque.WalletAddress == remotePlaque.Plaque.WalletAddress
-		if metasEqual && walletAddressEqual {
-			return nil
+// ListenForPlaqueChanges will trigger loading and playing tokens when the remote plaque changes, until ctx is done
+func (v *Viewer) ListenForPlaqueChanges(ctx context.Context, plaque *fstore.FirestorePlaque) {
+	for {
+		logger.Printf("ListenForPlaqueChanges - listening to changes for plaque: %s", plaque.DocumentID)
+		err := v.DBClient.ListenPlaque(ctx, plaque.DocumentID, func(remotePlaque *fstore.FirestorePlaque) error {
+			return v.applyPlaqueChange(ctx, remotePlaque)
+		})
+		if ctx.Err() != nil {
+			return
 		}
-
+		// callback will not error, but possible that startup of listener will error, retry in 1 minute
+		logger.Printf("ListenForPlaqueChanges - listen error %v, retrying connection in 1 minute", err)
 		v.stateLock.Lock()
-		v.loading = true
-		v.loadErr = nil
+		v.loadErr = err
 		v.stateLock.Unlock()
+		v.notifyStateChange()
+		if !sleep(ctx, time.Minute) {
+			return
+		}
+	}
+}
 
-		// update local plaque file with changes and play new tokens
-		err = func() error {
-			plaqueBytes, err := json.Marshal(remotePlaque)
-			if err != nil {
-				return err
-			}
+// applyPlaqueChange saves a remote plaque and plays its tokens if the token list, wallet address or schedule changed
+func (v *Viewer) applyPlaqueChange(ctx context.Context, remotePlaque *fstore.FirestorePlaque) error {
+	return v.changePlaque(ctx, func(*fstore.FirestorePlaque) *fstore.FirestorePlaque { return remotePlaque })
+}
 
-			err = ioutil.WriteFile(v.PlaqueFile, plaqueBytes, 0644)
-			if err != nil {
-				return err
-			}
+// changePlaque saves the plaque change returns for the local plaque, and plays its tokens if the token list, wallet address or schedule changed
+// changes are made one at a time, so change always sees the plaque saved by the change before it
+func (v *Viewer) changePlaque(ctx context.Context, change func(localPlaque *fstore.FirestorePlaque) *fstore.FirestorePlaque) error {
+	plaque, reload, err := v.savePlaqueChange(change)
+	if err != nil || !reload {
+		return err
+	}
+	v.reload(ctx, plaque)
+	return nil
+}
 
-			err = v.LoadAndPlayTokens(remotePlaque)
-			if err != nil {
-				return err
-			}
-			return nil
-		}()
+// savePlaqueChange saves the plaque change returns for the local plaque, returning it and whether its tokens must be reloaded
+func (v *Viewer) savePlaqueChange(change func(localPlaque *fstore.FirestorePlaque) *fstore.FirestorePlaque) (*fstore.FirestorePlaque, bool, error) {
+	v.plaqueLock.Lock()
+	defer v.plaqueLock.Unlock()
+	localPlaque, err := v.currentPlaque()
+	if err != nil {
+		return nil, false, err
+	}
+	remotePlaque := change(localPlaque)
 
-		v.stateLock.Lock()
-		v.loading = false
+	// skip if no changes to wallet address
+	metasEqual := reflect.DeepEqual(localPlaque.Plaque.TokenMetaIDList, remotePlaque.Plaque.TokenMetaIDList)
+	walletAddressEqual := localPlaque.Plaque.WalletAddress == remotePlaque.Plaque.WalletAddress
+	scheduleEqual := reflect.DeepEqual(localPlaque.Plaque.Schedule, remotePlaque.Plaque.Schedule)
+	if metasEqual && walletAddressEqual && scheduleEqual {
+		// other settings such as the default display duration apply to the playing tokens without reloading them
+		if reflect.DeepEqual(localPlaque, remotePlaque) {
+			return remotePlaque, false, nil
+		}
+		err = v.setPlaque(remotePlaque)
 		if err != nil {
-			logger.Printf("ListenForPlaqueChanges error %v", err)
-			v.loadErr = err
+			logger.Printf("ListenForPlaqueChanges failed to save plaque %v", err)
 		}
-		v.stateLock.Unlock()
+		v.notifyStateChange()
+		if !reflect.DeepEqual(localPlaque.Plaque.StagedTokenMetaIDList, remotePlaque.Plaque.StagedTokenMetaIDList) {
+			v.restartStaging()
+		}
+		return remotePlaque, false, nil
+	}
 
-		return nil
-	})
-	// callback will not error, but possible that startup of listener will error, retry in 1 minute
+	// update local plaque with changes and play new tokens
+	err = v.setPlaque(remotePlaque)
 	if err != nil {
-		logger.Printf("ListenForPlaqueChanges - listen error %v, retrying connection in 1 minute", err)
+		logger.Printf("ListenForPlaqueChanges error %v", err)
 		v.stateLock.Lock()
 		v.loadErr = err
 		v.stateLock.Unlock()
-		time.Sleep(1 * time.Minute)
-		v.ListenForPlaqueChanges(plaque)
+		v.notifyStateChange()
+		return remotePlaque, false, nil
+	}
+	return remotePlaque, true, nil
+}
+
+// reload shows the loading state while the tokens of plaque are loaded and played
+func (v *Viewer) reload(ctx context.Context, plaque *fstore.FirestorePlaque) {
+	v.loadLock.Lock()
+	defer v.loadLock.Unlock()
+
+	v.stateLock.Lock()
+	v.loading = true
+	v.loadErr = nil
+	v.stateLock.Unlock()
+	v.notifyStateChange()
+
+	err := v.LoadAndPlayTokens(ctx, plaque)
+
+	v.stateLock.Lock()
+	v.loading = false
+	if err != nil && ctx.Err() == nil {
+		logger.Printf("reload error %v", err)
+		v.loadErr = err
+	}
+	v.stateLock.Unlock()
+	v.notifyStateChange()
+}
+
+// sleep pauses for d, returning false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
 // LoadAndPlayTokens accepts a plaque, loads its associated media/metadata, and tells the video player to start playing this media
+// art that is already playing carries on while new media loads, then only the changed tokens are swapped in
+// the logo is shown while loading if nothing is playing, and whenever the plaque has nothing playable
 // possible errors:
-// - PlayFiles error for logo is unlikely since it will block and retry until vlc is found (infinite loop here is more likely)
+// - PlayFiles error for logo is unlikely since it will block and retry until vlc is found or the player process exits
 // - loadTokenMetas error is unlikely, only occurs on malformed token meta json
 // - loadMedia error will only occur if all tokens in playlist fail to download, if only some fail it will be logged and these will be skipped
 // - PlayFiles final now should only fail if vlc is not running, as tokens now have a verified local file that exists
-func (v *Viewer) LoadAndPlayTokens(plaque *fstore.FirestorePlaque) error {
+// - returns ctx.Err() if ctx is done before all media is loaded
+func (v *Viewer) LoadAndPlayTokens(ctx context.Context, plaque *fstore.FirestorePlaque) error {
 	logger.Printf("LoadAndPlayTokens called")
+	v.setLoadProgress(nil)
+	generation := v.resetFailures()
 
-	// show moda logo during any file loading, and if errors are hit
-	err := v.VideoPlayer.PlayFiles([]string{"moda-logo.png"})
-	if err != nil {
-		return err
+	// show moda logo during file loading if no art is playing
+	playing := v.currentPlaylist()
+	if len(playing) == 0 {
+		err := v.showLogo()
+		if err != nil {
+			return err
+		}
 	}
 
+	// the schedule decides which tokens are played, if any
+	selection := v.plaqueSchedule(plaque)
+	v.stateLock.Lock()
+	previous := v.schedule
+	v.schedule = &selection
+	v.stateLock.Unlock()
+	v.applyScheduledPower(ctx, previous, selection)
+	tokenMetaIDList := selection.TokenMetaIDList
+
+	// keep the media any of the plaque schedule windows can display
+	v.updateCache(plaque)
+
 	// show moda logo if account_id is not set or no assigned tokens
 	if plaque.Plaque.WalletAddress == "" {
 		logger.Printf("LoadAndPlayTokens no connected user, showing logo")
-		return nil
+		return v.showLogo()
+	}
+
+	// the logo stays up while the schedule has the display off
+	if selection.DisplayOff {
+		logger.Printf("LoadAndPlayTokens schedule window %v turns the display off, showing logo", selection.Window)
+		return v.showLogo()
 	}
 
 	// show moda logo if no tokens are assigned to plaque
-	if len(plaque.Plaque.TokenMetaIDList) == 0 {
-		logger.Printf("LoadAndPlayTokens plaque has %v tokens and 0 valid tokens, showing logo", len(plaque.Plaque.TokenMetaIDList))
-		return nil
+	if len(tokenMetaIDList) == 0 {
+		logger.Printf("LoadAndPlayTokens plaque has %v tokens and 0 valid tokens, showing logo", len(tokenMetaIDList))
+		return v.showLogo()
 	}
 
 	logger.Printf("LoadAndPlayTokens loading token metas...")
-	metas, err := v.loadTokenMetas(context.Background(), plaque)
+	metas, failures, err := v.loadTokenMetas(ctx, tokenMetaIDList)
 	if err != nil {
 		return err
 	}
+	for _, failure := range failures {
+		v.recordFailure(generation, failure)
+	}
+
+	// shuffled play orders also shuffle the order media is loaded in, so playback does not always start with the first tokens
+	metas = v.orderPlaylist(metas)
 
 	logger.Printf("LoadAndPlayTokens loading media for %v metas", len(metas))
+	// playback starts as soon as the first media files are ready, the rest are appended to the playlist as they finish
+	ready := func(ready []*fstore.FirestoreTokenMeta) error {
+		first := len(v.currentPlaylist()) == 0
+		err := v.addToPlaylist(ready)
+		if err != nil || !first {
+			return err
+		}
+
+		// art is showing, remaining downloads continue in the background
+		v.stateLock.Lock()
+		v.loading = false
+		v.stateLock.Unlock()
+		v.notifyStateChange()
+		return nil
+	}
+	if len(playing) > 0 {
+		// art is already showing, the playlist is only changed once every new media file is ready
+		ready = func([]*fstore.FirestoreTokenMeta) error { return nil }
+	}
 	// validTokenMetas are metas with associated media file that has been downloaded and exists locally
-	validTokenMetas := v.loadMedia(context.Background(), metas)
+	validTokenMetas, err := v.loadMedia(ctx, metas, ready)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if len(validTokenMetas) == 0 {
-		return fmt.Errorf("Viewer.loadMedia error - no valid tokens in list")
+		err = v.showLogo()
+		if err != nil {
+			return err
+		}
+		return errNoValidTokens
+	}
+	if len(playing) > 0 {
+		err = v.swapPlaylist(validTokenMetas)
+		if err != nil {
+			return err
+		}
 	}
 
 	// log if any invalid tokens were found
-	if len(validTokenMetas) != len(plaque.Plaque.TokenMetaIDList) {
-		logger.Printf("LoadAndPlayTokens invalid tokens found - plaque has %v tokens and %v valid tokens, playing valid token(s)", len(plaque.Plaque.TokenMetaIDList), len(validTokenMetas))
+	if len(validTokenMetas) != len(tokenMetaIDList) {
+		logger.Printf("LoadAndPlayTokens invalid tokens found - plaque has %v tokens and %v valid tokens, playing valid token(s)", len(tokenMetaIDList), len(validTokenMetas))
 	}
+	// the media just downloaded is pinned now its token metas are local, and media the new playlist replaced is unpinned
+	if v.Cache != nil {
+		v.pinMedia(plaque)
+	}
+	v.evictMedia()
+	v.wakeStaging()
+	return nil
+}
 
-	logger.Printf("LoadAndPlayTokens playing media playlist of %v tokens", len(validTokenMetas))
-	filepaths := make([]string, 0, len(validTokenMetas))
-	for _, m := range validTokenMetas {
-		filepaths = append(filepaths, url.QueryEscape(filepath.Join(v.MediaDir, m.MediaFileName())))
+// addToPlaylist plays metas if the playlist is empty, replacing the logo, otherwise appends them to the end of the playlist
+func (v *Viewer) addToPlaylist(metas []*fstore.FirestoreTokenMeta) error {
+	v.playlistLock.Lock()
+	defer v.playlistLock.Unlock()
+	v.touchMedia(metas)
+	playlist := v.currentPlaylist()
+	if len(playlist) == 0 {
+		logger.Printf("addToPlaylist playing media playlist of %v tokens", len(metas))
+		err := v.jump(func() error { return v.VideoPlayer.PlayFiles(v.mediaFilepaths(metas)) })
+		if err != nil {
+			return err
+		}
+		v.setPlaylist(metas)
+		return nil
+	}
+
+	logger.Printf("addToPlaylist appending %v tokens to playlist", len(metas))
+	err := v.VideoPlayer.AppendFiles(v.mediaFilepaths(metas))
+	if err != nil {
+		return err
 	}
-	err = v.VideoPlayer.PlayFiles(filepaths)
+	v.setPlaylist(append(append(make([]*fstore.FirestoreTokenMeta, 0, len(playlist)+len(metas)), playlist...), metas...))
+	return nil
+}
+
+// showLogo replaces the playlist with the moda logo, shown while there is no art to play
+func (v *Viewer) showLogo() error {
+	v.playlistLock.Lock()
+	defer v.playlistLock.Unlock()
+	err := v.jump(func() error { return v.VideoPlayer.PlayFiles([]string{"moda-logo.png"}) })
 	if err != nil {
 		return err
 	}
+	v.setPlaylist(nil)
 	return nil
 }
+
+// swapPlaylist changes the playing playlist to metas, appending new tokens and removing tokens no longer in metas
+// the playing token carries on if it is kept, otherwise the player jumps to the next kept token before it is removed
+// players cannot reorder their playlist, so sequential playlists whose kept tokens change order are replaced in one go
+func (v *Viewer) swapPlaylist(metas []*fstore.FirestoreTokenMeta) error {
+	if len(v.currentPlaylist()) == 0 {
+		return v.addToPlaylist(metas)
+	}
+	v.playlistLock.Lock()
+	defer v.playlistLock.Unlock()
+	playlist := v.currentPlaylist()
+	v.touchMedia(metas)
+
+	wanted := make(map[string]*fstore.FirestoreTokenMeta, len(metas))
+	for _, meta := range metas {
+		wanted[playlistKey(meta)] = meta
+	}
+	listed := make(map[string]bool, len(playlist))
+	swapped := make([]*fstore.FirestoreTokenMeta, 0, len(metas))
+	stale := make([]int, 0)
+	for i, meta := range playlist {
+		key := playlistKey(meta)
+		listed[key] = true
+		if kept, ok := wanted[key]; ok {
+			swapped = append(swapped, kept)
+			continue
+		}
+		stale = append(stale, i)
+	}
+	added := make([]*fstore.FirestoreTokenMeta, 0)
+	for _, meta := range metas {
+		if !listed[playlistKey(meta)] {
+			added = append(added, meta)
+		}
+	}
+	swapped = append(swapped, added...)
+
+	if order, _ := v.playOrder(); order == fstore.PlayOrderSequential && !samePlaylist(swapped, metas) {
+		logger.Printf("swapPlaylist playing reordered playlist of %v tokens", len(metas))
+		err := v.jump(func() error { return v.VideoPlayer.PlayFiles(v.mediaFilepaths(metas)) })
+		if err != nil {
+			return err
+		}
+		v.setPlaylist(metas)
+		return nil
+	}
+	if len(added) == 0 && len(stale) == 0 {
+		v.setPlaylist(swapped)
+		return nil
+	}
+
+	// the rotation is locked so a tick does not time the playing token against a half changed playlist
+	v.rotation.lock.Lock()
+	defer v.rotation.lock.Unlock()
+	logger.Printf("swapPlaylist appending %v tokens and removing %v tokens", len(added), len(stale))
+	if len(added) > 0 {
+		err := v.VideoPlayer.AppendFiles(v.mediaFilepaths(added))
+		if err != nil {
+			return err
+		}
+	}
+
+	status, err := v.VideoPlayer.GetStatus()
+	if err != nil {
+		return err
+	}
+	kept := func(i int) bool {
+		_, ok := wanted[playlistKey(playlist[i])]
+		return ok
+	}
+	if index := status.PlaylistIndex; index >= 0 && index < len(playlist) && !kept(index) {
+		// play the next kept token, wrapping around, or the first new token appended after the old playlist
+		next := -1
+		for i := 1; i < len(playlist) && next < 0; i++ {
+			if kept((index + i) % len(playlist)) {
+				next = (index + i) % len(playlist)
+			}
+		}
+		if next < 0 {
+			next = len(playlist)
+		}
+		v.rotation.meta = nil
+		err = v.VideoPlayer.PlayIndex(next)
+		if err != nil {
+			return err
+		}
+	}
+
+	// removing from the end keeps the indexes of the remaining stale tokens valid
+	for i := len(stale) - 1; i >= 0; i-- {
+		err = v.VideoPlayer.RemoveIndex(stale[i])
+		if err != nil {
+			return err
+		}
+	}
+	v.setPlaylist(swapped)
+	v.notifyStateChange()
+	return nil
+}
+
+// playlistKey identifies a playlist entry by token and media file, a token whose media changed is a new entry
+func playlistKey(meta *fstore.FirestoreTokenMeta) string {
+	return meta.DocumentID + "/" + meta.MediaFileName()
+}
+
+// samePlaylist returns whether a and b list the same entries in the same order
+func samePlaylist(a, b []*fstore.FirestoreTokenMeta) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if playlistKey(a[i]) != playlistKey(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mediaFilepaths returns the escaped local media paths the video player expects for metas, renditions in place of transcoded media
+func (v *Viewer) mediaFilepaths(metas []*fstore.FirestoreTokenMeta) []string {
+	filepaths := make([]string, 0, len(metas))
+	for _, m := range metas {
+		filepaths = append(filepaths, url.QueryEscape(filepath.Join(v.MediaDir, v.playbackFileName(m))))
+	}
+	return filepaths
+}
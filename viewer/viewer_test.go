@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"jkurtz678/moda-viewer/config"
 	"jkurtz678/moda-viewer/fstore"
 	"jkurtz678/moda-viewer/storage"
 	"jkurtz678/moda-viewer/videoplayer"
@@ -14,10 +15,11 @@ import (
 	"os/exec"
 	"path/filepath"
 	"testing"
+	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/franela/goblin"
 	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestViewer(t *testing.T) {
@@ -110,7 +112,7 @@ func TestViewer(t *testing.T) {
 
 			// startup will block so start in own routine
 			go func() {
-				g.Assert(v.Startup()).IsNil()
+				g.Assert(v.Startup(ctx)).IsNil()
 			}()
 
 			playerStub.PlayFilesWaitGroup.Wait() // block until viewer fully starts up
@@ -140,19 +142,19 @@ func TestViewer(t *testing.T) {
 
 		g.It("should show moda logo if no account is assigned to plaque", func() {
 			playerStub.PlayFilesWaitGroup.Add(1) // ready player stub wait group
-			g.Assert(v.Startup()).IsNil()
+			g.Assert(v.Startup(ctx)).IsNil()
 			g.Assert(playerStub.ActivePlaylistFilepaths).Equal([]string{"moda-logo.png"})
 		})
 
 		g.It("should show moda logo no tokens are selected", func() {
 			plaque, err := v.ReadLocalPlaqueFile()
 			g.Assert(err).IsNil()
-			err = v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, []firestore.Update{
-				{Path: "wallet_address", Value: "test_account_id"},
+			err = v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{
+				WalletAddress: fstore.String("test_account_id"),
 			})
 			g.Assert(err).IsNil()
 			playerStub.PlayFilesWaitGroup.Add(1) // ready player stub wait group
-			g.Assert(v.Startup()).IsNil()
+			g.Assert(v.Startup(ctx)).IsNil()
 			g.Assert(playerStub.ActivePlaylistFilepaths).Equal([]string{"moda-logo.png"})
 		})
 
@@ -168,13 +170,13 @@ func TestViewer(t *testing.T) {
 
 			// add account id so that scanning screen is not shown
 			// add token meta list so that plaque will play meta
-			err = v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, []firestore.Update{
-				{Path: "token_meta_id_list", Value: []string{meta1.DocumentID, meta2.DocumentID}},
+			err = v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{
+				TokenMetaIDList: &[]string{meta1.DocumentID, meta2.DocumentID},
 			})
 			g.Assert(err).IsNil()
 
 			playerStub.PlayFilesWaitGroup.Add(1) // ready player stub wait group
-			g.Assert(v.Startup()).IsNil()
+			g.Assert(v.Startup(ctx)).IsNil()
 
 			// ensure metas are loaded
 			localMeta1, err := v.ReadMetadata(meta1.DocumentID)
@@ -241,8 +243,8 @@ func TestViewer(t *testing.T) {
 			// now local file should exist
 
 			// change remote
-			g.Assert(v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, []firestore.Update{
-				{Path: "name", Value: "update-test"},
+			g.Assert(v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{
+				Name: fstore.String("update-test"),
 			})).IsNil()
 
 			// loadPlaqueData should trigger overwriting of local file
@@ -280,7 +282,7 @@ func TestViewer(t *testing.T) {
 		g.Assert(err).IsNil()
 
 		// add token to plaques
-		err = v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, []firestore.Update{{Path: "token_meta_id_list", Value: []string{meta1.DocumentID, meta2.DocumentID}}})
+		err = v.DBClient.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{TokenMetaIDList: &[]string{meta1.DocumentID, meta2.DocumentID}})
 		g.Assert(err).IsNil()
 
 		// run load plaque data again to get updated values (and ensure local plaque is matching)
@@ -288,7 +290,7 @@ func TestViewer(t *testing.T) {
 		g.Assert(err).IsNil()
 
 		g.It("should load and create local files for token metas", func() {
-			metas, err := v.loadTokenMetas(ctx, plaque)
+			metas, _, err := v.loadTokenMetas(ctx, plaque.Plaque.TokenMetaIDList)
 			g.Assert(err).IsNil()
 			g.Assert(len(metas)).Equal(2)
 			g.Assert(metas[0].DocumentID).Equal(meta1.DocumentID)
@@ -308,10 +310,10 @@ func TestViewer(t *testing.T) {
 			g.Assert(localMeta2.TokenMeta.Name).Equal(meta2.TokenMeta.Name)
 
 			// update remote, ensure local files update
-			g.Assert(v.DBClient.UpdateTokenMeta(ctx, meta1.DocumentID, []firestore.Update{{
-				Path: "name", Value: "starry night update",
-			}})).IsNil()
-			metas, err = v.loadTokenMetas(ctx, plaque)
+			g.Assert(v.DBClient.UpdateTokenMeta(ctx, meta1.DocumentID, &fstore.TokenMetaPatch{
+				Name: fstore.String("starry night update"),
+			})).IsNil()
+			metas, _, err = v.loadTokenMetas(ctx, plaque.Plaque.TokenMetaIDList)
 			g.Assert(err).IsNil()
 			g.Assert(metas[0].DocumentID).Equal(meta1.DocumentID)
 			g.Assert(metas[0].TokenMeta.Name).Equal("starry night update")
@@ -351,6 +353,155 @@ func NewTestViewer(tmpdir string) *Viewer {
 	}
 }
 
+func TestSwapPlaylist(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+	v := NewTestViewer(t.TempDir())
+	player := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+	for _, meta := range testMetas("1", "2", "3", "4") {
+		a.NoError(v.setTokenMeta(meta))
+	}
+	load := func(ids ...string) {
+		plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: ids}}
+		a.NoError(v.setPlaque(plaque))
+		a.NoError(v.LoadAndPlayTokens(ctx, plaque))
+	}
+	playerFiles := func() []string {
+		files := make([]string, 0, len(player.ActivePlaylistFilepaths))
+		for _, path := range player.ActivePlaylistFilepaths {
+			unescaped, err := url.QueryUnescape(path)
+			a.NoError(err)
+			files = append(files, filepath.Base(unescaped))
+		}
+		return files
+	}
+
+	player.PlayFilesWaitGroup.Add(1)
+	load("m1", "m2", "m3")
+	a.Equal([]string{"s1.mp4", "s2.mp4", "s3.mp4"}, playerFiles())
+
+	// only changed tokens are swapped, the playing token carries on without the logo, which would replay the playlist
+	a.NoError(player.PlayIndex(1))
+	player.Position = 30
+	load("m2", "m3", "m4")
+	a.Equal([]string{"s2.mp4", "s3.mp4", "s4.mp4"}, playerFiles())
+	a.Equal(0, player.ActiveIndex)
+	a.Equal(30.0, player.Position)
+	a.Equal(testMetas("2", "3", "4"), v.currentPlaylist())
+
+	// a removed playing token moves on to the next kept token first
+	load("m3", "m4")
+	a.Equal([]string{"s3.mp4", "s4.mp4"}, playerFiles())
+	a.Equal(0, player.ActiveIndex)
+	a.Equal("m3", v.GetViewerState().ActiveTokenMeta.DocumentID)
+
+	// the player cannot reorder a sequential playlist, so it is replaced
+	player.PlayFilesWaitGroup.Add(1)
+	load("m4", "m3")
+	a.Equal([]string{"s4.mp4", "s3.mp4"}, playerFiles())
+
+	// the logo only shows once nothing is playable
+	load()
+	a.Equal([]string{"moda-logo.png"}, playerFiles())
+	a.Empty(v.currentPlaylist())
+}
+
+// blockingPlaqueManager runs until its context is done, like the real webview process
+type blockingPlaqueManager struct {
+	stopped chan struct{}
+}
+
+func (p *blockingPlaqueManager) InitPlaque(ctx context.Context) error {
+	<-ctx.Done()
+	close(p.stopped)
+	return nil
+}
+
+func TestStartupShutdown(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	plaqueManager := &blockingPlaqueManager{stopped: make(chan struct{})}
+	v.PlaqueManager = plaqueManager
+	playerStub := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+
+	plaque := &fstore.FirestorePlaque{DocumentID: "p1", Plaque: fstore.Plaque{WalletAddress: "test", TokenMetaIDList: []string{"m1"}}}
+	a.NoError(v.setPlaque(plaque))
+	a.NoError(v.setTokenMeta(&fstore.FirestoreTokenMeta{DocumentID: "m1", TokenMeta: fstore.TokenMeta{MediaID: "s1", MediaType: ".mp4"}}))
+
+	// offline listener keeps retrying until shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	playerStub.PlayFilesWaitGroup.Add(1)
+	stopped := make(chan error)
+	go func() {
+		stopped <- v.Startup(ctx)
+	}()
+	playerStub.PlayFilesWaitGroup.Wait()
+
+	cancel()
+	select {
+	case err := <-stopped:
+		a.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Startup did not return after shutdown")
+	}
+
+	// plaque process was stopped before startup returned
+	select {
+	case <-plaqueManager.stopped:
+	default:
+		t.Fatal("plaque was not stopped")
+	}
+}
+
+func TestStartupLocalDB(t *testing.T) {
+	a := assert.New(t)
+	tmpdir := t.TempDir()
+	v := NewTestViewer(tmpdir)
+	v.PlaqueManager = &blockingPlaqueManager{stopped: make(chan struct{})}
+	playerStub := v.VideoPlayer.(*videoplayer.VideoPlayerStub)
+	client, err := fstore.NewLocalClient(filepath.Join(tmpdir, "db"))
+	a.NoError(err)
+	client.PollInterval = 10 * time.Millisecond
+	v.DBClient = client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	meta, err := client.CreateTokenMeta(ctx, &fstore.TokenMeta{Name: "m1", MediaID: "s1", MediaType: ".mp4"})
+	a.NoError(err)
+
+	// a new plaque is created in the local database
+	stopped := make(chan error)
+	go func() {
+		stopped <- v.Startup(ctx)
+	}()
+	a.Eventually(func() bool { return v.GetViewerState().State == ViewerStateQrScan }, 5*time.Second, 10*time.Millisecond)
+	plaque, err := v.currentPlaque()
+	a.NoError(err)
+
+	// changes to the local plaque file play the new tokens
+	playerStub.PlayFilesWaitGroup.Add(1)
+	a.NoError(client.UpdatePlaque(ctx, plaque.DocumentID, &fstore.PlaquePatch{
+		WalletAddress:   fstore.String("test"),
+		TokenMetaIDList: &[]string{meta.DocumentID},
+	}))
+	playerStub.PlayFilesWaitGroup.Wait()
+	a.Eventually(func() bool { return v.GetViewerState().State == ViewerStateDisplay }, 5*time.Second, 10*time.Millisecond)
+	a.Equal(meta.DocumentID, v.GetViewerState().ActiveTokenMeta.DocumentID)
+
+	cancel()
+	a.NoError(<-stopped)
+}
+
+func TestNewViewerPlayer(t *testing.T) {
+	a := assert.New(t)
+	cfg := config.Default()
+	a.IsType(&videoplayer.VLCPlayer{}, NewViewer(cfg, nil, nil).VideoPlayer)
+
+	cfg.Player = config.PlayerMPV
+	a.IsType(&videoplayer.MPVPlayer{}, NewViewer(cfg, nil, nil).VideoPlayer)
+}
+
 func TestCMDLogger(t *testing.T) {
 	t.Skip()
 	cmd := exec.Command("vlc", "../media/skate.mp4")
@@ -1,32 +1,49 @@
 package webview
 
 import (
+	"context"
+	"jkurtz678/moda-viewer/process"
 	"log"
 	"os/exec"
 )
 
 type PlaqueManager interface {
-	InitPlaque()
+	InitPlaque(ctx context.Context) error
 	//navigateURL(tokenMetaID string)
 }
 
 type PythonWebview struct {
+	URL string // url of the plaque page served by the plaque api
+
+	supervisor *process.Supervisor // restarts the webview if it exits
+}
+
+// NewPythonWebview returns a webview which shows the plaque page at url
+func NewPythonWebview(url string) *PythonWebview {
+	pw := &PythonWebview{URL: url}
+	pw.supervisor = process.NewSupervisor("webview", pw.command)
+	return pw
 }
 
-func (pw *PythonWebview) InitPlaque() {
+// InitPlaque runs the plaque webview, restarting it whenever it exits, until ctx is done and the webview has been stopped
+func (pw *PythonWebview) InitPlaque(ctx context.Context) error {
 	log.Printf("PythonWebview.InitPlaque() - running plaque webview")
-	// check if python3 command exists
+	return pw.supervisor.Run(ctx)
+}
+
+// ProcessStatus returns restart count and last exit reason of the webview process
+func (pw *PythonWebview) ProcessStatus() process.Status {
+	return pw.supervisor.Status()
+}
+
+// command returns the command which starts the webview with python3, or python if python3 is not found
+func (pw *PythonWebview) command() *exec.Cmd {
+	python := "python"
 	_, err := exec.LookPath("python3")
 	if err == nil {
-		// python3 command exists, use that to run python
-		cmd := exec.Command("python3", "webview/plaque_webview.py", "http://localhost:8080")
-		log.Fatalf("PythonWebview.InitPlaque() - error %v", cmd.Run())
-		return
+		python = "python3"
 	}
-
-	// python3 does not exist, use python as argument
-	cmd := exec.Command("python", "webview/plaque_webview.py", "http://localhost:8080")
-	log.Fatalf("PythonWebview.InitPlaque() - error %v", cmd.Run())
+	return exec.Command(python, "webview/plaque_webview.py", pw.URL)
 }
 
 /* func (pq *PythonWebview) navigateURL(tokenMetaID string) {
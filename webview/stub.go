@@ -1,9 +1,12 @@
 package webview
 
+import "context"
+
 type PlaqueManagerStub struct {
 	PlaqueInit bool
 }
 
-func (p *PlaqueManagerStub) InitPlaque() {
+func (p *PlaqueManagerStub) InitPlaque(ctx context.Context) error {
 	p.PlaqueInit = true
+	return nil
 }